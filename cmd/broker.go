@@ -12,6 +12,7 @@ import (
 
 	"github.com/TheThingsNetwork/ttn/core/adapters/http"
 	"github.com/TheThingsNetwork/ttn/core/components/broker"
+	dbutil "github.com/TheThingsNetwork/ttn/core/storage"
 	"github.com/TheThingsNetwork/ttn/utils/stats"
 	"github.com/TheThingsNetwork/ttn/utils/tokenkey"
 	"github.com/apex/log"
@@ -59,6 +60,14 @@ devices (with their network session keys) with the Broker.
 		statusAdapter.Bind(http.StatusPage{})
 
 		// Storage
+		var wrappers []dbutil.Wrapper
+		if viper.GetBool("broker.instrument-storage") {
+			wrappers = append(wrappers, dbutil.WithInstrument(dbutil.StatsCollector("broker.storage.devices")))
+		}
+		if ttl := viper.GetDuration("broker.cache-ttl"); ttl > 0 {
+			wrappers = append(wrappers, dbutil.WithCache(ttl, viper.GetInt("broker.cache-size")))
+		}
+
 		var dbDev broker.NetworkController
 		devDBString := viper.GetString("broker.db-devices")
 		switch {
@@ -69,7 +78,7 @@ devices (with their network session keys) with the Broker.
 				ctx.WithError(err).Fatal("Invalid devices database path")
 			}
 
-			dbDev, err = broker.NewNetworkController(dbPath)
+			dbDev, err = broker.NewNetworkController(dbPath, wrappers...)
 			if err != nil {
 				ctx.WithError(err).Fatal("Could not create local storage")
 			}
@@ -99,6 +108,12 @@ devices (with their network session keys) with the Broker.
 			ctx.WithError(fmt.Errorf("Invalid applications database string. Format: \"boltdb:/path/to.db\".")).Fatal("Could not instantiate local storage")
 		}
 
+		// Frame counters
+		maxFCntGap := viper.GetInt("broker.max-fcnt-gap")
+		if maxFCntGap < 1 || maxFCntGap > 65535 {
+			ctx.WithField("MaxFCntGap", maxFCntGap).Fatal("Invalid maximum frame counter gap, expected between 1 and 65535")
+		}
+
 		// Broker
 		broker := broker.New(
 			broker.Components{
@@ -110,6 +125,8 @@ devices (with their network session keys) with the Broker.
 				NetAddrUp:        fmt.Sprintf("%s:%d", viper.GetString("broker.uplink-address"), viper.GetInt("broker.uplink-port")),
 				NetAddrDown:      fmt.Sprintf("%s:%d", viper.GetString("broker.downlink-address"), viper.GetInt("broker.downlink-port")),
 				TokenKeyProvider: tokenkey.NewHTTPProvider(fmt.Sprintf("%s/key", viper.GetString("broker.account-server")), viper.GetString("broker.oauth2-keyfile")),
+				MinJoinInterval:  viper.GetDuration("broker.min-join-interval"),
+				MaxFCntGap:       uint32(maxFCntGap),
 			},
 		)
 
@@ -129,6 +146,14 @@ func init() {
 	brokerCmd.Flags().String("db-devices", "boltdb:/tmp/ttn_broker_devices.db", "Devices Database connection")
 	viper.BindPFlag("broker.db-devices", brokerCmd.Flags().Lookup("db-devices"))
 
+	brokerCmd.Flags().Bool("instrument-storage", false, "Report the duration and outcome of devices database operations in the stats")
+	viper.BindPFlag("broker.instrument-storage", brokerCmd.Flags().Lookup("instrument-storage"))
+
+	brokerCmd.Flags().Duration("cache-ttl", 0, "The time during which devices database reads are kept in memory, use 0 to disable")
+	brokerCmd.Flags().Int("cache-size", 10000, "The maximum number of devices database reads kept in memory, use 0 for no limit")
+	viper.BindPFlag("broker.cache-ttl", brokerCmd.Flags().Lookup("cache-ttl"))
+	viper.BindPFlag("broker.cache-size", brokerCmd.Flags().Lookup("cache-size"))
+
 	brokerCmd.Flags().String("status-address", "0.0.0.0", "The IP address to listen for serving status information")
 	brokerCmd.Flags().Int("status-port", 10701, "The port of the status server, use 0 to disable")
 	viper.BindPFlag("broker.status-address", brokerCmd.Flags().Lookup("status-address"))
@@ -144,6 +169,12 @@ func init() {
 	viper.BindPFlag("broker.downlink-address", brokerCmd.Flags().Lookup("downlink-address"))
 	viper.BindPFlag("broker.downlink-port", brokerCmd.Flags().Lookup("downlink-port"))
 
+	brokerCmd.Flags().Duration("min-join-interval", 0, "The minimum time between two accepted joins of a device, use 0 to disable")
+	viper.BindPFlag("broker.min-join-interval", brokerCmd.Flags().Lookup("min-join-interval"))
+
+	brokerCmd.Flags().Int("max-fcnt-gap", 16384, "The maximum gap between the last accepted frame counter of a device and a new one, between 1 and 65535")
+	viper.BindPFlag("broker.max-fcnt-gap", brokerCmd.Flags().Lookup("max-fcnt-gap"))
+
 	brokerCmd.Flags().String("account-server", "https://account.thethingsnetwork.org", "The address of the OAuth 2.0 server")
 	viper.BindPFlag("broker.account-server", brokerCmd.Flags().Lookup("account-server"))
 
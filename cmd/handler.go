@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"encoding/hex"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -12,8 +13,11 @@ import (
 	"github.com/TheThingsNetwork/ttn/core/adapters/fields"
 	"github.com/TheThingsNetwork/ttn/core/adapters/http"
 	handlerMQTT "github.com/TheThingsNetwork/ttn/core/adapters/mqtt"
+	"github.com/TheThingsNetwork/ttn/core/band"
 	"github.com/TheThingsNetwork/ttn/core/components/broker"
 	"github.com/TheThingsNetwork/ttn/core/components/handler"
+	dbutil "github.com/TheThingsNetwork/ttn/core/storage"
+	"github.com/TheThingsNetwork/ttn/core/types"
 	ttnMQTT "github.com/TheThingsNetwork/ttn/mqtt"
 	"github.com/TheThingsNetwork/ttn/utils/stats"
 	"github.com/apex/log"
@@ -60,6 +64,18 @@ The Handler is the bridge between The Things Network and applications.
 		statusAdapter.Bind(http.Healthz{})
 		statusAdapter.Bind(http.StatusPage{})
 
+		// Storages instrumentation and read cache, the cache hits not being measured
+		storageWrappers := func(name string) []dbutil.Wrapper {
+			var wrappers []dbutil.Wrapper
+			if viper.GetBool("handler.instrument-storage") {
+				wrappers = append(wrappers, dbutil.WithInstrument(dbutil.StatsCollector("handler.storage."+name)))
+			}
+			if ttl := viper.GetDuration("handler.cache-ttl"); ttl > 0 {
+				wrappers = append(wrappers, dbutil.WithCache(ttl, viper.GetInt("handler.cache-size")))
+			}
+			return wrappers
+		}
+
 		// In-memory devices storage
 		var devicesDB handler.DevStorage
 
@@ -72,7 +88,7 @@ The Handler is the bridge between The Things Network and applications.
 				ctx.WithError(err).Fatal("Invalid devices database path")
 			}
 
-			devicesDB, err = handler.NewDevStorage(devDBPath)
+			devicesDB, err = handler.NewDevStorage(devDBPath, storageWrappers("devices")...)
 			if err != nil {
 				ctx.WithError(err).Fatal("Could not create local devices storage")
 			}
@@ -94,7 +110,7 @@ The Handler is the bridge between The Things Network and applications.
 				ctx.WithError(err).Fatal("Invalid packets database path")
 			}
 
-			packetsDB, err = handler.NewPktStorage(pktDBPath, 1)
+			packetsDB, err = handler.NewPktStorage(pktDBPath, 1, storageWrappers("packets")...)
 			if err != nil {
 				ctx.WithError(err).Fatal("Could not create local packets storage")
 			}
@@ -137,6 +153,48 @@ The Handler is the bridge between The Things Network and applications.
 			),
 		)
 
+		// Applications for which identical downlinks are only queued once
+		var dedupDownlinks []types.AppEUI
+		if dedupStr := viper.GetString("handler.dedup-downlinks"); dedupStr != "" {
+			for _, str := range strings.Split(dedupStr, ",") {
+				appEUI, err := types.ParseAppEUI(strings.Trim(str, " "))
+				if err != nil {
+					ctx.WithError(err).Fatal("Invalid application EUI for downlink de-duplication")
+				}
+				dedupDownlinks = append(dedupDownlinks, appEUI)
+			}
+		}
+
+		// Regional parameters
+		region, err := band.Get(viper.GetString("handler.region"))
+		if err != nil {
+			ctx.WithError(err).WithField("Supported", band.Regions()).Fatal("Invalid region")
+		}
+
+		// Network identifier
+		var netID [3]byte
+		if netIDStr := viper.GetString("handler.net-id"); netIDStr != "" {
+			data, err := hex.DecodeString(netIDStr)
+			if err != nil || len(data) != 3 {
+				ctx.WithField("NetID", netIDStr).Fatal("Invalid network identifier")
+			}
+			copy(netID[:], data)
+		}
+
+		// Device addresses prefix
+		var devAddrPrefix [4]byte
+		devAddrPrefixLength := viper.GetInt("handler.devaddr-prefix-length")
+		if devAddrPrefixLength < 0 || devAddrPrefixLength > 32 {
+			ctx.WithField("Length", devAddrPrefixLength).Fatal("Invalid device address prefix length")
+		}
+		if prefixStr := viper.GetString("handler.devaddr-prefix"); prefixStr != "" {
+			data, err := hex.DecodeString(prefixStr)
+			if err != nil || len(data) != 4 {
+				ctx.WithField("Prefix", prefixStr).Fatal("Invalid device address prefix")
+			}
+			copy(devAddrPrefix[:], data)
+		}
+
 		// Handler
 		handler := handler.New(
 			handler.Components{
@@ -150,6 +208,15 @@ The Handler is the bridge between The Things Network and applications.
 				PublicNetAddr:          fmt.Sprintf("%s:%d", viper.GetString("handler.public-address"), viper.GetInt("handler.public-port")),
 				PrivateNetAddr:         fmt.Sprintf("%s:%d", viper.GetString("handler.internal-address"), viper.GetInt("handler.internal-port")),
 				PrivateNetAddrAnnounce: fmt.Sprintf("%s:%d", viper.GetString("handler.internal-address-announce"), viper.GetInt("handler.internal-port")),
+				MaxDevicesPerApp:       uint(viper.GetInt("handler.max-devices-per-app")),
+				DedupDownlinks:         dedupDownlinks,
+				MaxMetadata:            uint(viper.GetInt("handler.max-metadata")),
+				BufferDelay:            viper.GetDuration("handler.buffer-delay"),
+				DevStatusInterval:      viper.GetDuration("handler.dev-status-interval"),
+				Band:                   region,
+				NetID:                  netID,
+				DevAddrPrefix:          devAddrPrefix,
+				DevAddrPrefixLength:    uint(devAddrPrefixLength),
 			},
 		)
 
@@ -200,4 +267,38 @@ func init() {
 
 	handlerCmd.Flags().String("ttn-broker", "localhost:1781", "The address of the TTN broker (downlink)")
 	viper.BindPFlag("handler.ttn-broker", handlerCmd.Flags().Lookup("ttn-broker"))
+
+	handlerCmd.Flags().Int("max-devices-per-app", 0, "The maximum number of devices per application, use 0 to disable")
+	viper.BindPFlag("handler.max-devices-per-app", handlerCmd.Flags().Lookup("max-devices-per-app"))
+
+	handlerCmd.Flags().Int("max-metadata", 0, "The maximum number of gateway metadata kept per uplink, use 0 to disable")
+	viper.BindPFlag("handler.max-metadata", handlerCmd.Flags().Lookup("max-metadata"))
+
+	handlerCmd.Flags().Duration("buffer-delay", 300*time.Millisecond, "The time during which duplicates of a packet received by several gateways are gathered")
+	viper.BindPFlag("handler.buffer-delay", handlerCmd.Flags().Lookup("buffer-delay"))
+
+	handlerCmd.Flags().Duration("dev-status-interval", 0, "The interval at which devices are asked for their battery level and link margin, use 0 to disable")
+	viper.BindPFlag("handler.dev-status-interval", handlerCmd.Flags().Lookup("dev-status-interval"))
+
+	handlerCmd.Flags().String("region", band.EU863870, "The region whose regional parameters are used to answer devices")
+	viper.BindPFlag("handler.region", handlerCmd.Flags().Lookup("region"))
+
+	handlerCmd.Flags().String("net-id", "0E0E0E", "The network identifier sent to devices on join, in hexadecimal")
+	viper.BindPFlag("handler.net-id", handlerCmd.Flags().Lookup("net-id"))
+
+	handlerCmd.Flags().String("devaddr-prefix", "", "The prefix of the device addresses given on join, in hexadecimal over 4 bytes (e.g. 26011400)")
+	handlerCmd.Flags().Int("devaddr-prefix-length", 0, "The number of significant bits of the device addresses prefix, use 0 to derive it from the network identifier")
+	viper.BindPFlag("handler.devaddr-prefix", handlerCmd.Flags().Lookup("devaddr-prefix"))
+	viper.BindPFlag("handler.devaddr-prefix-length", handlerCmd.Flags().Lookup("devaddr-prefix-length"))
+
+	handlerCmd.Flags().Bool("instrument-storage", false, "Report the duration and outcome of storage operations in the stats")
+	viper.BindPFlag("handler.instrument-storage", handlerCmd.Flags().Lookup("instrument-storage"))
+
+	handlerCmd.Flags().Duration("cache-ttl", 0, "The time during which storage reads are kept in memory, use 0 to disable")
+	handlerCmd.Flags().Int("cache-size", 10000, "The maximum number of storage reads kept in memory, use 0 for no limit")
+	viper.BindPFlag("handler.cache-ttl", handlerCmd.Flags().Lookup("cache-ttl"))
+	viper.BindPFlag("handler.cache-size", handlerCmd.Flags().Lookup("cache-size"))
+
+	handlerCmd.Flags().String("dedup-downlinks", "", "Comma-separated list of AppEUIs for which a downlink identical to the last queued one is discarded")
+	viper.BindPFlag("handler.dedup-downlinks", handlerCmd.Flags().Lookup("dedup-downlinks"))
 }
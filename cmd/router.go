@@ -14,6 +14,7 @@ import (
 	"github.com/TheThingsNetwork/ttn/core/adapters/udp"
 	"github.com/TheThingsNetwork/ttn/core/components/router"
 	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/utils/stats"
 	"github.com/apex/log"
 	"github.com/spf13/cobra"
@@ -49,6 +50,7 @@ the gateway's duty cycle is (almost) full.`,
 			"uplink":        fmt.Sprintf("%s:%d", viper.GetString("router.uplink-address"), viper.GetInt("router.uplink-port")),
 			"downlink":      fmt.Sprintf("%s:%d", viper.GetString("router.downlink-address"), viper.GetInt("router.downlink-port")),
 			"brokers":       viper.GetString("router.brokers"),
+			"blacklist":     viper.GetString("router.blacklist"),
 		}).Info("Using Configuration")
 	},
 	Run: func(cmd *cobra.Command, args []string) {
@@ -140,6 +142,18 @@ the gateway's duty cycle is (almost) full.`,
 			brokers = append(brokers, broker)
 		}
 
+		// Blacklisted gateways
+		var blacklist []types.GatewayEUI
+		if blacklistStr := viper.GetString("router.blacklist"); blacklistStr != "" {
+			for _, str := range strings.Split(blacklistStr, ",") {
+				eui, err := types.ParseGatewayEUI(strings.Trim(str, " "))
+				if err != nil {
+					ctx.WithError(err).Fatal("Invalid gateway EUI to blacklist")
+				}
+				blacklist = append(blacklist, eui)
+			}
+		}
+
 		// Router
 		router := router.New(
 			router.Components{
@@ -150,10 +164,29 @@ the gateway's duty cycle is (almost) full.`,
 				GtwStorage:  dg,
 			},
 			router.Options{
-				NetAddr: fmt.Sprintf("%s:%d", viper.GetString("router.downlink-address"), viper.GetInt("router.downlink-port")),
+				NetAddr:            fmt.Sprintf("%s:%d", viper.GetString("router.downlink-address"), viper.GetInt("router.downlink-port")),
+				BrokerTimeout:      viper.GetDuration("router.broker-timeout"),
+				MinGateways:        uint(viper.GetInt("router.min-gateways")),
+				GatewayStaleness:   viper.GetDuration("router.gateway-staleness"),
+				JoinSuppression:    viper.GetDuration("router.join-suppression"),
+				StatusHistory:      viper.GetInt("router.status-history"),
+				StatusRate:         viper.GetFloat64("router.status-rate"),
+				StatusBurst:        uint(viper.GetInt("router.status-burst")),
+				MaxConcurrentSends: viper.GetInt("router.broker-concurrency"),
 			},
 		)
 
+		statusAdapter.Bind(http.Readyz{Check: router.Healthy})
+
+		for _, eui := range blacklist {
+			router.BlacklistGateway(eui)
+			ctx.WithField("GatewayEUI", eui).Info("Gateway blacklisted")
+		}
+
+		if eviction := viper.GetDuration("router.gateway-eviction"); eviction > 0 {
+			router.StartSweeper(eviction/2, eviction)
+		}
+
 		// Gateway Adapter
 		gtwNet := fmt.Sprintf("%s:%d", viper.GetString("router.uplink-address"), viper.GetInt("router.uplink-port"))
 		err := udp.Start(
@@ -206,4 +239,33 @@ func init() {
 
 	routerCmd.Flags().String("brokers", "localhost:1881", "Comma-separated list of brokers")
 	viper.BindPFlag("router.brokers", routerCmd.Flags().Lookup("brokers"))
+
+	routerCmd.Flags().Duration("broker-timeout", 2*time.Second, "The time after which a broker that hasn't answered is abandoned")
+	viper.BindPFlag("router.broker-timeout", routerCmd.Flags().Lookup("broker-timeout"))
+
+	routerCmd.Flags().Int("broker-concurrency", 16, "The number of brokers a packet is forwarded to concurrently")
+	viper.BindPFlag("router.broker-concurrency", routerCmd.Flags().Lookup("broker-concurrency"))
+
+	routerCmd.Flags().Int("min-gateways", 0, "The number of gateways that must have reported their status recently for the router to be ready, use 0 to disable")
+	viper.BindPFlag("router.min-gateways", routerCmd.Flags().Lookup("min-gateways"))
+
+	routerCmd.Flags().Duration("gateway-staleness", 2*time.Minute, "The time after which a gateway status report is considered outdated")
+	viper.BindPFlag("router.gateway-staleness", routerCmd.Flags().Lookup("gateway-staleness"))
+
+	routerCmd.Flags().Duration("join-suppression", 5*time.Second, "The time during which further join requests of a device through the same gateway are not forwarded to the brokers")
+	viper.BindPFlag("router.join-suppression", routerCmd.Flags().Lookup("join-suppression"))
+
+	routerCmd.Flags().Int("status-history", 10, "The number of status reports kept in memory per gateway")
+	viper.BindPFlag("router.status-history", routerCmd.Flags().Lookup("status-history"))
+
+	routerCmd.Flags().Float64("status-rate", 1, "The number of status reports stored per second and per gateway, the excess is coalesced, use 0 to disable")
+	routerCmd.Flags().Int("status-burst", 5, "The number of status reports a gateway may send in a row before the rate applies")
+	viper.BindPFlag("router.status-rate", routerCmd.Flags().Lookup("status-rate"))
+	viper.BindPFlag("router.status-burst", routerCmd.Flags().Lookup("status-burst"))
+
+	routerCmd.Flags().Duration("gateway-eviction", time.Hour, "The time after which a gateway that stopped reporting its status is forgotten, use 0 to disable")
+	viper.BindPFlag("router.gateway-eviction", routerCmd.Flags().Lookup("gateway-eviction"))
+
+	routerCmd.Flags().String("blacklist", "", "Comma-separated list of gateway EUIs whose traffic is not forwarded")
+	viper.BindPFlag("router.blacklist", routerCmd.Flags().Lookup("blacklist"))
 }
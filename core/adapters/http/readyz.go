@@ -0,0 +1,33 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"net/http"
+)
+
+// Readyz defines a handler to check whether a component is ready to handle traffic via a GET
+// request. It answers with a 503 and the reason when the given Check fails.
+//
+// It listens to requests of the form: [GET] /readyz
+type Readyz struct {
+	Check func() error
+}
+
+// URL implements the http.Handler interface
+func (p Readyz) URL() string {
+	return "/readyz"
+}
+
+// Handle implements the http.Handler interface
+func (p Readyz) Handle(w http.ResponseWriter, req *http.Request) error {
+	if err := p.Check(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+	return nil
+}
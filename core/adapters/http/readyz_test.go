@@ -0,0 +1,51 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	"github.com/smartystreets/assertions"
+)
+
+func TestReadyzURL(t *testing.T) {
+	a := assertions.New(t)
+
+	h := Readyz{}
+
+	a.So(h.URL(), assertions.ShouldEqual, "/readyz")
+}
+
+func TestReadyzHandleReady(t *testing.T) {
+	a := assertions.New(t)
+
+	h := Readyz{Check: func() error { return nil }}
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rw := NewResponseWriter()
+
+	err := h.Handle(&rw, req)
+	a.So(err, assertions.ShouldBeNil)
+	a.So(rw.TheStatus, assertions.ShouldEqual, 200)
+	a.So(string(rw.TheBody), assertions.ShouldEqual, "ok")
+}
+
+func TestReadyzHandleNotReady(t *testing.T) {
+	a := assertions.New(t)
+
+	h := Readyz{Check: func() error { return errors.New(errors.Operational, "No broker configured") }}
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rw := NewResponseWriter()
+
+	err := h.Handle(&rw, req)
+	a.So(err, assertions.ShouldNotBeNil)
+	a.So(rw.TheStatus, assertions.ShouldEqual, 503)
+	a.So(string(rw.TheBody), assertions.ShouldContainSubstring, "No broker configured")
+}
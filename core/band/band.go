@@ -0,0 +1,109 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package band
+
+import (
+	"fmt"
+
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+)
+
+// Band gives the regional parameters used to answer devices of a given region
+type Band interface {
+	RX1Offset() uint8          // The data rate offset between uplinks and RX1 downlinks
+	RX1Power() uint32          // The transmit power of RX1 downlinks, in dBm
+	RX2Params() RX2Params      // The fixed parameters of the RX2 window
+	CFList() [5]uint32         // The frequencies of the additional channels given to activated devices, in Hz
+	DefaultChannels() []uint32 // The frequencies every device of the region listens on, in Hz
+}
+
+// RX2Params gathers the parameters of the RX2 window
+type RX2Params struct {
+	Frequency float32 // In MHz
+	DataRate  string  // Of the form SFxxBWyyy
+	Power     uint32  // In dBm
+}
+
+// Available regions
+const (
+	EU863870 = "EU_863_870"
+)
+
+// bands references all supported regions
+var bands = map[string]Band{
+	EU863870: band{
+		rx1Offset: 0,
+		rx1Power:  14,
+		rx2: RX2Params{
+			Frequency: 869.525,
+			DataRate:  "SF9BW125",
+			Power:     27,
+		},
+		cfList:          [5]uint32{867100000, 867300000, 867500000, 867700000, 867900000},
+		defaultChannels: []uint32{868100000, 868300000, 868500000},
+	},
+}
+
+// ErrUnknownRegion is the fault of the error returned when looking up a region that isn't supported
+type ErrUnknownRegion struct {
+	Region string // The region looked up
+}
+
+// Error implements the error interface
+func (e ErrUnknownRegion) Error() string {
+	return fmt.Sprintf("Unknown region %q", e.Region)
+}
+
+// Get retrieves the band associated to the given region. It fails with an ErrUnknownRegion fault
+// when the region isn't supported.
+func Get(region string) (Band, error) {
+	b, ok := bands[region]
+	if !ok {
+		return nil, errors.New(errors.Structural, ErrUnknownRegion{Region: region})
+	}
+	return b, nil
+}
+
+// Regions lists the supported regions
+func Regions() []string {
+	var regions []string
+	for region := range bands {
+		regions = append(regions, region)
+	}
+	return regions
+}
+
+// band implements the band.Band interface
+type band struct {
+	rx1Offset       uint8
+	rx1Power        uint32
+	rx2             RX2Params
+	cfList          [5]uint32
+	defaultChannels []uint32
+}
+
+// RX1Offset implements the band.Band interface
+func (b band) RX1Offset() uint8 {
+	return b.rx1Offset
+}
+
+// RX1Power implements the band.Band interface
+func (b band) RX1Power() uint32 {
+	return b.rx1Power
+}
+
+// RX2Params implements the band.Band interface
+func (b band) RX2Params() RX2Params {
+	return b.rx2
+}
+
+// CFList implements the band.Band interface
+func (b band) CFList() [5]uint32 {
+	return b.cfList
+}
+
+// DefaultChannels implements the band.Band interface
+func (b band) DefaultChannels() []uint32 {
+	return append([]uint32{}, b.defaultChannels...)
+}
@@ -0,0 +1,66 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package band
+
+import (
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+)
+
+func TestGet(t *testing.T) {
+	for _, region := range Regions() {
+		Desc(t, "Get a complete band for %s", region)
+
+		// Operate
+		b, err := Get(region)
+		FatalUnless(t, err)
+		rx2 := b.RX2Params()
+		_, _, errDatr := dutycycle.ParseDatr(rx2.DataRate)
+		_, errSubBand := dutycycle.GetSubBand(rx2.Frequency)
+
+		// Check
+		CheckErrors(t, nil, errDatr)
+		CheckErrors(t, nil, errSubBand)
+		Check(t, true, rx2.Power > 0, "RX2 power")
+		Check(t, true, b.RX1Power() > 0, "RX1 power")
+		Check(t, true, len(b.DefaultChannels()) > 0, "Default channels")
+		for _, freq := range append(b.DefaultChannels(), b.CFList()[:]...) {
+			if freq == 0 {
+				continue
+			}
+			if _, err := dutycycle.GetSubBand(float32(freq) / 1e6); err != nil {
+				t.Errorf("Channel %d isn't within the region", freq)
+			}
+		}
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Get an unknown region")
+
+		// Operate
+		_, err := Get("XX_123_456")
+
+		// Check
+		CheckErrors(t, ErrStructural, err)
+		Check(t, ErrUnknownRegion{Region: "XX_123_456"}, err.(errors.Failure).Fault, "Faults")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Get an empty region")
+
+		// Operate
+		_, err := Get("")
+
+		// Check
+		CheckErrors(t, ErrStructural, err)
+		Check(t, ErrUnknownRegion{Region: ""}, err.(errors.Failure).Fault, "Faults")
+	}
+}
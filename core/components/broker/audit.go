@@ -0,0 +1,68 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// Device identifies a device session known by the broker
+type Device struct {
+	AppEUI   []byte
+	DevEUI   []byte
+	DevAddr  []byte
+	LastSeen time.Time // The last time an uplink of the device was accepted, zero if never
+}
+
+// ListByNwkSKey lists all devices whose session relies on the given network session key. It is
+// meant for key audits only and is on purpose not exposed through the broker manager service.
+// Every known device is scanned, which makes it O(n).
+func (b component) ListByNwkSKey(key types.NwkSKey) ([]Device, error) {
+	entries, err := b.NetworkController.readByNwkSKey(key)
+	if err != nil {
+		b.Ctx.WithError(err).Debug("Unable to list devices by NwkSKey")
+		return nil, err
+	}
+	return toDevices(entries), nil
+}
+
+// FindByDevEUI lists the devices with the given DevEUI, whatever their application. A DevEUI
+// should be unique, but nothing prevents it from being registered in several applications.
+// Every known device is scanned, which makes it O(n).
+func (b component) FindByDevEUI(devEUI types.DevEUI) ([]Device, error) {
+	entries, err := b.NetworkController.readByDevEUI(devEUI[:])
+	if err != nil {
+		b.Ctx.WithError(err).Debug("Unable to find devices by DevEUI")
+		return nil, err
+	}
+	return toDevices(entries), nil
+}
+
+// DeleteDevices removes all devices of an application, when it is offboarded, and gives the number
+// of devices removed. Like the audits, it is on purpose not exposed through the broker manager
+// service. Every known device is scanned, which makes it O(n).
+func (b component) DeleteDevices(appEUI types.AppEUI) (int, error) {
+	n, err := b.NetworkController.deleteAll(appEUI[:])
+	if err != nil {
+		b.Ctx.WithError(err).Debug("Unable to delete devices of application")
+		return n, err
+	}
+	b.Ctx.WithField("AppEUI", appEUI).WithField("Deleted", n).Info("Deleted devices of application")
+	return n, nil
+}
+
+func toDevices(entries []devEntry) []Device {
+	var devices []Device
+	for _, entry := range entries {
+		devices = append(devices, Device{
+			AppEUI:   entry.AppEUI,
+			DevEUI:   entry.DevEUI,
+			DevAddr:  entry.DevAddr,
+			LastSeen: entry.LastSeen,
+		})
+	}
+	return devices
+}
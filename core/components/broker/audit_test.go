@@ -0,0 +1,136 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+)
+
+func TestFindByDevEUI(t *testing.T) {
+	dbPath := path.Join(os.TempDir(), "TestBrokerFindByDevEUI.db")
+	defer func() {
+		os.Remove(dbPath)
+	}()
+
+	nc, err := NewNetworkController(dbPath)
+	FatalUnless(t, err)
+	defer nc.done()
+
+	entries := []devEntry{
+		{
+			DevAddr: []byte{1, 1, 1, 1},
+			Dialer:  NewDialer([]byte("url")),
+			AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+		},
+		{
+			DevAddr: []byte{1, 1, 1, 1},
+			Dialer:  NewDialer([]byte("url")),
+			AppEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+			DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		},
+		{
+			DevAddr: []byte{3, 3, 3, 3},
+			Dialer:  NewDialer([]byte("url")),
+			AppEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+			DevEUI:  []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		},
+	}
+	for _, entry := range entries {
+		FatalUnless(t, nc.upsert(entry))
+	}
+	br := New(Components{NetworkController: nc, Ctx: GetLogger(t, "Broker")}, Options{})
+
+	// --------------------
+
+	{
+		Desc(t, "Find a device sharing its DevAddr with another one")
+
+		// Expect
+		var wantErr *string
+		var wantDevices = []Device{
+			{
+				AppEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				DevAddr: []byte{1, 1, 1, 1},
+			},
+		}
+
+		// Operate
+		devices, err := br.FindByDevEUI(types.DevEUI{2, 2, 2, 2, 2, 2, 2, 2})
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDevices, devices, "Devices")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Find an unknown device")
+
+		// Expect
+		var wantErr *string
+		var wantDevices []Device
+
+		// Operate
+		devices, err := br.FindByDevEUI(types.DevEUI{4, 4, 4, 4, 4, 4, 4, 4})
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDevices, devices, "Devices")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Find a device after an uplink -> LastSeen exposed")
+
+		// Build
+		_, err := nc.setFCntUp(entries[2].DevAddr, entries[2].AppEUI, entries[2].DevEUI, 0, 1)
+		FatalUnless(t, err)
+
+		// Expect
+		var wantErr *string
+
+		// Operate
+		devices, err := br.FindByDevEUI(types.DevEUI{3, 3, 3, 3, 3, 3, 3, 3})
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, 1, len(devices), "Devices")
+		if len(devices) == 1 {
+			Check(t, true, time.Since(devices[0].LastSeen) < time.Minute, "LastSeen")
+		}
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Fail to scan devices -> Operational")
+
+		// Build
+		nc := NewMockNetworkController()
+		nc.Failures["readByDevEUI"] = errors.New(errors.Operational, "Mock Error")
+		br := New(Components{NetworkController: nc, Ctx: GetLogger(t, "Broker")}, Options{})
+
+		// Expect
+		var wantErr = ErrOperational
+		var wantDevices []Device
+
+		// Operate
+		devices, err := br.FindByDevEUI(types.DevEUI{1, 1, 1, 1, 1, 1, 1, 1})
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDevices, devices, "Devices")
+	}
+}
@@ -6,8 +6,10 @@ package broker
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
 	"github.com/TheThingsNetwork/ttn/utils/stats"
 	"github.com/TheThingsNetwork/ttn/utils/tokenkey"
@@ -24,8 +26,19 @@ type component struct {
 	NetAddrDown      string
 	TokenKeyProvider tokenkey.Provider
 	MaxDevNonces     uint
+	MinJoinInterval  time.Duration
+	MaxFCntGap       uint32
 }
 
+// maxFCntGap is the MAX_FCNT_GAP of the LoRaWAN specification
+const maxFCntGap = 16384
+
+// maxFCntGapLimit is the largest gap a 16-bit frame counter can cover
+const maxFCntGapLimit = 65535
+
+// ErrJoinRateLimited is returned when a device joins again before the minimum join interval elapsed
+var ErrJoinRateLimited = errors.New(errors.Behavioural, "Join rate limited")
+
 // Components defines a structure to make the instantiation easier to read
 type Components struct {
 	NetworkController NetworkController
@@ -38,23 +51,37 @@ type Options struct {
 	NetAddrUp        string
 	NetAddrDown      string
 	TokenKeyProvider tokenkey.Provider
+	MinJoinInterval  time.Duration // Minimum time between two accepted joins of a device, 0 means no limit
+	MaxFCntGap       uint32        // Maximum gap between the stored and received frame counters, defaults to 16384, at most 65535
 }
 
 // Interface defines the Broker interface
 type Interface interface {
 	core.BrokerServer
 	core.BrokerManagerServer
+	DiagnoseUplink(payload *core.LoRaWANData) (Diagnosis, error)
+	ListByNwkSKey(key types.NwkSKey) ([]Device, error)
+	FindByDevEUI(devEUI types.DevEUI) ([]Device, error)
+	DeleteDevices(appEUI types.AppEUI) (int, error)
 	Start() error
 }
 
 // New construct a new Broker component
 func New(c Components, o Options) Interface {
+	if o.MaxFCntGap == 0 {
+		o.MaxFCntGap = maxFCntGap
+	}
+	if o.MaxFCntGap > maxFCntGapLimit {
+		o.MaxFCntGap = maxFCntGapLimit
+	}
 	return component{
 		Components:       c,
 		NetAddrUp:        o.NetAddrUp,
 		NetAddrDown:      o.NetAddrDown,
 		TokenKeyProvider: o.TokenKeyProvider,
 		MaxDevNonces:     10,
+		MinJoinInterval:  o.MinJoinInterval,
+		MaxFCntGap:       o.MaxFCntGap,
 	}
 }
 
@@ -143,6 +170,13 @@ func (b component) HandleJoin(bctx context.Context, req *core.JoinBrokerReq) (*c
 		return new(core.JoinBrokerRes), errors.New(errors.Structural, "DevNonce used by the past")
 	}
 
+	// Check the device isn't stuck in a join loop; it keeps its current session meanwhile
+	if b.MinJoinInterval > 0 && !nonces.LastJoin.IsZero() && time.Since(nonces.LastJoin) < b.MinJoinInterval {
+		stats.MarkMeter("broker.join.rate_limited")
+		ctx.WithField("LastJoin", nonces.LastJoin).Debug("Join too soon after the previous one")
+		return new(core.JoinBrokerRes), ErrJoinRateLimited
+	}
+
 	// Forward the registration to the handler
 	handler, closer, err := appEntry.Dialer.Dial()
 	if err != nil {
@@ -177,6 +211,7 @@ func (b component) HandleJoin(bctx context.Context, req *core.JoinBrokerReq) (*c
 
 	// Update the DevNonce
 	nonces.DevNonces = append(nonces.DevNonces, req.DevNonce)
+	nonces.LastJoin = time.Now()
 	if uint(len(nonces.DevNonces)) > b.MaxDevNonces {
 		nonces.DevNonces = nonces.DevNonces[1:]
 	}
@@ -254,7 +289,7 @@ func (b component) HandleData(bctx context.Context, req *core.DataBrokerReq) (*c
 		key := lorawan.AES128Key(entry.NwkSKey)
 
 		// Check frame counter is in valid range
-		fcnt32, err := b.NetworkController.wholeCounter(fcnt16, entry.FCntUp)
+		fcnt32, err := b.NetworkController.wholeCounter(fcnt16, entry.FCntUp, b.MaxFCntGap)
 		if err != nil {
 			// invalid, is device in developer mode
 			if (entry.Flags & core.RelaxFcntCheck) != 0 {
@@ -301,11 +336,31 @@ func (b component) HandleData(bctx context.Context, req *core.DataBrokerReq) (*c
 	// It does matter here to use the DevEUI from the entry and not from the packet.
 	// The packet actually holds a DevAddr and the real DevEUI has been determined thanks
 	// to the MIC check + persistence
-	mEntry.FCntUp = fhdr.FCnt
-	if err := b.NetworkController.upsert(*mEntry); err != nil {
+	// The counter is swapped rather than overwritten so that a concurrent uplink of the same
+	// device can't bring it back to an older value.
+	swapped, err := b.NetworkController.setFCntUp(mEntry.DevAddr, mEntry.AppEUI, mEntry.DevEUI, mEntry.FCntUp, fhdr.FCnt)
+	if err != nil {
 		ctx.WithError(err).Debug("Unable to update Frame Counter")
 		return new(core.DataBrokerRes), err
 	}
+	if !swapped {
+		stats.MarkMeter("broker.uplink.fcnt_conflict")
+		err := errors.New(errors.Behavioural, "Frame counter updated concurrently")
+		ctx.WithError(err).Debug("Unable to handle uplink")
+		return new(core.DataBrokerRes), err
+	}
+	mEntry.FCntUp = fhdr.FCnt
+
+	// Keep track of the battery level and link margin the device reports
+	for _, cmd := range fhdr.FOpts {
+		if ans, ok := cmd.Payload.(*lorawan.DevStatusAnsPayload); ok {
+			stats.MarkMeter("broker.uplink.dev_status")
+			ctx.WithFields(log.Fields{"Battery": ans.Battery, "Margin": ans.Margin}).Debug("Device status")
+			if err := b.NetworkController.setStatus(mEntry.DevAddr, mEntry.AppEUI, mEntry.DevEUI, ans.Battery, ans.Margin); err != nil {
+				ctx.WithError(err).Warn("Unable to store device status")
+			}
+		}
+	}
 
 	// Then we forward the packet to the handler and wait for the response
 	handler, closer, err := mEntry.Dialer.Dial()
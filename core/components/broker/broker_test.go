@@ -13,6 +13,7 @@ import (
 	"github.com/TheThingsNetwork/ttn/core/mocks"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
 	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	"github.com/apex/log"
 	"github.com/brocaar/lorawan"
 	"golang.org/x/net/context"
 )
@@ -44,7 +45,7 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 	}
 
 	// --------------------
@@ -91,7 +92,7 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 	}
 
 	// --------------------
@@ -138,7 +139,7 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 	}
 
 	// --------------------
@@ -216,6 +217,7 @@ func TestHandleData(t *testing.T) {
 		var wantRes = new(core.DataBrokerRes)
 		var wantFCnt = nc.OutWholeCounter.FCnt
 		var wantDialer = true
+		var wantMaxGap uint32 = maxFCntGap
 
 		// Operate
 		res, err := br.HandleData(context.Background(), req)
@@ -224,8 +226,71 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
+		Check(t, wantMaxGap, nc.InWholeCounter.MaxGap, "Maximum frame counter gaps")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Valid uplink | One entry, maximum FCnt gap above 16-bits")
+
+		// Build
+		hl := mocks.NewHandlerClient()
+		nc := NewMockNetworkController()
+		as := NewMockAppStorage()
+		nc.OutWholeCounter.FCnt = 2
+
+		dl := NewMockDialer()
+		dl.OutDial.Client = hl
+		dl.OutDial.Closer = NewMockCloser()
+
+		nc.OutRead.Entries = []devEntry{
+			{
+				Dialer:  dl,
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+				FCntUp:  1,
+			},
+		}
+		br := New(Components{NetworkController: nc, AppStorage: as, Ctx: GetLogger(t, "Broker")}, Options{MaxFCntGap: 100000})
+		req := &core.DataBrokerReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    nc.OutWholeCounter.FCnt,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{0, 0, 0, 0}, // Temporary, computed below
+			},
+			Metadata: new(core.Metadata),
+		}
+		payload, err := core.NewLoRaWANData(req.Payload, true)
+		FatalUnless(t, err)
+		err = payload.SetMIC(lorawan.AES128Key(nc.OutRead.Entries[0].NwkSKey))
+		FatalUnless(t, err)
+		req.Payload.MIC = payload.MIC[:]
+
+		// Expect
+		var wantErr *string
+		var wantMaxGap uint32 = 65535
+
+		// Operate
+		_, err = br.HandleData(context.Background(), req)
+
+		// Checks
+		CheckErrors(t, wantErr, err)
+		Check(t, wantMaxGap, nc.InWholeCounter.MaxGap, "Maximum frame counter gaps")
 	}
 
 	// --------------------
@@ -292,7 +357,76 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
+		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Valid uplink | One entry, payload tampered with")
+
+		// Build
+		hl := mocks.NewHandlerClient()
+		nc := NewMockNetworkController()
+		as := NewMockAppStorage()
+		nc.OutWholeCounter.FCnt = 2
+
+		dl := NewMockDialer()
+		dl.OutDial.Client = hl
+		dl.OutDial.Closer = NewMockCloser()
+
+		nc.OutRead.Entries = []devEntry{
+			{
+				Dialer:  dl,
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+				FCntUp:  1,
+			},
+		}
+		br := New(Components{NetworkController: nc, AppStorage: as, Ctx: GetLogger(t, "Broker")}, Options{})
+		req := &core.DataBrokerReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    nc.OutWholeCounter.FCnt,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{0, 0, 0, 0}, // Temporary, computed below
+			},
+			Metadata: new(core.Metadata),
+		}
+		payload, err := core.NewLoRaWANData(req.Payload, true)
+		FatalUnless(t, err)
+		err = payload.SetMIC(lorawan.AES128Key(nc.OutRead.Entries[0].NwkSKey))
+		FatalUnless(t, err)
+		req.Payload.MIC = payload.MIC[:]
+		req.Payload.MACPayload.FRMPayload = []byte{14, 14, 42, 43}
+
+		// Expect
+		var wantErr = ErrNotFound
+		var wantDataUp *core.DataUpHandlerReq
+		var wantRes = new(core.DataBrokerRes)
+		var wantFCnt uint32
+		var wantDialer bool
+
+		// Operate
+		res, err := br.HandleData(context.Background(), req)
+
+		// Checks
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
+		Check(t, wantRes, res, "Broker Data Responses")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
 
@@ -369,12 +503,95 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
 
 	// --------------------
 
+	{
+		Desc(t, "Valid uplink | One entry, device status in FOpts")
+
+		// Build
+		hl := mocks.NewHandlerClient()
+		nc := NewMockNetworkController()
+		as := NewMockAppStorage()
+		nc.OutWholeCounter.FCnt = 14
+
+		dl := NewMockDialer()
+		dl.OutDial.Client = hl
+		dl.OutDial.Closer = NewMockCloser()
+
+		nc.OutRead.Entries = []devEntry{
+			{
+				Dialer:  dl,
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+				FCntUp:  13,
+			},
+		}
+		br := New(Components{NetworkController: nc, AppStorage: as, Ctx: GetLogger(t, "Broker")}, Options{})
+		req := &core.DataBrokerReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    nc.OutWholeCounter.FCnt,
+						FCtrl:   new(core.LoRaWANFCtrl),
+						FOpts: [][]byte{
+							{0x06, 0xfe, 0x0a}, // DevStatusAns: battery 254, margin 10 dB
+						},
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{0, 0, 0, 0}, // Temporary, computed below
+			},
+			Metadata: new(core.Metadata),
+		}
+		payload, err := core.NewLoRaWANData(req.Payload, true)
+		FatalUnless(t, err)
+		err = payload.SetMIC(lorawan.AES128Key(nc.OutRead.Entries[0].NwkSKey))
+		FatalUnless(t, err)
+		req.Payload.MIC = payload.MIC[:]
+
+		// Expect
+		var wantErr *string
+		var wantDataUp = &core.DataUpHandlerReq{
+			Payload:  req.Payload.MACPayload.FRMPayload,
+			AppEUI:   nc.OutRead.Entries[0].AppEUI,
+			DevEUI:   nc.OutRead.Entries[0].DevEUI,
+			FCnt:     nc.OutWholeCounter.FCnt,
+			FPort:    1,
+			MType:    req.Payload.MHDR.MType,
+			Metadata: req.Metadata,
+		}
+		var wantRes = new(core.DataBrokerRes)
+		var wantFCnt = nc.OutWholeCounter.FCnt
+		var wantDialer = true
+		var wantBattery uint8 = 254
+		var wantMargin int8 = 10
+
+		// Operate
+		res, err := br.HandleData(context.Background(), req)
+
+		// Checks
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
+		Check(t, wantRes, res, "Broker Data Responses")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
+		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
+		Check(t, wantBattery, nc.InSetStatus.Battery, "Battery levels")
+		Check(t, wantMargin, nc.InSetStatus.Margin, "Link margins")
+	}
+
+	// --------------------
+
 	{
 		Desc(t, "Valid uplink | One entry, Dial failed")
 
@@ -439,7 +656,7 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
 
@@ -518,7 +735,7 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
 
@@ -596,7 +813,7 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
 
@@ -701,7 +918,7 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
 
@@ -715,7 +932,7 @@ func TestHandleData(t *testing.T) {
 		nc := NewMockNetworkController()
 		as := NewMockAppStorage()
 		nc.OutWholeCounter.FCnt = 14
-		nc.Failures["upsert"] = errors.New(errors.Operational, "Mock Error")
+		nc.Failures["setFCntUp"] = errors.New(errors.Operational, "Mock Error")
 
 		dl := NewMockDialer()
 		dl.OutDial.Client = hl
@@ -771,7 +988,78 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
+		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Valid uplink | One entry, FCnt updated concurrently")
+
+		// Build
+		hl := mocks.NewHandlerClient()
+		nc := NewMockNetworkController()
+		as := NewMockAppStorage()
+		nc.OutWholeCounter.FCnt = 14
+		nc.OutSetFCntUp.Swapped = false
+
+		dl := NewMockDialer()
+		dl.OutDial.Client = hl
+		dl.OutDial.Closer = NewMockCloser()
+
+		nc.OutRead.Entries = []devEntry{
+			{
+				Dialer:  dl,
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+				FCntUp:  10,
+			},
+		}
+		br := New(Components{NetworkController: nc, AppStorage: as, Ctx: GetLogger(t, "Broker")}, Options{})
+		req := &core.DataBrokerReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    nc.OutWholeCounter.FCnt,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{0, 0, 0, 0}, // Temporary, computed below
+			},
+			Metadata: new(core.Metadata),
+		}
+		payload, err := core.NewLoRaWANData(req.Payload, true)
+		FatalUnless(t, err)
+		err = payload.SetMIC(lorawan.AES128Key(nc.OutRead.Entries[0].NwkSKey))
+		FatalUnless(t, err)
+		req.Payload.MIC = payload.MIC[:]
+		req.Payload.MACPayload.FHDR.FCnt %= 65536
+
+		// Expect
+		var wantErr = ErrBehavioural
+		var wantDataUp *core.DataUpHandlerReq
+		var wantRes = new(core.DataBrokerRes)
+		var wantFCnt = nc.OutWholeCounter.FCnt
+		var wantDialer bool
+
+		// Operate
+		res, err := br.HandleData(context.Background(), req)
+
+		// Checks
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
+		Check(t, wantRes, res, "Broker Data Responses")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
+		Check(t, uint32(10), nc.InSetFCntUp.Expected, "Expected frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
 
@@ -860,7 +1148,7 @@ func TestHandleData(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantDataUp, hl.InHandleDataUp.Req, "Handler Data Requests")
 		Check(t, wantRes, res, "Broker Data Responses")
-		Check(t, wantFCnt, nc.InUpsert.Entry.FCntUp, "Frame counters")
+		Check(t, wantFCnt, nc.InSetFCntUp.FCnt, "Frame counters")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
 }
@@ -959,6 +1247,9 @@ func TestHandleJoin(t *testing.T) {
 		// Operate
 		res, err := br.HandleJoin(context.Background(), req)
 
+		// Ignore LastJoin, checked separately
+		nc.InUpsertNonces.Entry.LastJoin = time.Time{}
+
 		// Checks
 		CheckErrors(t, wantErr, err)
 		Check(t, wantJoinReq, hl.InHandleJoin.Req, "Handler Join Requests")
@@ -1028,6 +1319,9 @@ func TestHandleJoin(t *testing.T) {
 		// Operate
 		res, err := br.HandleJoin(context.Background(), req)
 
+		// Ignore LastJoin, checked separately
+		nc.InUpsertNonces.Entry.LastJoin = time.Time{}
+
 		// Checks
 		CheckErrors(t, wantErr, err)
 		Check(t, wantJoinReq, hl.InHandleJoin.Req, "Handler Join Requests")
@@ -1387,6 +1681,73 @@ func TestHandleJoin(t *testing.T) {
 
 	// --------------------
 
+	{
+		Desc(t, "Valid Join Request | DevNonces full, drop the oldest one")
+
+		// Build
+		nc := NewMockNetworkController()
+		as := NewMockAppStorage()
+		hl := mocks.NewHandlerClient()
+		hl.OutHandleJoin.Res = &core.JoinHandlerRes{
+			Payload: &core.LoRaWANJoinAccept{
+				Payload: []byte{14, 42},
+			},
+			DevAddr:  []byte{1, 1, 1, 1},
+			NwkSKey:  []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			Metadata: new(core.Metadata),
+		}
+
+		dl := NewMockDialer()
+		dl.OutDial.Client = hl
+		dl.OutDial.Closer = NewMockCloser()
+
+		as.OutRead.Entry = appEntry{
+			Dialer: dl,
+			AppEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		}
+		var devNonces [][]byte
+		for i := byte(0); i < 10; i++ {
+			devNonces = append(devNonces, []byte{0, i})
+		}
+		nc.OutReadNonces.Entry = noncesEntry{
+			AppEUI:    []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevEUI:    []byte{3, 3, 3, 3, 3, 3, 3, 3},
+			DevNonces: devNonces,
+		}
+
+		br := New(Components{NetworkController: nc, AppStorage: as, Ctx: GetLogger(t, "Broker")}, Options{})
+		req := &core.JoinBrokerReq{
+			AppEUI:   nc.OutReadNonces.Entry.AppEUI,
+			DevEUI:   nc.OutReadNonces.Entry.DevEUI,
+			DevNonce: []byte{14, 14},
+			MIC:      []byte{14, 14, 14, 14},
+
+			Metadata: new(core.Metadata),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantActivation = noncesEntry{
+			AppEUI:    req.AppEUI,
+			DevEUI:    req.DevEUI,
+			DevNonces: append(append([][]byte{}, devNonces[1:]...), req.DevNonce),
+		}
+		var wantDialer = true
+
+		// Operate
+		_, err := br.HandleJoin(context.Background(), req)
+
+		// Ignore LastJoin, checked separately
+		nc.InUpsertNonces.Entry.LastJoin = time.Time{}
+
+		// Checks
+		CheckErrors(t, wantErr, err)
+		Check(t, wantActivation, nc.InUpsertNonces.Entry, "Activations")
+		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
+	}
+
+	// --------------------
+
 	{
 		Desc(t, "Valid Join Request | Dial fails")
 
@@ -1641,6 +2002,9 @@ func TestHandleJoin(t *testing.T) {
 		// Operate
 		res, err := br.HandleJoin(context.Background(), req)
 
+		// Ignore LastJoin, checked separately
+		nc.InUpsertNonces.Entry.LastJoin = time.Time{}
+
 		// Checks
 		CheckErrors(t, wantErr, err)
 		Check(t, wantJoinReq, hl.InHandleJoin.Req, "Handler Join Requests")
@@ -1712,6 +2076,9 @@ func TestHandleJoin(t *testing.T) {
 		// Operate
 		res, err := br.HandleJoin(context.Background(), req)
 
+		// Ignore LastJoin, checked separately
+		nc.InUpsertNonces.Entry.LastJoin = time.Time{}
+
 		// Checks
 		CheckErrors(t, wantErr, err)
 		Check(t, wantJoinReq, hl.InHandleJoin.Req, "Handler Join Requests")
@@ -1719,6 +2086,121 @@ func TestHandleJoin(t *testing.T) {
 		Check(t, wantActivation, nc.InUpsertNonces.Entry, "Activations")
 		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
 	}
+	// --------------------
+
+	{
+		Desc(t, "Valid Join Request | Joined too recently")
+
+		// Build
+		nc := NewMockNetworkController()
+		as := NewMockAppStorage()
+		hl := mocks.NewHandlerClient()
+		dl := NewMockDialer()
+		dl.OutDial.Client = hl
+		dl.OutDial.Closer = NewMockCloser()
+
+		as.OutRead.Entry = appEntry{
+			Dialer: dl,
+			AppEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		}
+		nc.OutReadNonces.Entry = noncesEntry{
+			AppEUI:    []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevEUI:    []byte{3, 3, 3, 3, 3, 3, 3, 3},
+			DevNonces: [][]byte{[]byte{14, 14}},
+			LastJoin:  time.Now().Add(-time.Second),
+		}
+
+		br := New(Components{NetworkController: nc, AppStorage: as, Ctx: GetLogger(t, "Broker")}, Options{MinJoinInterval: time.Minute})
+		req := &core.JoinBrokerReq{
+			AppEUI:   nc.OutReadNonces.Entry.AppEUI,
+			DevEUI:   nc.OutReadNonces.Entry.DevEUI,
+			DevNonce: []byte{15, 15},
+			MIC:      []byte{14, 14, 14, 14},
+
+			Metadata: new(core.Metadata),
+		}
+
+		// Expect
+		var wantErr = ErrBehavioural
+		var wantJoinReq *core.JoinHandlerReq
+		var wantRes = new(core.JoinBrokerRes)
+		var wantActivation noncesEntry
+		var wantDevice devEntry
+		var wantDialer bool
+
+		// Operate
+		res, err := br.HandleJoin(context.Background(), req)
+
+		// Checks
+		CheckErrors(t, wantErr, err)
+		Check(t, wantJoinReq, hl.InHandleJoin.Req, "Handler Join Requests")
+		Check(t, wantRes, res, "Broker Join Responses")
+		Check(t, wantActivation, nc.InUpsertNonces.Entry, "Activations")
+		Check(t, wantDevice, nc.InUpsert.Entry, "Devices")
+		Check(t, wantDialer, dl.InDial.Called, "Dialer calls")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Valid Join Request | Joined after the minimum interval")
+
+		// Build
+		nc := NewMockNetworkController()
+		as := NewMockAppStorage()
+		hl := mocks.NewHandlerClient()
+		hl.OutHandleJoin.Res = &core.JoinHandlerRes{
+			Payload: &core.LoRaWANJoinAccept{
+				Payload: []byte{14, 42},
+			},
+			DevAddr:  []byte{1, 1, 1, 1},
+			NwkSKey:  []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			Metadata: new(core.Metadata),
+		}
+		dl := NewMockDialer()
+		dl.OutDial.Client = hl
+		dl.OutDial.Closer = NewMockCloser()
+
+		as.OutRead.Entry = appEntry{
+			Dialer: dl,
+			AppEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		}
+		nc.OutReadNonces.Entry = noncesEntry{
+			AppEUI:    []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevEUI:    []byte{3, 3, 3, 3, 3, 3, 3, 3},
+			DevNonces: [][]byte{[]byte{14, 14}},
+			LastJoin:  time.Now().Add(-2 * time.Minute),
+		}
+
+		br := New(Components{NetworkController: nc, AppStorage: as, Ctx: GetLogger(t, "Broker")}, Options{MinJoinInterval: time.Minute})
+		req := &core.JoinBrokerReq{
+			AppEUI:   nc.OutReadNonces.Entry.AppEUI,
+			DevEUI:   nc.OutReadNonces.Entry.DevEUI,
+			DevNonce: []byte{15, 15},
+			MIC:      []byte{14, 14, 14, 14},
+
+			Metadata: new(core.Metadata),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantRes = &core.JoinBrokerRes{
+			Payload:  hl.OutHandleJoin.Res.Payload,
+			Metadata: hl.OutHandleJoin.Res.Metadata,
+		}
+		var wantNonces = [][]byte{[]byte{14, 14}, req.DevNonce}
+		var wantLastJoin = true
+
+		// Operate
+		before := time.Now()
+		res, err := br.HandleJoin(context.Background(), req)
+
+		// Checks
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Broker Join Responses")
+		Check(t, wantNonces, nc.InUpsertNonces.Entry.DevNonces, "DevNonces")
+		Check(t, wantLastJoin, !nc.InUpsertNonces.Entry.LastJoin.Before(before), "Last joins updated")
+	}
 }
 
 func TestStart(t *testing.T) {
@@ -1746,3 +2228,71 @@ func TestStart(t *testing.T) {
 	}
 	CheckErrors(t, nil, err)
 }
+
+// benchmarkHandleData measures an uplink going through the MIC matching of nb devices sharing
+// the same DevAddr. Only the last one matches.
+func benchmarkHandleData(b *testing.B, nb int) {
+	// Build
+	hl := mocks.NewHandlerClient()
+	nc := NewMockNetworkController()
+	as := NewMockAppStorage()
+	nc.OutWholeCounter.FCnt = 2
+
+	dl := NewMockDialer()
+	dl.OutDial.Client = hl
+	dl.OutDial.Closer = NewMockCloser()
+
+	for i := 0; i < nb; i++ {
+		nc.OutRead.Entries = append(nc.OutRead.Entries, devEntry{
+			Dialer:  dl,
+			AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevEUI:  []byte{0, 0, 0, 0, 0, 0, byte(i >> 8), byte(i)},
+			NwkSKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, byte(i >> 8), byte(i)},
+			FCntUp:  1,
+		})
+	}
+	br := New(Components{
+		NetworkController: nc,
+		AppStorage:        as,
+		Ctx:               &log.Logger{Handler: log.HandlerFunc(func(*log.Entry) error { return nil }), Level: log.FatalLevel},
+	}, Options{})
+	req := &core.DataBrokerReq{
+		Payload: &core.LoRaWANData{
+			MHDR: &core.LoRaWANMHDR{
+				MType: uint32(lorawan.UnconfirmedDataUp),
+				Major: uint32(lorawan.LoRaWANR1),
+			},
+			MACPayload: &core.LoRaWANMACPayload{
+				FHDR: &core.LoRaWANFHDR{
+					DevAddr: []byte{1, 2, 3, 4},
+					FCnt:    nc.OutWholeCounter.FCnt,
+					FCtrl:   new(core.LoRaWANFCtrl),
+				},
+				FPort:      1,
+				FRMPayload: []byte{14, 14, 42, 42},
+			},
+			MIC: []byte{0, 0, 0, 0}, // Temporary, computed below
+		},
+		Metadata: new(core.Metadata),
+	}
+	payload, err := core.NewLoRaWANData(req.Payload, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := payload.SetMIC(lorawan.AES128Key(nc.OutRead.Entries[nb-1].NwkSKey)); err != nil {
+		b.Fatal(err)
+	}
+	req.Payload.MIC = payload.MIC[:]
+
+	// Operate
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := br.HandleData(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHandleData1(b *testing.B)   { benchmarkHandleData(b, 1) }
+func BenchmarkHandleData10(b *testing.B)  { benchmarkHandleData(b, 10) }
+func BenchmarkHandleData100(b *testing.B) { benchmarkHandleData(b, 100) }
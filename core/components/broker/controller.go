@@ -7,9 +7,13 @@ import (
 	"bytes"
 	"encoding"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"math"
 	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	dbutil "github.com/TheThingsNetwork/ttn/core/storage"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
@@ -19,27 +23,36 @@ import (
 // NetworkController gives a facade for manipulating the broker databases and devices
 type NetworkController interface {
 	read(devAddr []byte) ([]devEntry, error)
+	readByNwkSKey(nwkSKey [16]byte) ([]devEntry, error)
+	readByDevEUI(devEUI []byte) ([]devEntry, error)
 	readNonces(appEUI []byte, devEUI []byte) (noncesEntry, error)
 	upsertNonces(entry noncesEntry) error
 	upsert(entry devEntry) error
-	wholeCounter(devCnt uint32, entryCnt uint32) (uint32, error)
+	deleteAll(appEUI []byte) (int, error)
+	setFCntUp(devAddr []byte, appEUI []byte, devEUI []byte, expected uint32, fcnt uint32) (bool, error)
+	setStatus(devAddr []byte, appEUI []byte, devEUI []byte, battery uint8, margin int8) error
+	wholeCounter(devCnt uint32, entryCnt uint32, maxGap uint32) (uint32, error)
 	done() error
 }
 
 type devEntry struct {
-	AppEUI  []byte
-	DevEUI  []byte
-	DevAddr []byte
-	Dialer  Dialer
-	FCntUp  uint32
-	NwkSKey [16]byte
-	Flags   uint32
+	AppEUI   []byte
+	DevEUI   []byte
+	DevAddr  []byte
+	Dialer   Dialer
+	FCntUp   uint32
+	NwkSKey  [16]byte
+	Flags    uint32
+	Battery  uint8     // As last reported in a DevStatusAns, 0 means external power, 255 unknown
+	Margin   int8      // As last reported in a DevStatusAns, in dB
+	LastSeen time.Time // The last time an uplink of the device was accepted
 }
 
 type noncesEntry struct {
 	AppEUI    []byte
 	DevEUI    []byte
 	DevNonces [][]byte
+	LastJoin  time.Time
 }
 
 type controller struct {
@@ -49,9 +62,9 @@ type controller struct {
 
 var dbDevices = []byte("devices")
 
-// NewNetworkController constructs a new broker controller
-func NewNetworkController(name string) (NetworkController, error) {
-	itf, err := dbutil.New(name)
+// NewNetworkController constructs a new broker controller, optionally wrapped (e.g. cached)
+func NewNetworkController(name string, wrappers ...dbutil.Wrapper) (NetworkController, error) {
+	itf, err := dbutil.New(name, wrappers...)
 	if err != nil {
 		return nil, errors.New(errors.Operational, err)
 	}
@@ -60,16 +73,61 @@ func NewNetworkController(name string) (NetworkController, error) {
 }
 
 // read implements the NetworkController interface
+//
+// Devices are given by decreasing LastSeen, the most active ones being the most likely to be the
+// sender of an uplink.
 func (s *controller) read(devAddr []byte) ([]devEntry, error) {
-	entries, err := s.db.Read(devAddr, &devEntry{}, dbDevices)
+	itf, err := s.db.Read(devAddr, &devEntry{}, dbDevices)
 	if err != nil {
 		return nil, err
 	}
-	return entries.([]devEntry), nil
+	entries := itf.([]devEntry)
+	sort.Stable(byLastSeen(entries))
+	return entries, nil
+}
+
+// byLastSeen sorts device entries by decreasing LastSeen
+type byLastSeen []devEntry
+
+func (s byLastSeen) Len() int           { return len(s) }
+func (s byLastSeen) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastSeen) Less(i, j int) bool { return s[i].LastSeen.After(s[j].LastSeen) }
+
+// readByNwkSKey implements the NetworkController interface
+func (s *controller) readByNwkSKey(nwkSKey [16]byte) ([]devEntry, error) {
+	return s.scan(func(entry devEntry) bool { return entry.NwkSKey == nwkSKey })
+}
+
+// readByDevEUI implements the NetworkController interface
+func (s *controller) readByDevEUI(devEUI []byte) ([]devEntry, error) {
+	return s.scan(func(entry devEntry) bool { return bytes.Equal(entry.DevEUI, devEUI) })
+}
+
+// scan goes through every known device and keeps the ones matching the given filter.
+// There's no secondary index, so it's O(n).
+func (s *controller) scan(filter func(entry devEntry) bool) ([]devEntry, error) {
+	s.RLock()
+	defer s.RUnlock()
+	itf, err := s.db.ReadAll(&devEntry{}, dbDevices)
+	if err != nil {
+		if err.(errors.Failure).Nature == errors.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []devEntry
+	for _, entry := range itf.([]devEntry) {
+		if filter(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
 }
 
 // wholeCounter implements the broker.NetworkController interface
-func (s *controller) wholeCounter(devCnt uint32, entryCnt uint32) (uint32, error) {
+//
+// The counter of the device is rejected when it is more than maxGap ahead of the stored one.
+func (s *controller) wholeCounter(devCnt uint32, entryCnt uint32, maxGap uint32) (uint32, error) {
 	upperSup := int(math.Pow(2, 16))
 	diff := int(devCnt) - (int(entryCnt) % upperSup)
 	var offset int
@@ -78,7 +136,7 @@ func (s *controller) wholeCounter(devCnt uint32, entryCnt uint32) (uint32, error
 	} else {
 		offset = upperSup + diff
 	}
-	if offset > upperSup/4 {
+	if offset > int(maxGap) {
 		return 0, errors.New(errors.Structural, "Gap too big, counter is errored")
 	}
 	return entryCnt + uint32(offset), nil
@@ -115,6 +173,115 @@ func (s *controller) upsert(update devEntry) error {
 	return s.db.Update(update.DevAddr, newEntries, dbDevices)
 }
 
+// deleteAll implements the broker.NetworkController interface
+//
+// It removes all devices of an application, whatever their DevAddr, and gives the number of devices
+// removed. Every known device is scanned, which makes it O(n).
+func (s *controller) deleteAll(appEUI []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	itf, err := s.db.ReadAll(&devEntry{}, dbDevices)
+	if err != nil {
+		if err.(errors.Failure).Nature == errors.NotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	devAddrs := make(map[string]bool)
+	for _, entry := range itf.([]devEntry) {
+		if bytes.Equal(entry.AppEUI, appEUI) {
+			devAddrs[string(entry.DevAddr)] = true
+		}
+	}
+
+	var n int
+	for devAddr := range devAddrs {
+		itf, err := s.db.Read([]byte(devAddr), &devEntry{}, dbDevices)
+		if err != nil {
+			return n, err
+		}
+		var kept []encoding.BinaryMarshaler
+		for _, entry := range itf.([]devEntry) {
+			if bytes.Equal(entry.AppEUI, appEUI) {
+				n++
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		if len(kept) == 0 {
+			err = s.db.Delete([]byte(devAddr), dbDevices)
+		} else {
+			err = s.db.Update([]byte(devAddr), kept, dbDevices)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// setFCntUp implements the broker.NetworkController interface
+//
+// The counter is only updated if it still holds the expected value, or already holds the new one
+// (the same frame received through several gateways). It returns whether the update happened.
+func (s *controller) setFCntUp(devAddr []byte, appEUI []byte, devEUI []byte, expected uint32, fcnt uint32) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	itf, err := s.db.Read(devAddr, &devEntry{}, dbDevices)
+	if err != nil {
+		return false, err
+	}
+	entries := itf.([]devEntry)
+
+	var newEntries []encoding.BinaryMarshaler
+	var found bool
+	for _, e := range entries {
+		entry := new(devEntry)
+		*entry = e
+		if bytes.Equal(entry.AppEUI, appEUI) && bytes.Equal(entry.DevEUI, devEUI) {
+			if entry.FCntUp != expected && entry.FCntUp != fcnt {
+				return false, nil
+			}
+			entry.FCntUp = fcnt
+			entry.LastSeen = time.Now()
+			found = true
+		}
+		newEntries = append(newEntries, entry)
+	}
+	if !found {
+		return false, errors.New(errors.NotFound, "Device not found")
+	}
+	return true, s.db.Update(devAddr, newEntries, dbDevices)
+}
+
+// setStatus implements the broker.NetworkController interface
+func (s *controller) setStatus(devAddr []byte, appEUI []byte, devEUI []byte, battery uint8, margin int8) error {
+	s.Lock()
+	defer s.Unlock()
+	itf, err := s.db.Read(devAddr, &devEntry{}, dbDevices)
+	if err != nil {
+		return err
+	}
+	entries := itf.([]devEntry)
+
+	var newEntries []encoding.BinaryMarshaler
+	var found bool
+	for _, e := range entries {
+		entry := new(devEntry)
+		*entry = e
+		if bytes.Equal(entry.AppEUI, appEUI) && bytes.Equal(entry.DevEUI, devEUI) {
+			entry.Battery = battery
+			entry.Margin = margin
+			found = true
+		}
+		newEntries = append(newEntries, entry)
+	}
+	if !found {
+		return errors.New(errors.NotFound, "Device not found")
+	}
+	return s.db.Update(devAddr, newEntries, dbDevices)
+}
+
 // readNonces implements the broker.NetworkController interface
 func (s *controller) readNonces(appEUI []byte, devEUI []byte) (noncesEntry, error) {
 	itf, err := s.db.Read(nil, &noncesEntry{}, appEUI, devEUI)
@@ -144,6 +311,12 @@ func (e devEntry) MarshalBinary() ([]byte, error) {
 	rw.Write(e.FCntUp)
 	rw.Write(e.Flags)
 	rw.Write(e.Dialer.MarshalSafely())
+	rw.Write([]byte{e.Battery, uint8(e.Margin)})
+	lastSeen, err := e.LastSeen.MarshalBinary()
+	if err != nil {
+		return nil, errors.New(errors.Structural, err)
+	}
+	rw.Write(lastSeen)
 	return rw.Bytes()
 }
 
@@ -166,11 +339,56 @@ func (e *devEntry) UnmarshalBinary(data []byte) error {
 	rw.Read(func(data []byte) { e.FCntUp = binary.BigEndian.Uint32(data) })
 	rw.Read(func(data []byte) { e.Flags = binary.BigEndian.Uint32(data) })
 	rw.Read(func(data []byte) { e.Dialer = NewDialer(data) })
+	rw.TryRead(func(data []byte) error {
+		if len(data) != 2 {
+			return errors.New(errors.Structural, "Invalid device status")
+		}
+		e.Battery, e.Margin = data[0], int8(data[1])
+		return nil
+	})
+	rw.TryRead(func(data []byte) error { return e.LastSeen.UnmarshalBinary(data) })
 	return rw.Err()
 }
 
+// String implements the fmt.Stringer interface, the session key is redacted
+func (e devEntry) String() string {
+	return fmt.Sprintf(
+		"{AppEUI: %X, DevEUI: %X, DevAddr: %X, FCntUp: %d, Flags: %d, Battery: %d, Margin: %d, LastSeen: %s, NwkSKey: <redacted>}",
+		e.AppEUI, e.DevEUI, e.DevAddr, e.FCntUp, e.Flags, e.Battery, e.Margin, e.LastSeen.Format(time.RFC3339),
+	)
+}
+
+// MarshalJSON implements the json.Marshaler interface, the session key is redacted
+func (e devEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		AppEUI   string
+		DevEUI   string
+		DevAddr  string
+		FCntUp   uint32
+		Flags    uint32
+		Battery  uint8
+		Margin   int8
+		LastSeen time.Time
+		NwkSKey  string
+	}{
+		AppEUI:   fmt.Sprintf("%X", e.AppEUI),
+		DevEUI:   fmt.Sprintf("%X", e.DevEUI),
+		DevAddr:  fmt.Sprintf("%X", e.DevAddr),
+		FCntUp:   e.FCntUp,
+		Flags:    e.Flags,
+		Battery:  e.Battery,
+		Margin:   e.Margin,
+		LastSeen: e.LastSeen,
+		NwkSKey:  "<redacted>",
+	})
+}
+
 // MarshalBinary implements the encoding.BinaryMarshaler interface
 func (e noncesEntry) MarshalBinary() ([]byte, error) {
+	lastJoin, err := e.LastJoin.MarshalBinary()
+	if err != nil {
+		return nil, errors.New(errors.Structural, err)
+	}
 	rw := readwriter.New(nil)
 	rw.Write(e.AppEUI)
 	rw.Write(e.DevEUI)
@@ -179,6 +397,7 @@ func (e noncesEntry) MarshalBinary() ([]byte, error) {
 		_, _ = buf.Write(n)
 	}
 	rw.Write(buf.Bytes())
+	rw.Write(lastJoin)
 	return rw.Bytes()
 }
 
@@ -201,5 +420,6 @@ func (e *noncesEntry) UnmarshalBinary(data []byte) error {
 			e.DevNonces = append(e.DevNonces, devNonce)
 		}
 	})
+	rw.TryRead(func(data []byte) error { return e.LastJoin.UnmarshalBinary(data) })
 	return rw.Err()
 }
@@ -4,10 +4,16 @@
 package broker
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/TheThingsNetwork/ttn/core"
 	. "github.com/TheThingsNetwork/ttn/utils/testing"
 )
 
@@ -61,6 +67,48 @@ func TestNetworkControllerDevice(t *testing.T) {
 
 	// -------------------
 
+	{
+		Desc(t, "Store a registration with relaxed frame counter check, reopen, reset its counter")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		entry := devEntry{
+			DevAddr: []byte{1, 2, 3, 6},
+			Dialer:  NewDialer([]byte("url")),
+			AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevEUI:  []byte{0, 0, 0, 0, 1, 2, 3, 6},
+			NwkSKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			FCntUp:  40,
+			Flags:   core.RelaxFcntCheck,
+		}
+		FatalUnless(t, db.upsert(entry))
+		FatalUnless(t, db.done())
+
+		// Operate
+		db, _ = NewNetworkController(NetworkControllerDB)
+		reopened, err := db.read(entry.DevAddr)
+		FatalUnless(t, err)
+		ok, errSet := db.setFCntUp(entry.DevAddr, entry.AppEUI, entry.DevEUI, entry.FCntUp, 0)
+		entries, err := db.read(entry.DevAddr)
+
+		// Expect
+		want := entry
+		want.FCntUp = 0
+		if len(entries) == 1 {
+			want.LastSeen = entries[0].LastSeen
+		}
+
+		// Check
+		CheckErrors(t, nil, errSet)
+		CheckErrors(t, nil, err)
+		Check(t, []devEntry{entry}, reopened, "Reopened DevEntries")
+		Check(t, true, ok, "Counter updated")
+		Check(t, []devEntry{want}, entries, "DevEntries")
+		_ = db.done()
+	}
+
+	// -------------------
+
 	{
 		Desc(t, "Store entries with same DevAddr")
 
@@ -252,7 +300,7 @@ func TestNetworkControllerDevice(t *testing.T) {
 		cnt16 := wholeCnt + 1
 
 		// Operate
-		cnt32, err := db.wholeCounter(cnt16, wholeCnt)
+		cnt32, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
 
 		// Check
 		CheckErrors(t, nil, err)
@@ -263,6 +311,66 @@ func TestNetworkControllerDevice(t *testing.T) {
 
 	// --------------------
 
+	{
+		Desc(t, "Test counters, | | = max_gap")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		wholeCnt := uint32(70000)
+		cnt16 := (wholeCnt + maxFCntGap) % 65536
+
+		// Operate
+		cnt32, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, wholeCnt+maxFCntGap, cnt32, "Counters")
+
+		_ = db.done()
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Test counters, | | = max_gap + 1")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		wholeCnt := uint32(70000)
+		cnt16 := (wholeCnt + maxFCntGap + 1) % 65536
+
+		// Operate
+		_, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
+
+		// Check
+		CheckErrors(t, ErrStructural, err)
+
+		_ = db.done()
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Test counters, custom max_gap")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		wholeCnt := uint32(14)
+
+		// Operate
+		cnt32, errAtGap := db.wholeCounter(wholeCnt+10, wholeCnt, 10)
+		_, errAboveGap := db.wholeCounter(wholeCnt+11, wholeCnt, 10)
+
+		// Check
+		CheckErrors(t, nil, errAtGap)
+		CheckErrors(t, ErrStructural, errAboveGap)
+		Check(t, wholeCnt+10, cnt32, "Counters")
+
+		_ = db.done()
+	}
+
+	// --------------------
+
 	{
 		Desc(t, "Test counters, devCnt < wholeCnt, | | > max_gap")
 
@@ -272,7 +380,7 @@ func TestNetworkControllerDevice(t *testing.T) {
 		cnt16 := wholeCnt - 1
 
 		// Operate
-		_, err := db.wholeCounter(cnt16, wholeCnt)
+		_, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
 
 		// Check
 		CheckErrors(t, ErrStructural, err)
@@ -291,7 +399,7 @@ func TestNetworkControllerDevice(t *testing.T) {
 		cnt16 := uint32(wholeCnt%65536 + 2)
 
 		// Operate
-		cnt32, err := db.wholeCounter(cnt16, wholeCnt)
+		cnt32, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
 
 		// Check
 		CheckErrors(t, nil, err)
@@ -311,7 +419,7 @@ func TestNetworkControllerDevice(t *testing.T) {
 		cnt16 := uint32(wholeCnt%65536 + 45000)
 
 		// Operate
-		_, err := db.wholeCounter(cnt16, wholeCnt)
+		_, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
 
 		// Check
 		CheckErrors(t, ErrStructural, err)
@@ -330,7 +438,7 @@ func TestNetworkControllerDevice(t *testing.T) {
 		cnt16 := uint32(2)
 
 		// Operate
-		cnt32, err := db.wholeCounter(cnt16, wholeCnt)
+		cnt32, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
 
 		// Check
 		CheckErrors(t, nil, err)
@@ -338,6 +446,616 @@ func TestNetworkControllerDevice(t *testing.T) {
 
 		_ = db.done()
 	}
+
+	// --------------------
+
+	{
+		Desc(t, "Test counters, rollover 0xFFFF -> 0x10000")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		wholeCnt := uint32(0xFFFF)
+		cnt16 := uint32(0)
+
+		// Operate
+		cnt32, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, uint32(0x10000), cnt32, "Counters")
+
+		_ = db.done()
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Test counters, second rollover 0x1FFFF -> 0x20000")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		wholeCnt := uint32(0x1FFFF)
+		cnt16 := uint32(0)
+
+		// Operate
+		cnt32, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, uint32(0x20000), cnt32, "Counters")
+
+		_ = db.done()
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Test counters, 0x10000 -> same frame again")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		wholeCnt := uint32(0x10000)
+		cnt16 := uint32(0)
+
+		// Operate
+		cnt32, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, uint32(0x10000), cnt32, "Counters")
+
+		_ = db.done()
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Test counters, 0x10000 -> 0xFFFF from before rollover")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		wholeCnt := uint32(0x10000)
+		cnt16 := uint32(0xFFFF)
+
+		// Operate
+		_, err := db.wholeCounter(cnt16, wholeCnt, maxFCntGap)
+
+		// Check
+		CheckErrors(t, ErrStructural, err)
+
+		_ = db.done()
+	}
+}
+
+func TestNetworkControllerNwkSKey(t *testing.T) {
+	NetworkControllerDB := path.Join(os.TempDir(), "TestBrokerNetworkControllerNwkSKey.db")
+	defer func() {
+		os.Remove(NetworkControllerDB)
+	}()
+
+	shared := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6}
+	entry1 := devEntry{
+		DevAddr: []byte{1, 1, 1, 1},
+		Dialer:  NewDialer([]byte("url")),
+		AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		DevEUI:  []byte{0, 0, 0, 0, 1, 1, 1, 1},
+		NwkSKey: shared,
+	}
+	entry2 := devEntry{
+		DevAddr: []byte{1, 1, 1, 1},
+		Dialer:  NewDialer([]byte("url")),
+		AppEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+		DevEUI:  []byte{0, 0, 0, 0, 2, 2, 2, 2},
+		NwkSKey: shared,
+	}
+	entry3 := devEntry{
+		DevAddr: []byte{3, 3, 3, 3},
+		Dialer:  NewDialer([]byte("url")),
+		AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		DevEUI:  []byte{0, 0, 0, 0, 3, 3, 3, 3},
+		NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+	}
+	entry4 := devEntry{
+		DevAddr: []byte{4, 4, 4, 4},
+		Dialer:  NewDialer([]byte("url")),
+		AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		DevEUI:  []byte{0, 0, 0, 0, 4, 4, 4, 4},
+		NwkSKey: shared,
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Lookup a key on an empty database")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+
+		// Operate
+		entries, err := db.readByNwkSKey(shared)
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, []devEntry(nil), entries, "DevEntries")
+		_ = db.done()
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Lookup a key shared by several devices")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		for _, entry := range []devEntry{entry1, entry2, entry3, entry4} {
+			err := db.upsert(entry)
+			FatalUnless(t, err)
+		}
+
+		// Operate
+		entries, err := db.readByNwkSKey(shared)
+
+		// Expect
+		want := []devEntry{entry1, entry2, entry4}
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, want, entries, "DevEntries")
+		_ = db.done()
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Lookup a key used by a single device")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+
+		// Operate
+		entries, err := db.readByNwkSKey(entry3.NwkSKey)
+
+		// Expect
+		want := []devEntry{entry3}
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, want, entries, "DevEntries")
+		_ = db.done()
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Lookup an unused key")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+
+		// Operate
+		entries, err := db.readByNwkSKey([16]byte{14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14})
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, []devEntry(nil), entries, "DevEntries")
+		_ = db.done()
+	}
+}
+
+func TestNetworkControllerFCntUp(t *testing.T) {
+	NetworkControllerDB := path.Join(os.TempDir(), "TestBrokerNetworkControllerFCntUp.db")
+	defer func() {
+		os.Remove(NetworkControllerDB)
+	}()
+
+	db, err := NewNetworkController(NetworkControllerDB)
+	FatalUnless(t, err)
+	defer db.done()
+
+	entry1 := devEntry{
+		DevAddr: []byte{1, 1, 1, 1},
+		Dialer:  NewDialer([]byte("url")),
+		AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		DevEUI:  []byte{0, 0, 0, 0, 1, 1, 1, 1},
+		NwkSKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+		FCntUp:  14,
+	}
+	entry2 := devEntry{
+		DevAddr: []byte{1, 1, 1, 1},
+		Dialer:  NewDialer([]byte("url")),
+		AppEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+		DevEUI:  []byte{0, 0, 0, 0, 2, 2, 2, 2},
+		NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+		FCntUp:  42,
+	}
+	FatalUnless(t, db.upsert(entry1))
+	FatalUnless(t, db.upsert(entry2))
+
+	// -------------------
+
+	{
+		Desc(t, "Swap with the expected counter")
+
+		// Operate
+		swapped, err := db.setFCntUp(entry1.DevAddr, entry1.AppEUI, entry1.DevEUI, 14, 15)
+		FatalUnless(t, err)
+		entries, err := db.read(entry1.DevAddr)
+		FatalUnless(t, err)
+
+		// Expect
+		want1, want2 := entry1, entry2
+		want1.FCntUp = 15
+		want1.LastSeen = entries[0].LastSeen
+
+		// Check
+		Check(t, true, swapped, "Swaps")
+		Check(t, []devEntry{want1, want2}, entries, "DevEntries")
+		Check(t, true, time.Since(entries[0].LastSeen) < time.Minute, "Last seen")
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Swap with an outdated counter")
+
+		// Operate
+		swapped, err := db.setFCntUp(entry1.DevAddr, entry1.AppEUI, entry1.DevEUI, 14, 16)
+		FatalUnless(t, err)
+		entries, err := db.read(entry1.DevAddr)
+		FatalUnless(t, err)
+
+		// Expect
+		want1, want2 := entry1, entry2
+		want1.FCntUp = 15
+		want1.LastSeen = entries[0].LastSeen
+
+		// Check
+		Check(t, false, swapped, "Swaps")
+		Check(t, []devEntry{want1, want2}, entries, "DevEntries")
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Swap with an outdated counter, same frame")
+
+		// Operate
+		swapped, err := db.setFCntUp(entry1.DevAddr, entry1.AppEUI, entry1.DevEUI, 14, 15)
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, true, swapped, "Swaps")
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Swap an unknown device")
+
+		// Operate
+		_, err := db.setFCntUp(entry1.DevAddr, entry1.AppEUI, []byte{0, 0, 0, 0, 3, 3, 3, 3}, 14, 15)
+
+		// Check
+		CheckErrors(t, ErrNotFound, err)
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Concurrent swaps, exactly one wins each round")
+
+		expected := uint32(42)
+		for round := 0; round < 5; round++ {
+			// Operate
+			var wg sync.WaitGroup
+			chwins := make(chan uint32, 50)
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(fcnt uint32) {
+					defer wg.Done()
+					swapped, err := db.setFCntUp(entry2.DevAddr, entry2.AppEUI, entry2.DevEUI, expected, fcnt)
+					if err == nil && swapped {
+						chwins <- fcnt
+					}
+				}(expected + uint32(i) + 1)
+			}
+			wg.Wait()
+			close(chwins)
+
+			var wins []uint32
+			for fcnt := range chwins {
+				wins = append(wins, fcnt)
+			}
+			entries, err := db.read(entry2.DevAddr)
+			FatalUnless(t, err)
+
+			// Check
+			Check(t, 1, len(wins), "Winners")
+			if len(wins) == 1 {
+				Check(t, wins[0], entries[0].FCntUp, "Frame counters") // The most recently seen first
+				expected = wins[0]
+			}
+		}
+	}
+}
+
+func TestNetworkControllerLastSeen(t *testing.T) {
+	NetworkControllerDB := path.Join(os.TempDir(), "TestBrokerNetworkControllerLastSeen.db")
+	defer func() {
+		os.Remove(NetworkControllerDB)
+	}()
+
+	db, err := NewNetworkController(NetworkControllerDB)
+	FatalUnless(t, err)
+	defer db.done()
+
+	now := time.Unix(1462000000, 0).UTC()
+	newEntry := func(devEUI byte, lastSeen time.Time) devEntry {
+		return devEntry{
+			DevAddr:  []byte{3, 3, 3, 3},
+			Dialer:   NewDialer([]byte("url")),
+			AppEUI:   []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevEUI:   []byte{0, 0, 0, 0, 0, 0, 0, devEUI},
+			NwkSKey:  [16]byte{devEUI},
+			LastSeen: lastSeen,
+		}
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Lookup devices sharing a DevAddr, most recently seen first")
+
+		// Build
+		entry1 := newEntry(1, now.Add(-2*time.Hour))
+		entry2 := newEntry(2, now)
+		entry3 := newEntry(3, now.Add(-time.Hour))
+		FatalUnless(t, db.upsert(entry1))
+		FatalUnless(t, db.upsert(entry2))
+		FatalUnless(t, db.upsert(entry3))
+
+		// Operate
+		entries, err := db.read(entry1.DevAddr)
+
+		// Expect
+		want := []devEntry{entry2, entry3, entry1}
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, want, entries, "DevEntries")
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "An accepted uplink moves the device first")
+
+		// Operate
+		swapped, err := db.setFCntUp([]byte{3, 3, 3, 3}, []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{0, 0, 0, 0, 0, 0, 0, 1}, 0, 1)
+		FatalUnless(t, err)
+		entries, err := db.read([]byte{3, 3, 3, 3})
+		FatalUnless(t, err)
+
+		// Expect
+		want := [][]byte{
+			{0, 0, 0, 0, 0, 0, 0, 1},
+			{0, 0, 0, 0, 0, 0, 0, 2},
+			{0, 0, 0, 0, 0, 0, 0, 3},
+		}
+
+		// Check
+		var got [][]byte
+		for _, entry := range entries {
+			got = append(got, entry.DevEUI)
+		}
+		Check(t, true, swapped, "Swaps")
+		Check(t, want, got, "DevEUIs")
+	}
+}
+
+func TestNetworkControllerLastSeenPersistence(t *testing.T) {
+	NetworkControllerDB := path.Join(os.TempDir(), "TestBrokerNetworkControllerLastSeenPersistence.db")
+	defer func() {
+		os.Remove(NetworkControllerDB)
+	}()
+
+	db, err := NewNetworkController(NetworkControllerDB)
+	FatalUnless(t, err)
+
+	before := time.Now().Add(-time.Hour)
+	entry := devEntry{
+		DevAddr:  []byte{4, 4, 4, 4},
+		Dialer:   NewDialer([]byte("url")),
+		AppEUI:   []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		DevEUI:   []byte{0, 0, 0, 0, 4, 4, 4, 4},
+		NwkSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+		FCntUp:   14,
+		Battery:  42,
+		Margin:   -3,
+		LastSeen: before,
+	}
+	FatalUnless(t, db.upsert(entry))
+
+	// -------------------
+
+	{
+		Desc(t, "An accepted uplink advances LastSeen, which survives a restart")
+
+		// Operate
+		swapped, err := db.setFCntUp(entry.DevAddr, entry.AppEUI, entry.DevEUI, 14, 15)
+		FatalUnless(t, err)
+		FatalUnless(t, db.done())
+		db, err = NewNetworkController(NetworkControllerDB)
+		FatalUnless(t, err)
+		entries, err := db.read(entry.DevAddr)
+		FatalUnless(t, err)
+
+		// Expect
+		want := entry
+		want.FCntUp = 15
+		want.LastSeen = entries[0].LastSeen
+
+		// Check
+		Check(t, true, swapped, "Swaps")
+		Check(t, []devEntry{want}, entries, "DevEntries")
+		Check(t, true, entries[0].LastSeen.After(before), "LastSeen advanced")
+		Check(t, true, time.Since(entries[0].LastSeen) < time.Minute, "LastSeen recent")
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "A rejected uplink leaves LastSeen untouched")
+
+		// Build
+		entries, err := db.read(entry.DevAddr)
+		FatalUnless(t, err)
+		lastSeen := entries[0].LastSeen
+
+		// Operate
+		swapped, err := db.setFCntUp(entry.DevAddr, entry.AppEUI, entry.DevEUI, 14, 16)
+		FatalUnless(t, err)
+		entries, err = db.read(entry.DevAddr)
+		FatalUnless(t, err)
+
+		// Check
+		Check(t, false, swapped, "Swaps")
+		Check(t, true, entries[0].LastSeen.Equal(lastSeen), "LastSeen kept")
+	}
+
+	FatalUnless(t, db.done())
+}
+
+func TestNetworkControllerDeleteAll(t *testing.T) {
+	NetworkControllerDB := path.Join(os.TempDir(), "TestBrokerNetworkControllerDeleteAll.db")
+	defer func() {
+		os.Remove(NetworkControllerDB)
+	}()
+
+	db, err := NewNetworkController(NetworkControllerDB)
+	FatalUnless(t, err)
+	defer db.done()
+
+	appEUI1, appEUI2 := []byte{1, 1, 1, 1, 1, 1, 1, 1}, []byte{2, 2, 2, 2, 2, 2, 2, 2}
+	entries := []devEntry{
+		{
+			DevAddr: []byte{1, 1, 1, 1},
+			Dialer:  NewDialer([]byte("url")),
+			AppEUI:  appEUI1,
+			DevEUI:  []byte{0, 0, 0, 0, 1, 1, 1, 1},
+		},
+		{
+			DevAddr: []byte{1, 1, 1, 1},
+			Dialer:  NewDialer([]byte("url")),
+			AppEUI:  appEUI2,
+			DevEUI:  []byte{0, 0, 0, 0, 2, 2, 2, 2},
+		},
+		{
+			DevAddr: []byte{3, 3, 3, 3},
+			Dialer:  NewDialer([]byte("url")),
+			AppEUI:  appEUI1,
+			DevEUI:  []byte{0, 0, 0, 0, 3, 3, 3, 3},
+		},
+	}
+	for _, entry := range entries {
+		FatalUnless(t, db.upsert(entry))
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Delete the devices of one application only")
+
+		// Operate
+		n, err := db.deleteAll(appEUI1)
+		FatalUnless(t, err)
+		shared, errShared := db.read([]byte{1, 1, 1, 1})
+		_, errAlone := db.read([]byte{3, 3, 3, 3})
+
+		// Expect
+		wantShared := []devEntry{entries[1]}
+
+		// Check
+		Check(t, 2, n, "Deleted devices")
+		CheckErrors(t, nil, errShared)
+		Check(t, wantShared, shared, "DevEntries")
+		CheckErrors(t, ErrNotFound, errAlone)
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Delete the devices of an application without devices")
+
+		// Operate
+		n, err := db.deleteAll(appEUI1)
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, 0, n, "Deleted devices")
+	}
+}
+
+func TestNetworkControllerStatus(t *testing.T) {
+	NetworkControllerDB := path.Join(os.TempDir(), NetworkControllerDB)
+	defer func() {
+		os.Remove(NetworkControllerDB)
+	}()
+
+	db, err := NewNetworkController(NetworkControllerDB)
+	FatalUnless(t, err)
+	defer db.done()
+
+	entry1 := devEntry{
+		DevAddr: []byte{1, 1, 1, 1},
+		Dialer:  NewDialer([]byte("url")),
+		AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		DevEUI:  []byte{0, 0, 0, 0, 1, 1, 1, 1},
+		NwkSKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+		FCntUp:  14,
+	}
+	entry2 := devEntry{
+		DevAddr: []byte{1, 1, 1, 1},
+		Dialer:  NewDialer([]byte("url")),
+		AppEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+		DevEUI:  []byte{0, 0, 0, 0, 2, 2, 2, 2},
+		NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+		FCntUp:  42,
+	}
+	FatalUnless(t, db.upsert(entry1))
+	FatalUnless(t, db.upsert(entry2))
+
+	// -------------------
+
+	{
+		Desc(t, "Set the status of a device")
+
+		// Operate
+		err := db.setStatus(entry1.DevAddr, entry1.AppEUI, entry1.DevEUI, 128, -7)
+		FatalUnless(t, err)
+		entries, err := db.read(entry1.DevAddr)
+		FatalUnless(t, err)
+
+		// Expect
+		want1, want2 := entry1, entry2
+		want1.Battery = 128
+		want1.Margin = -7
+
+		// Check
+		Check(t, []devEntry{want1, want2}, entries, "DevEntries")
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "Set the status of an unknown device")
+
+		// Operate
+		err := db.setStatus(entry1.DevAddr, entry1.AppEUI, []byte{0, 0, 0, 0, 3, 3, 3, 3}, 128, -7)
+
+		// Check
+		CheckErrors(t, ErrNotFound, err)
+	}
 }
 
 func TestNonces(t *testing.T) {
@@ -372,6 +1090,31 @@ func TestNonces(t *testing.T) {
 
 	// -------------------
 
+	{
+		Desc(t, "Store then lookup a noncesEntry with a last join")
+
+		// Build
+		db, _ := NewNetworkController(NetworkControllerDB)
+		entry := noncesEntry{
+			AppEUI:    []byte{1, 2, 4},
+			DevEUI:    []byte{4, 5, 7},
+			DevNonces: [][]byte{[]byte{14, 42}},
+			LastJoin:  time.Unix(1462000000, 0).UTC(),
+		}
+
+		// Operate
+		err := db.upsertNonces(entry)
+		FatalUnless(t, err)
+		got, err := db.readNonces(entry.AppEUI, entry.DevEUI)
+		FatalUnless(t, err)
+
+		// Check
+		Check(t, entry, got, "Nonces Entries")
+		_ = db.done()
+	}
+
+	// -------------------
+
 	{
 		Desc(t, "Update an existing nonce")
 
@@ -420,3 +1163,41 @@ func TestNonces(t *testing.T) {
 		_ = db.done()
 	}
 }
+
+func TestDevEntryRedaction(t *testing.T) {
+	entry := devEntry{
+		AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		DevEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+		DevAddr: []byte{1, 2, 3, 4},
+		FCntUp:  14,
+		NwkSKey: [16]byte{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef},
+	}
+	key := fmt.Sprintf("%X", entry.NwkSKey)
+
+	// -------------------
+
+	{
+		Desc(t, "The session key does not appear in the string representation")
+
+		// Operate
+		str := entry.String()
+
+		// Check
+		Check(t, false, strings.Contains(strings.ToUpper(str), key), "Key leaked")
+		Check(t, true, strings.Contains(str, "01020304"), "DevAddr shown")
+	}
+
+	// -------------------
+
+	{
+		Desc(t, "The session key does not appear in the JSON representation")
+
+		// Operate
+		data, err := json.Marshal(entry)
+		FatalUnless(t, err)
+
+		// Check
+		Check(t, false, strings.Contains(strings.ToUpper(string(data)), key), "Key leaked")
+		Check(t, true, strings.Contains(string(data), `"FCntUp":14`), "FCntUp shown")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/brocaar/lorawan"
+)
+
+// Verdict summarizes the outcome of an uplink diagnosis
+type Verdict string
+
+// Possible verdicts of an uplink diagnosis
+const (
+	VerdictRoutable     Verdict = "routable"
+	VerdictNoSession    Verdict = "no session"
+	VerdictMICMismatch  Verdict = "mic mismatch"
+	VerdictFCntRejected Verdict = "fcnt rejected"
+)
+
+// Candidate reports the resolution steps for one device sharing the diagnosed DevAddr
+type Candidate struct {
+	AppEUI    []byte
+	DevEUI    []byte
+	FCntUp    uint32 // The last frame counter known by the network controller
+	FCnt      uint32 // The full frame counter reconstructed from the uplink one
+	FCntValid bool   // Whether the frame counter is in the accepted range
+	FCntReset bool   // Whether the device is relaxed and the frame counter would be reset
+	MICValid  bool   // Whether the MIC matches with either the 16-bits or 32-bits counter
+}
+
+// Diagnosis describes why an uplink would or would not be routed to a handler
+type Diagnosis struct {
+	DevAddr    []byte
+	FCnt       uint32
+	Verdict    Verdict
+	Candidates []Candidate
+}
+
+// DiagnoseUplink walks through the same resolution steps than HandleData for the given payload and
+// reports the outcome for every candidate. It does not alter the network controller nor contact
+// any handler.
+func (b component) DiagnoseUplink(payload *core.LoRaWANData) (Diagnosis, error) {
+	uplinkPayload, err := core.NewLoRaWANData(payload, true)
+	if err != nil {
+		return Diagnosis{}, errors.New(errors.Structural, err)
+	}
+	fhdr := &uplinkPayload.MACPayload.(*lorawan.MACPayload).FHDR // No nil ref, ensured by NewLoRaWANData()
+	fcnt16 := fhdr.FCnt
+
+	diagnosis := Diagnosis{
+		DevAddr: payload.MACPayload.FHDR.DevAddr,
+		FCnt:    fcnt16,
+	}
+
+	entries, err := b.NetworkController.read(diagnosis.DevAddr)
+	if err != nil {
+		if err.(errors.Failure).Nature != errors.NotFound {
+			return Diagnosis{}, err
+		}
+		diagnosis.Verdict = VerdictNoSession
+		return diagnosis, nil
+	}
+
+	var fcntValid, micValid bool
+	for _, entry := range entries {
+		candidate := Candidate{
+			AppEUI: entry.AppEUI,
+			DevEUI: entry.DevEUI,
+			FCntUp: entry.FCntUp,
+		}
+		key := lorawan.AES128Key(entry.NwkSKey)
+
+		fcnt32, err := b.NetworkController.wholeCounter(fcnt16, entry.FCntUp, b.MaxFCntGap)
+		if err == nil {
+			candidate.FCntValid = true
+		} else if (entry.Flags & core.RelaxFcntCheck) != 0 {
+			fcnt32 = fcnt16
+			candidate.FCntValid = true
+			candidate.FCntReset = true
+		}
+		candidate.FCnt = fcnt32
+
+		if candidate.FCntValid {
+			fcntValid = true
+			fhdr.FCnt = fcnt16
+			ok, err := uplinkPayload.ValidateMIC(key)
+			if err == nil && !ok {
+				fhdr.FCnt = fcnt32
+				ok, err = uplinkPayload.ValidateMIC(key)
+			}
+			candidate.MICValid = err == nil && ok
+			micValid = micValid || candidate.MICValid
+		}
+
+		diagnosis.Candidates = append(diagnosis.Candidates, candidate)
+	}
+
+	switch {
+	case micValid:
+		diagnosis.Verdict = VerdictRoutable
+	case !fcntValid:
+		diagnosis.Verdict = VerdictFCntRejected
+	default:
+		diagnosis.Verdict = VerdictMICMismatch
+	}
+	return diagnosis, nil
+}
@@ -0,0 +1,271 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	"github.com/brocaar/lorawan"
+)
+
+func TestDiagnoseUplink(t *testing.T) {
+	// Builds an uplink with a MIC computed from the given key
+	newPayload := func(t *testing.T, fcnt uint32, key [16]byte) *core.LoRaWANData {
+		payload := &core.LoRaWANData{
+			MHDR: &core.LoRaWANMHDR{
+				MType: uint32(lorawan.UnconfirmedDataUp),
+				Major: uint32(lorawan.LoRaWANR1),
+			},
+			MACPayload: &core.LoRaWANMACPayload{
+				FHDR: &core.LoRaWANFHDR{
+					DevAddr: []byte{1, 2, 3, 4},
+					FCnt:    fcnt,
+					FCtrl:   new(core.LoRaWANFCtrl),
+				},
+				FPort:      1,
+				FRMPayload: []byte{14, 14, 42, 42},
+			},
+			MIC: []byte{0, 0, 0, 0}, // Temporary, computed below
+		}
+		data, err := core.NewLoRaWANData(payload, true)
+		FatalUnless(t, err)
+		err = data.SetMIC(lorawan.AES128Key(key))
+		FatalUnless(t, err)
+		payload.MIC = data.MIC[:]
+		return payload
+	}
+
+	{
+		Desc(t, "Invalid LoRaWAN payload")
+
+		// Build
+		nc := NewMockNetworkController()
+		br := New(Components{NetworkController: nc, Ctx: GetLogger(t, "Broker")}, Options{})
+
+		// Expect
+		var wantErr = ErrStructural
+		var wantDiagnosis Diagnosis
+
+		// Operate
+		diagnosis, err := br.DiagnoseUplink(nil)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDiagnosis, diagnosis, "Diagnoses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Fail to lookup device -> Operational")
+
+		// Build
+		nc := NewMockNetworkController()
+		nc.Failures["read"] = errors.New(errors.Operational, "Mock Error")
+		br := New(Components{NetworkController: nc, Ctx: GetLogger(t, "Broker")}, Options{})
+		payload := newPayload(t, 2, [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6})
+
+		// Expect
+		var wantErr = ErrOperational
+		var wantDiagnosis Diagnosis
+
+		// Operate
+		diagnosis, err := br.DiagnoseUplink(payload)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDiagnosis, diagnosis, "Diagnoses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "No session for DevAddr")
+
+		// Build
+		nc := NewMockNetworkController()
+		nc.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+		br := New(Components{NetworkController: nc, Ctx: GetLogger(t, "Broker")}, Options{})
+		payload := newPayload(t, 2, [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6})
+
+		// Expect
+		var wantErr *string
+		var wantDiagnosis = Diagnosis{
+			DevAddr: []byte{1, 2, 3, 4},
+			FCnt:    2,
+			Verdict: VerdictNoSession,
+		}
+
+		// Operate
+		diagnosis, err := br.DiagnoseUplink(payload)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDiagnosis, diagnosis, "Diagnoses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "MIC mismatch on all candidates")
+
+		// Build
+		nc := NewMockNetworkController()
+		nc.OutWholeCounter.FCnt = 2
+		nc.OutRead.Entries = []devEntry{
+			{
+				AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+				DevEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+				NwkSKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+				FCntUp:  1,
+			},
+			{
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+				FCntUp:  1,
+			},
+		}
+		br := New(Components{NetworkController: nc, Ctx: GetLogger(t, "Broker")}, Options{})
+		payload := newPayload(t, 2, [16]byte{14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14, 14})
+
+		// Expect
+		var wantErr *string
+		var wantDiagnosis = Diagnosis{
+			DevAddr: []byte{1, 2, 3, 4},
+			FCnt:    2,
+			Verdict: VerdictMICMismatch,
+			Candidates: []Candidate{
+				{
+					AppEUI:    nc.OutRead.Entries[0].AppEUI,
+					DevEUI:    nc.OutRead.Entries[0].DevEUI,
+					FCntUp:    1,
+					FCnt:      2,
+					FCntValid: true,
+				},
+				{
+					AppEUI:    nc.OutRead.Entries[1].AppEUI,
+					DevEUI:    nc.OutRead.Entries[1].DevEUI,
+					FCntUp:    1,
+					FCnt:      2,
+					FCntValid: true,
+				},
+			},
+		}
+		var wantUpsert devEntry
+
+		// Operate
+		diagnosis, err := br.DiagnoseUplink(payload)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDiagnosis, diagnosis, "Diagnoses")
+		Check(t, wantUpsert, nc.InUpsert.Entry, "Upserted entries")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "FCnt rejected on all candidates")
+
+		// Build
+		nc := NewMockNetworkController()
+		nc.Failures["wholeCounter"] = errors.New(errors.Structural, "Mock Error")
+		nc.OutRead.Entries = []devEntry{
+			{
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+				FCntUp:  1,
+			},
+		}
+		br := New(Components{NetworkController: nc, Ctx: GetLogger(t, "Broker")}, Options{})
+		payload := newPayload(t, 44567, nc.OutRead.Entries[0].NwkSKey)
+
+		// Expect
+		var wantErr *string
+		var wantDiagnosis = Diagnosis{
+			DevAddr: []byte{1, 2, 3, 4},
+			FCnt:    44567,
+			Verdict: VerdictFCntRejected,
+			Candidates: []Candidate{
+				{
+					AppEUI: nc.OutRead.Entries[0].AppEUI,
+					DevEUI: nc.OutRead.Entries[0].DevEUI,
+					FCntUp: 1,
+				},
+			},
+		}
+
+		// Operate
+		diagnosis, err := br.DiagnoseUplink(payload)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDiagnosis, diagnosis, "Diagnoses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Second candidate matches")
+
+		// Build
+		nc := NewMockNetworkController()
+		nc.OutWholeCounter.FCnt = 2
+		nc.OutRead.Entries = []devEntry{
+			{
+				AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+				DevEUI:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+				NwkSKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+				FCntUp:  1,
+			},
+			{
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				NwkSKey: [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+				FCntUp:  1,
+			},
+		}
+		br := New(Components{NetworkController: nc, Ctx: GetLogger(t, "Broker")}, Options{})
+		payload := newPayload(t, 2, nc.OutRead.Entries[1].NwkSKey)
+
+		// Expect
+		var wantErr *string
+		var wantDiagnosis = Diagnosis{
+			DevAddr: []byte{1, 2, 3, 4},
+			FCnt:    2,
+			Verdict: VerdictRoutable,
+			Candidates: []Candidate{
+				{
+					AppEUI:    nc.OutRead.Entries[0].AppEUI,
+					DevEUI:    nc.OutRead.Entries[0].DevEUI,
+					FCntUp:    1,
+					FCnt:      2,
+					FCntValid: true,
+				},
+				{
+					AppEUI:    nc.OutRead.Entries[1].AppEUI,
+					DevEUI:    nc.OutRead.Entries[1].DevEUI,
+					FCntUp:    1,
+					FCnt:      2,
+					FCntValid: true,
+					MICValid:  true,
+				},
+			},
+		}
+		var wantUpsert devEntry
+
+		// Operate
+		diagnosis, err := br.DiagnoseUplink(payload)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDiagnosis, diagnosis, "Diagnoses")
+		Check(t, wantUpsert, nc.InUpsert.Entry, "Upserted entries")
+	}
+}
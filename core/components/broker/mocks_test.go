@@ -118,9 +118,44 @@ type MockNetworkController struct {
 	OutRead struct {
 		Entries []devEntry
 	}
+	InReadByNwkSKey struct {
+		NwkSKey [16]byte
+	}
+	OutReadByNwkSKey struct {
+		Entries []devEntry
+	}
+	InReadByDevEUI struct {
+		DevEUI []byte
+	}
+	OutReadByDevEUI struct {
+		Entries []devEntry
+	}
 	InUpsert struct {
 		Entry devEntry
 	}
+	InDeleteAll struct {
+		AppEUI []byte
+	}
+	OutDeleteAll struct {
+		Count int
+	}
+	InSetFCntUp struct {
+		DevAddr  []byte
+		AppEUI   []byte
+		DevEUI   []byte
+		Expected uint32
+		FCnt     uint32
+	}
+	OutSetFCntUp struct {
+		Swapped bool
+	}
+	InSetStatus struct {
+		DevAddr []byte
+		AppEUI  []byte
+		DevEUI  []byte
+		Battery uint8
+		Margin  int8
+	}
 	InReadNonces struct {
 		AppEUI []byte
 		DevEUI []byte
@@ -134,6 +169,7 @@ type MockNetworkController struct {
 	InWholeCounter struct {
 		DevCnt   uint32
 		EntryCnt uint32
+		MaxGap   uint32
 	}
 	OutWholeCounter struct {
 		FCnt uint32
@@ -145,9 +181,11 @@ type MockNetworkController struct {
 
 // NewMockNetworkController creates a new MockNetworkController
 func NewMockNetworkController() *MockNetworkController {
-	return &MockNetworkController{
+	m := &MockNetworkController{
 		Failures: make(map[string]error),
 	}
+	m.OutSetFCntUp.Swapped = true
+	return m
 }
 
 // read implements the NetworkController interface
@@ -156,12 +194,50 @@ func (m *MockNetworkController) read(devAddr []byte) ([]devEntry, error) {
 	return m.OutRead.Entries, m.Failures["read"]
 }
 
+// readByNwkSKey implements the NetworkController interface
+func (m *MockNetworkController) readByNwkSKey(nwkSKey [16]byte) ([]devEntry, error) {
+	m.InReadByNwkSKey.NwkSKey = nwkSKey
+	return m.OutReadByNwkSKey.Entries, m.Failures["readByNwkSKey"]
+}
+
+// readByDevEUI implements the NetworkController interface
+func (m *MockNetworkController) readByDevEUI(devEUI []byte) ([]devEntry, error) {
+	m.InReadByDevEUI.DevEUI = devEUI
+	return m.OutReadByDevEUI.Entries, m.Failures["readByDevEUI"]
+}
+
 // upsert implements the NetworkController interface
 func (m *MockNetworkController) upsert(entry devEntry) error {
 	m.InUpsert.Entry = entry
 	return m.Failures["upsert"]
 }
 
+// deleteAll implements the NetworkController interface
+func (m *MockNetworkController) deleteAll(appEUI []byte) (int, error) {
+	m.InDeleteAll.AppEUI = appEUI
+	return m.OutDeleteAll.Count, m.Failures["deleteAll"]
+}
+
+// setFCntUp implements the NetworkController interface
+func (m *MockNetworkController) setFCntUp(devAddr []byte, appEUI []byte, devEUI []byte, expected uint32, fcnt uint32) (bool, error) {
+	m.InSetFCntUp.DevAddr = devAddr
+	m.InSetFCntUp.AppEUI = appEUI
+	m.InSetFCntUp.DevEUI = devEUI
+	m.InSetFCntUp.Expected = expected
+	m.InSetFCntUp.FCnt = fcnt
+	return m.OutSetFCntUp.Swapped, m.Failures["setFCntUp"]
+}
+
+// setStatus implements the NetworkController interface
+func (m *MockNetworkController) setStatus(devAddr []byte, appEUI []byte, devEUI []byte, battery uint8, margin int8) error {
+	m.InSetStatus.DevAddr = devAddr
+	m.InSetStatus.AppEUI = appEUI
+	m.InSetStatus.DevEUI = devEUI
+	m.InSetStatus.Battery = battery
+	m.InSetStatus.Margin = margin
+	return m.Failures["setStatus"]
+}
+
 // readNonces implements the NetworkController interface
 func (m *MockNetworkController) readNonces(appEUI, devEUI []byte) (noncesEntry, error) {
 	m.InReadNonces.AppEUI = appEUI
@@ -176,9 +252,10 @@ func (m *MockNetworkController) upsertNonces(entry noncesEntry) error {
 }
 
 // wholeCnt implements the NetworkController interface
-func (m *MockNetworkController) wholeCounter(devCnt, entryCnt uint32) (uint32, error) {
+func (m *MockNetworkController) wholeCounter(devCnt, entryCnt, maxGap uint32) (uint32, error) {
 	m.InWholeCounter.DevCnt = devCnt
 	m.InWholeCounter.EntryCnt = entryCnt
+	m.InWholeCounter.MaxGap = maxGap
 	return m.OutWholeCounter.FCnt, m.Failures["wholeCounter"]
 }
 
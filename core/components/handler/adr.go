@@ -0,0 +1,115 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/core/band"
+	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+	"github.com/brocaar/lorawan"
+)
+
+const (
+	adrHistorySize = 20   // The number of uplinks an ADR decision is based on
+	adrMargin      = 15.0 // The installation margin kept on top of the demodulation floor, in dB
+	adrStep        = 3.0  // The SNR gained or lost per data rate or transmit power step, in dB
+	adrMaxDataRate = 5    // SF7BW125
+	adrMaxTxPower  = 5    // The lowest transmit power index
+)
+
+// adrRequiredSNR gives the demodulation floor of each spreading factor, in dB. Those are properties
+// of the LoRa modulation, identical in every region.
+var adrRequiredSNR = map[uint]float32{
+	7:  -7.5,
+	8:  -10,
+	9:  -12.5,
+	10: -15,
+	11: -17.5,
+	12: -20,
+}
+
+// channelMask gives the channels a device of the given band is allowed to use once activated, that
+// is, the default channels of the region followed by the ones of the CFList
+func channelMask(b band.Band) lorawan.ChMask {
+	var chMask lorawan.ChMask
+	n := len(b.DefaultChannels())
+	for _, freq := range b.CFList() {
+		if freq != 0 {
+			n++
+		}
+	}
+	for i := 0; i < n && i < len(chMask); i++ {
+		chMask[i] = true
+	}
+	return chMask
+}
+
+// recordLinkSNR appends the best SNR of an uplink among all gateways which received it to the
+// history of a device
+func recordLinkSNR(linkSNR []float32, metadata []*core.Metadata) []float32 {
+	if len(metadata) == 0 {
+		return linkSNR
+	}
+	best := metadata[0].Lsnr
+	for _, m := range metadata[1:] {
+		if m.Lsnr > best {
+			best = m.Lsnr
+		}
+	}
+
+	linkSNR = append(append([]float32{}, linkSNR...), best)
+	if len(linkSNR) > adrHistorySize {
+		linkSNR = linkSNR[len(linkSNR)-adrHistorySize:]
+	}
+	return linkSNR
+}
+
+// computeADR gives the data rate and transmit power a device should switch to, according to the
+// margin observed on its last uplinks. It gives nothing when the device should keep its settings
+// or when there isn't enough history to decide. The device is told to use the given channels.
+func computeADR(datr string, txPower uint8, linkSNR []float32, chMask lorawan.ChMask) (*lorawan.LinkADRReqPayload, bool) {
+	if len(linkSNR) < adrHistorySize {
+		return nil, false
+	}
+
+	sf, bw, err := dutycycle.ParseDatr(datr)
+	if err != nil || bw != 125 {
+		return nil, false
+	}
+	required, ok := adrRequiredSNR[uint(sf)]
+	if !ok {
+		return nil, false
+	}
+
+	max := linkSNR[0]
+	for _, snr := range linkSNR[1:] {
+		if snr > max {
+			max = snr
+		}
+	}
+
+	steps := int((max - required - adrMargin) / adrStep)
+	dataRate, power := uint8(12-sf), txPower
+	for ; steps > 0 && dataRate < adrMaxDataRate; steps-- {
+		dataRate++
+	}
+	for ; steps > 0 && power < adrMaxTxPower; steps-- {
+		power++
+	}
+	for ; steps < 0 && power > 0; steps++ {
+		power--
+	}
+
+	if dataRate == uint8(12-sf) && power == txPower {
+		return nil, false
+	}
+
+	payload := &lorawan.LinkADRReqPayload{
+		DataRate:   dataRate,
+		TXPower:    power,
+		ChMask:     chMask,
+		Redundancy: lorawan.Redundancy{NbRep: 1},
+	}
+	return payload, true
+}
@@ -0,0 +1,141 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/core/band"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	"github.com/brocaar/lorawan"
+)
+
+// linkSNR gives a full history where the best SNR is the given one
+func linkSNR(best float32) []float32 {
+	history := make([]float32, adrHistorySize)
+	for i := range history {
+		history[i] = best - 5
+	}
+	history[adrHistorySize/2] = best
+	return history
+}
+
+// partialBand is a band whose CFList only fills some of the additional channels
+type partialBand struct {
+	band.Band
+}
+
+// CFList implements the band.Band interface
+func (b partialBand) CFList() [5]uint32 {
+	return [5]uint32{867100000, 867300000}
+}
+
+func TestChannelMask(t *testing.T) {
+	{
+		Desc(t, "Default channels and full CFList")
+		b, err := band.Get(band.EU863870)
+		FatalUnless(t, err)
+		want := lorawan.ChMask{true, true, true, true, true, true, true, true}
+		Check(t, want, channelMask(b), "ChMask")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Default channels and partial CFList")
+		b, err := band.Get(band.EU863870)
+		FatalUnless(t, err)
+		want := lorawan.ChMask{true, true, true, true, true}
+		Check(t, want, channelMask(partialBand{Band: b}), "ChMask")
+	}
+}
+
+func TestRecordLinkSNR(t *testing.T) {
+	{
+		Desc(t, "Record the best SNR among all gateways")
+		metadata := []*core.Metadata{{Lsnr: -2.5}, {Lsnr: 7.25}, {Lsnr: 3.0}}
+		Check(t, []float32{1.0, 7.25}, recordLinkSNR([]float32{1.0}, metadata), "Link SNR")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Keep a bounded history")
+		got := recordLinkSNR(linkSNR(10.0), []*core.Metadata{{Lsnr: 14.0}})
+		Check(t, adrHistorySize, len(got), "History size")
+		Check(t, float32(14.0), got[adrHistorySize-1], "Last SNR")
+	}
+}
+
+func TestComputeADR(t *testing.T) {
+	chMask := lorawan.ChMask{true, true, true, true, true, true, true, true}
+
+	{
+		Desc(t, "Not enough history")
+		_, ok := computeADR("SF12BW125", 0, linkSNR(10.0)[1:], chMask)
+		Check(t, false, ok, "Recommendation")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Unsupported data rate")
+		_, ok := computeADR("SF12BW250", 0, linkSNR(10.0), chMask)
+		Check(t, false, ok, "Recommendation")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "High SNR, raise the data rate")
+		want := &lorawan.LinkADRReqPayload{
+			DataRate:   2,
+			TXPower:    0,
+			ChMask:     chMask,
+			Redundancy: lorawan.Redundancy{NbRep: 1},
+		}
+		got, ok := computeADR("SF12BW125", 0, linkSNR(1.0), chMask)
+		Check(t, true, ok, "Recommendation")
+		Check(t, want, got, "LinkADRReq")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Very high SNR, raise the data rate then lower the transmit power")
+		want := &lorawan.LinkADRReqPayload{
+			DataRate:   5,
+			TXPower:    2,
+			ChMask:     chMask,
+			Redundancy: lorawan.Redundancy{NbRep: 1},
+		}
+		got, ok := computeADR("SF9BW125", 0, linkSNR(15.5), chMask)
+		Check(t, true, ok, "Recommendation")
+		Check(t, want, got, "LinkADRReq")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Low SNR, raise the transmit power")
+		want := &lorawan.LinkADRReqPayload{
+			DataRate:   5,
+			TXPower:    1,
+			ChMask:     chMask,
+			Redundancy: lorawan.Redundancy{NbRep: 1},
+		}
+		got, ok := computeADR("SF7BW125", 3, linkSNR(1.0), chMask)
+		Check(t, true, ok, "Recommendation")
+		Check(t, want, got, "LinkADRReq")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Margin within a step, keep the settings")
+		_, ok := computeADR("SF10BW125", 0, linkSNR(1.0), chMask)
+		Check(t, false, ok, "Recommendation")
+	}
+}
@@ -6,6 +6,9 @@ package handler
 import (
 	"encoding"
 	"encoding/binary"
+	"math"
+	"sync"
+	"time"
 
 	dbutil "github.com/TheThingsNetwork/ttn/core/storage"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
@@ -17,6 +20,10 @@ type DevStorage interface {
 	read(appEUI []byte, devEUI []byte) (devEntry, error)
 	readAll(appEUI []byte) ([]devEntry, error)
 	upsert(entry devEntry) error
+	reserve(appEUI []byte, devEUI []byte, maxDevices uint) error
+	release(appEUI []byte, devEUI []byte)
+	upsertIfVersion(entry devEntry, version uint64) error
+	deleteAll(appEUI []byte) (int, error)
 	setDefault(appEUI []byte, entry *devDefaultEntry) error
 	getDefault(appEUI []byte) (*devDefaultEntry, error)
 	done() error
@@ -34,6 +41,11 @@ type devEntry struct {
 	FCntUp   uint32
 	NwkSKey  [16]byte
 	Flags    uint32
+	TxPower  uint8     // The last transmit power index requested through ADR
+	LinkSNR  []float32 // The best SNR of the last uplinks, used for ADR
+	StatusAt time.Time // The last time the device was asked for its status
+	Version  uint64    // Incremented on each write, used to detect concurrent modifications
+	AppNonce [3]byte   // The AppNonce of the last activation
 }
 
 type devDefaultEntry struct {
@@ -41,17 +53,19 @@ type devDefaultEntry struct {
 }
 
 type devStorage struct {
-	db dbutil.Interface
+	sync.Mutex // Guards the versions of the entries and the reservations
+	db         dbutil.Interface
+	reserved   map[string]map[string]int // Registrations in progress, by AppEUI then DevEUI
 }
 
-// NewDevStorage creates a new Device Storage for handler
-func NewDevStorage(name string) (DevStorage, error) {
-	itf, err := dbutil.New(name)
+// NewDevStorage creates a new Device Storage for handler, optionally wrapped (e.g. cached)
+func NewDevStorage(name string, wrappers ...dbutil.Wrapper) (DevStorage, error) {
+	itf, err := dbutil.New(name, wrappers...)
 	if err != nil {
 		return nil, errors.New(errors.Operational, err)
 	}
 
-	return &devStorage{db: itf}, nil
+	return &devStorage{db: itf, reserved: make(map[string]map[string]int)}, nil
 }
 
 func (s *devStorage) read(appEUI []byte, devEUI []byte) (devEntry, error) {
@@ -71,9 +85,129 @@ func (s *devStorage) readAll(appEUI []byte) ([]devEntry, error) {
 }
 
 func (s *devStorage) upsert(entry devEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	version, err := s.version(entry.AppEUI, entry.DevEUI)
+	if err != nil {
+		return err
+	}
+	entry.Version = version + 1
+	return s.db.Update(entry.DevEUI, []encoding.BinaryMarshaler{entry}, entry.AppEUI)
+}
+
+// reserve makes room for a device in the quota of its application, ahead of its registration. It
+// fails with ErrDeviceQuotaExceeded when the application already has maxDevices devices, either
+// stored or being registered. Existing devices can always be updated. The devices are counted and
+// the slot taken under the same lock, so concurrent registrations can't exceed the quota. A
+// maxDevices of 0 means no limit. The slot is given back with release, once the registration is
+// over, whatever its outcome.
+func (s *devStorage) reserve(appEUI []byte, devEUI []byte, maxDevices uint) error {
+	if maxDevices == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	entries, err := s.readAll(appEUI)
+	if err != nil {
+		if ferr, ok := err.(errors.Failure); !ok || ferr.Nature != errors.NotFound {
+			return err
+		}
+	}
+	devices := make(map[string]bool)
+	for _, e := range entries {
+		if e.DevEUI != nil { // The default device shares the bucket and has no DevEUI
+			devices[string(e.DevEUI)] = true
+		}
+	}
+	if devices[string(devEUI)] {
+		return nil
+	}
+
+	reserved := s.reserved[string(appEUI)]
+	if reserved[string(devEUI)] == 0 {
+		for d := range reserved {
+			devices[d] = true
+		}
+		if uint(len(devices)) >= maxDevices {
+			return ErrDeviceQuotaExceeded
+		}
+	}
+	if reserved == nil {
+		reserved = make(map[string]int)
+		s.reserved[string(appEUI)] = reserved
+	}
+	reserved[string(devEUI)]++
+	return nil
+}
+
+// release gives back a slot taken with reserve
+func (s *devStorage) release(appEUI []byte, devEUI []byte) {
+	s.Lock()
+	defer s.Unlock()
+	reserved := s.reserved[string(appEUI)]
+	if reserved[string(devEUI)] > 1 {
+		reserved[string(devEUI)]--
+		return
+	}
+	delete(reserved, string(devEUI))
+	if len(reserved) == 0 {
+		delete(s.reserved, string(appEUI))
+	}
+}
+
+// upsertIfVersion stores an entry only if the stored one hasn't been modified since the given
+// version was read. It fails with a Behavioural error otherwise.
+func (s *devStorage) upsertIfVersion(entry devEntry, version uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	current, err := s.version(entry.AppEUI, entry.DevEUI)
+	if err != nil {
+		return err
+	}
+	if current != version {
+		return errors.New(errors.Behavioural, "Device entry modified concurrently")
+	}
+	entry.Version = version + 1
 	return s.db.Update(entry.DevEUI, []encoding.BinaryMarshaler{entry}, entry.AppEUI)
 }
 
+// version gives the version of a stored entry, 0 if there's none
+func (s *devStorage) version(appEUI []byte, devEUI []byte) (uint64, error) {
+	entry, err := s.read(appEUI, devEUI)
+	if err != nil {
+		if ferr, ok := err.(errors.Failure); ok && ferr.Nature == errors.NotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return entry.Version, nil
+}
+
+// deleteAll removes all devices of an application and gives the number of devices removed. The
+// default device entry of the application is kept.
+func (s *devStorage) deleteAll(appEUI []byte) (int, error) {
+	entries, err := s.readAll(appEUI)
+	if err != nil {
+		if ferr, ok := err.(errors.Failure); ok && ferr.Nature == errors.NotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var n int
+	for _, entry := range entries {
+		if entry.DevEUI == nil { // The default device shares the bucket and has no DevEUI
+			continue
+		}
+		if err := s.db.Delete(entry.DevEUI, appEUI); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
 func (s *devStorage) setDefault(appEUI []byte, entry *devDefaultEntry) error {
 	return s.db.Update([]byte("default"), []encoding.BinaryMarshaler{entry}, appEUI)
 }
@@ -110,6 +244,19 @@ func (e devEntry) MarshalBinary() ([]byte, error) {
 	rw.Write(e.AppEUI)
 	rw.Write(e.DevEUI)
 	rw.Write(e.DevAddr)
+	rw.Write(e.TxPower)
+	linkSNR := make([]byte, 4*len(e.LinkSNR))
+	for i, snr := range e.LinkSNR {
+		binary.BigEndian.PutUint32(linkSNR[4*i:], math.Float32bits(snr))
+	}
+	rw.Write(linkSNR)
+	statusAt, err := e.StatusAt.MarshalBinary()
+	if err != nil {
+		return nil, errors.New(errors.Structural, err)
+	}
+	rw.Write(statusAt)
+	rw.Write(e.Version)
+	rw.Write(e.AppNonce[:])
 	return rw.Bytes()
 }
 
@@ -141,6 +288,38 @@ func (e *devEntry) UnmarshalBinary(data []byte) error {
 		e.DevAddr = make([]byte, len(data))
 		copy(e.DevAddr, data)
 	})
+	rw.TryRead(func(data []byte) error {
+		if len(data) != 1 {
+			return errors.New(errors.Structural, "Invalid TxPower")
+		}
+		e.TxPower = data[0]
+		return nil
+	})
+	rw.TryRead(func(data []byte) error {
+		if len(data)%4 != 0 {
+			return errors.New(errors.Structural, "Invalid LinkSNR")
+		}
+		e.LinkSNR = nil
+		for i := 0; i < len(data); i += 4 {
+			e.LinkSNR = append(e.LinkSNR, math.Float32frombits(binary.BigEndian.Uint32(data[i:])))
+		}
+		return nil
+	})
+	rw.TryRead(func(data []byte) error { return e.StatusAt.UnmarshalBinary(data) })
+	rw.TryRead(func(data []byte) error {
+		if len(data) != 8 {
+			return errors.New(errors.Structural, "Invalid Version")
+		}
+		e.Version = binary.BigEndian.Uint64(data)
+		return nil
+	})
+	rw.TryRead(func(data []byte) error {
+		if len(data) != 3 {
+			return errors.New(errors.Structural, "Invalid AppNonce")
+		}
+		copy(e.AppNonce[:], data)
+		return nil
+	})
 	return rw.Err()
 }
 
@@ -6,6 +6,7 @@ package handler
 import (
 	"os"
 	"path"
+	"sync"
 	"testing"
 
 	. "github.com/TheThingsNetwork/ttn/utils/testing"
@@ -47,9 +48,13 @@ func TestStore(t *testing.T) {
 		FatalUnless(t, err)
 		got, err := db.read(entry.AppEUI, entry.DevEUI)
 
+		// Expect
+		want := entry
+		want.Version = 1
+
 		// Check
 		CheckErrors(t, nil, err)
-		Check(t, entry, got, "Device Entries")
+		Check(t, want, got, "Device Entries")
 	}
 
 	// ------------------
@@ -89,9 +94,13 @@ func TestStore(t *testing.T) {
 		FatalUnless(t, err)
 		got, err := db.read(entry.AppEUI, entry.DevEUI)
 
+		// Expect
+		want := entry
+		want.Version = 2
+
 		// Check
 		CheckErrors(t, nil, err)
-		Check(t, entry, got, "Device Entries")
+		Check(t, want, got, "Device Entries")
 	}
 
 	// ------------------
@@ -124,9 +133,78 @@ func TestStore(t *testing.T) {
 		got, errRead := db.read(entry.AppEUI, entry.DevEUI)
 		FatalUnless(t, errRead)
 
+		// Expect
+		want := update
+		want.Version = 2
+
 		// Check
 		CheckErrors(t, nil, err)
-		Check(t, update, got, "Device Entries")
+		Check(t, want, got, "Device Entries")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Update an unmodified registration")
+
+		// Build
+		entry := devEntry{
+			AppEUI:   []byte{1, 2, 3, 4, 5, 6, 7, 15},
+			DevEUI:   []byte{0, 0, 0, 0, 1, 2, 3, 4},
+			DevAddr:  []byte{1, 2, 3, 4},
+			FCntDown: 2,
+		}
+		FatalUnless(t, db.upsert(entry))
+		stored, err := db.read(entry.AppEUI, entry.DevEUI)
+		FatalUnless(t, err)
+		stored.FCntDown = 14
+
+		// Operate
+		err = db.upsertIfVersion(stored, stored.Version)
+		got, errRead := db.read(entry.AppEUI, entry.DevEUI)
+		FatalUnless(t, errRead)
+
+		// Expect
+		want := stored
+		want.Version = 2
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, want, got, "Device Entries")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Update a registration modified meanwhile")
+
+		// Build
+		entry := devEntry{
+			AppEUI:   []byte{1, 2, 3, 4, 5, 6, 7, 16},
+			DevEUI:   []byte{0, 0, 0, 0, 1, 2, 3, 4},
+			DevAddr:  []byte{1, 2, 3, 4},
+			FCntDown: 2,
+		}
+		FatalUnless(t, db.upsert(entry))
+		stored, err := db.read(entry.AppEUI, entry.DevEUI)
+		FatalUnless(t, err)
+		edit := entry
+		edit.DevAddr = []byte{4, 3, 2, 1}
+		FatalUnless(t, db.upsert(edit))
+		stored.FCntDown = 14
+
+		// Operate
+		err = db.upsertIfVersion(stored, stored.Version)
+		got, errRead := db.read(entry.AppEUI, entry.DevEUI)
+		FatalUnless(t, errRead)
+
+		// Expect
+		want := edit
+		want.Version = 2
+
+		// Check
+		CheckErrors(t, ErrBehavioural, err)
+		Check(t, want, got, "Device Entries")
 	}
 
 	// ------------------
@@ -169,6 +247,9 @@ func TestStore(t *testing.T) {
 		FatalUnless(t, err)
 		entries, err := db.readAll(entry1.AppEUI)
 
+		// Expect
+		entry1.Version, entry2.Version = 1, 1
+
 		// Check
 		CheckErrors(t, nil, err)
 		Check(t, []devEntry{entry1, entry2}, entries, "Devices Entries")
@@ -176,6 +257,169 @@ func TestStore(t *testing.T) {
 
 	// ------------------
 
+	{
+		Desc(t, "Reserve new devices concurrently, within a quota")
+
+		// Build
+		appEUI := []byte{9, 9, 9, 9, 9, 9, 9, 9}
+		var wg sync.WaitGroup
+		reserved := make(chan []byte, 10)
+		errs := make(chan error, 10)
+
+		// Operate
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(devEUI []byte) {
+				defer wg.Done()
+				err := db.reserve(appEUI, devEUI, 3)
+				if err == nil {
+					reserved <- devEUI
+				}
+				errs <- err
+			}([]byte{0, 0, 0, 0, 9, 9, 9, byte(i)})
+		}
+		wg.Wait()
+		close(reserved)
+		close(errs)
+		var rejected int
+		for err := range errs {
+			if err == ErrDeviceQuotaExceeded {
+				rejected++
+			}
+		}
+		var stored int
+		for devEUI := range reserved {
+			err := db.upsert(devEntry{AppEUI: appEUI, DevEUI: devEUI})
+			FatalUnless(t, err)
+			db.release(appEUI, devEUI)
+			stored++
+		}
+
+		// Check
+		Check(t, 3, stored, "Reserved devices")
+		Check(t, 7, rejected, "Rejected devices")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Reserve a new device with the quota reached")
+
+		// Operate
+		err := db.reserve([]byte{9, 9, 9, 9, 9, 9, 9, 9}, []byte{0, 0, 0, 0, 9, 9, 9, 14}, 3)
+
+		// Check
+		CheckErrors(t, ErrBehavioural, err)
+		Check(t, ErrDeviceQuotaExceeded, err, "Errors")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Reserve an existing device with the quota reached")
+
+		// Build
+		appEUI := []byte{9, 9, 9, 9, 9, 9, 9, 9}
+		entries, err := db.readAll(appEUI)
+		FatalUnless(t, err)
+
+		// Operate
+		err = db.reserve(appEUI, entries[0].DevEUI, 3)
+		db.release(appEUI, entries[0].DevEUI)
+
+		// Check
+		CheckErrors(t, nil, err)
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Reserve twice the same new device")
+
+		// Build
+		appEUI := []byte{9, 9, 9, 9, 9, 9, 9, 10}
+		devEUI := []byte{0, 0, 0, 0, 9, 9, 9, 9}
+
+		// Operate
+		err1 := db.reserve(appEUI, devEUI, 1)
+		err2 := db.reserve(appEUI, devEUI, 1)
+		db.release(appEUI, devEUI)
+		err3 := db.reserve(appEUI, []byte{0, 0, 0, 0, 9, 9, 9, 10}, 1)
+		db.release(appEUI, devEUI)
+		err4 := db.reserve(appEUI, []byte{0, 0, 0, 0, 9, 9, 9, 10}, 1)
+
+		// Check
+		CheckErrors(t, nil, err1)
+		CheckErrors(t, nil, err2)
+		CheckErrors(t, ErrBehavioural, err3)
+		CheckErrors(t, nil, err4)
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Delete all devices of an application")
+
+		// Build
+		appEUI1 := []byte{4, 4, 4, 4, 4, 4, 4, 1}
+		appEUI2 := []byte{4, 4, 4, 4, 4, 4, 4, 2}
+		entry1 := devEntry{
+			AppEUI:  appEUI1,
+			DevEUI:  []byte{0, 0, 0, 0, 0, 0, 0, 1},
+			DevAddr: []byte{1, 1, 1, 1},
+		}
+		entry2 := devEntry{
+			AppEUI:  appEUI1,
+			DevEUI:  []byte{0, 0, 0, 0, 0, 0, 0, 2},
+			DevAddr: []byte{2, 2, 2, 2},
+		}
+		entry3 := devEntry{
+			AppEUI:  appEUI2,
+			DevEUI:  []byte{0, 0, 0, 0, 0, 0, 0, 3},
+			DevAddr: []byte{3, 3, 3, 3},
+		}
+		defaultEntry := devDefaultEntry{
+			AppKey: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8},
+		}
+		FatalUnless(t, db.upsert(entry1))
+		FatalUnless(t, db.upsert(entry2))
+		FatalUnless(t, db.upsert(entry3))
+		FatalUnless(t, db.setDefault(appEUI1, &defaultEntry))
+
+		// Operate
+		n, err := db.deleteAll(appEUI1)
+		FatalUnless(t, err)
+		_, errRead := db.read(appEUI1, entry1.DevEUI)
+		entries, err := db.readAll(appEUI2)
+		FatalUnless(t, err)
+		def, err := db.getDefault(appEUI1)
+		FatalUnless(t, err)
+
+		// Expect
+		entry3.Version = 1
+
+		// Check
+		Check(t, 2, n, "Devices removed")
+		CheckErrors(t, ErrNotFound, errRead)
+		Check(t, []devEntry{entry3}, entries, "Devices Entries")
+		Check(t, &defaultEntry, def, "Default Entry")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Delete all devices of an unknown application")
+
+		// Operate
+		n, err := db.deleteAll([]byte{4, 4, 4, 4, 4, 4, 4, 3})
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, 0, n, "Devices removed")
+	}
+
+	// ------------------
+
 	{
 		Desc(t, "Read a non-existing default device entry")
 
@@ -234,6 +478,7 @@ func TestMarshalUnmarshalDevEntries(t *testing.T) {
 			DevEUI:   []byte{14, 14, 14, 14, 14, 14, 14, 14},
 			FCntDown: 42,
 			NwkSKey:  [16]byte{28, 27, 26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13},
+			Version:  3,
 		}
 
 		data, err := entry.MarshalBinary()
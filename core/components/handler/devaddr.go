@@ -0,0 +1,91 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"bytes"
+
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/TheThingsNetwork/ttn/utils/random"
+)
+
+// maxDevAddrAttempts bounds the number of addresses drawn before giving up on an allocation
+const maxDevAddrAttempts = 10
+
+// devAddrAllocator draws random device addresses within a given prefix
+type devAddrAllocator struct {
+	Prefix      [4]byte                             // The NwkID prefix, left-aligned
+	Length      uint                                // The number of significant bits in Prefix, at most 32
+	InUse       func(devAddr [4]byte) (bool, error) // Tells whether an address is already taken, optional
+	MaxAttempts int                                 // The number of addresses drawn before failing, defaults to maxDevAddrAttempts
+}
+
+// allocate returns a fresh address which matches the prefix and isn't in use
+func (a devAddrAllocator) allocate() ([4]byte, error) {
+	attempts := a.MaxAttempts
+	if attempts <= 0 {
+		attempts = maxDevAddrAttempts
+	}
+
+	for i := 0; i < attempts; i++ {
+		devAddr := a.draw()
+		if a.InUse == nil {
+			return devAddr, nil
+		}
+		inUse, err := a.InUse(devAddr)
+		if err != nil {
+			return [4]byte{}, errors.New(errors.Operational, err)
+		}
+		if !inUse {
+			return devAddr, nil
+		}
+	}
+	return [4]byte{}, errors.New(errors.Operational, "Unable to allocate a free DevAddr")
+}
+
+// draw generates a random address and overwrites its most significant bits with the prefix
+func (a devAddrAllocator) draw() [4]byte {
+	var devAddr [4]byte
+	copy(devAddr[:], random.Bytes(4))
+	for i := uint(0); i < a.Length && i < 32; i++ {
+		mask := byte(0x80) >> (i % 8)
+		devAddr[i/8] = (devAddr[i/8] &^ mask) | (a.Prefix[i/8] & mask)
+	}
+	return devAddr
+}
+
+// matches tells whether the given address belongs to the allocator prefix
+func (a devAddrAllocator) matches(devAddr [4]byte) bool {
+	for i := uint(0); i < a.Length && i < 32; i++ {
+		mask := byte(0x80) >> (i % 8)
+		if devAddr[i/8]&mask != a.Prefix[i/8]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+// allocateDevAddr gives a device of an application a fresh address. Devices are only looked up by
+// application, hence the collision check is restricted to the other devices of the same application.
+// Those are read once, whatever the number of addresses drawn.
+func (h component) allocateDevAddr(appEUI []byte, devEUI []byte) ([4]byte, error) {
+	entries, err := h.DevStorage.readAll(appEUI)
+	if err != nil && err.(errors.Failure).Nature != errors.NotFound {
+		return [4]byte{}, errors.New(errors.Operational, err)
+	}
+	inUse := make(map[[4]byte]bool, len(entries))
+	for _, entry := range entries {
+		if len(entry.DevAddr) == 4 && !bytes.Equal(entry.DevEUI, devEUI) {
+			var devAddr [4]byte
+			copy(devAddr[:], entry.DevAddr)
+			inUse[devAddr] = true
+		}
+	}
+
+	allocator := h.DevAddrs
+	allocator.InUse = func(devAddr [4]byte) (bool, error) {
+		return inUse[devAddr], nil
+	}
+	return allocator.allocate()
+}
@@ -0,0 +1,209 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+)
+
+func TestDevAddrAllocator(t *testing.T) {
+	{
+		Desc(t, "Allocated addresses always match the prefix")
+
+		// Build
+		allocators := []devAddrAllocator{
+			{Prefix: [4]byte{0x1c}, Length: 7},
+			{Prefix: [4]byte{0xff, 0xf0}, Length: 12},
+			{Prefix: [4]byte{0x00, 0x00, 0x00, 0x00}, Length: 25},
+			{Prefix: [4]byte{0x26, 0x01, 0x14, 0x42}, Length: 32},
+		}
+
+		// Operate
+		var mismatches int
+		for _, allocator := range allocators {
+			for i := 0; i < 100; i++ {
+				devAddr, err := allocator.allocate()
+				FatalUnless(t, err)
+				if !allocator.matches(devAddr) {
+					t.Logf("%X does not match prefix %X/%d", devAddr, allocator.Prefix, allocator.Length)
+					mismatches++
+				}
+			}
+		}
+
+		// Check
+		Check(t, 0, mismatches, "Mismatches")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Retry when the drawn address is already in use")
+
+		// Build
+		var calls int
+		allocator := devAddrAllocator{
+			Prefix: [4]byte{0x1c},
+			Length: 7,
+			InUse: func(devAddr [4]byte) (bool, error) {
+				calls++
+				return calls < 3, nil
+			},
+		}
+
+		// Expect
+		var wantErr *string
+		wantCalls := 3
+
+		// Operate
+		devAddr, err := allocator.allocate()
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantCalls, calls, "InUse calls")
+		Check(t, true, allocator.matches(devAddr), "Prefix match")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Give up once all attempts collided")
+
+		// Build
+		var calls int
+		allocator := devAddrAllocator{
+			Prefix:      [4]byte{0x1c},
+			Length:      7,
+			MaxAttempts: 4,
+			InUse: func(devAddr [4]byte) (bool, error) {
+				calls++
+				return true, nil
+			},
+		}
+
+		// Expect
+		var wantErr = ErrOperational
+		wantCalls := 4
+
+		// Operate
+		_, err := allocator.allocate()
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantCalls, calls, "InUse calls")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Fail when the collision check fails")
+
+		// Build
+		allocator := devAddrAllocator{
+			Prefix: [4]byte{0x1c},
+			Length: 7,
+			InUse: func(devAddr [4]byte) (bool, error) {
+				return false, errors.New(errors.Operational, "Mock Error")
+			},
+		}
+
+		// Expect
+		var wantErr = ErrOperational
+
+		// Operate
+		_, err := allocator.allocate()
+
+		// Check
+		CheckErrors(t, wantErr, err)
+	}
+}
+
+// countingDevStorage is a device storage counting the lookups of all devices of an application
+type countingDevStorage struct {
+	*MockDevStorage
+	ReadAlls int
+}
+
+// readAll implements the DevStorage interface
+func (m *countingDevStorage) readAll(appEUI []byte) ([]devEntry, error) {
+	m.ReadAlls++
+	return m.MockDevStorage.readAll(appEUI)
+}
+
+func TestAllocateDevAddr(t *testing.T) {
+	{
+		Desc(t, "Look the devices of the application up once, whatever the attempts")
+
+		// Build
+		devStorage := &countingDevStorage{MockDevStorage: NewMockDevStorage()}
+		devStorage.OutReadAll.Entries = []devEntry{
+			{
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{3, 3, 3, 3, 3, 3, 3, 3},
+				DevAddr: []byte{0x26, 0x01, 0x14, 0x42},
+			},
+		}
+		h := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			DevStorage: devStorage,
+			PktStorage: NewMockPktStorage(),
+		}, Options{
+			PublicNetAddr:       "localhost",
+			PrivateNetAddr:      "localhost",
+			DevAddrPrefix:       [4]byte{0x26, 0x01, 0x14, 0x42},
+			DevAddrPrefixLength: 32, // Every attempt draws the address in use
+		}).(*component)
+
+		// Expect
+		var wantErr = ErrOperational
+		var wantReadAlls = 1
+
+		// Operate
+		_, err := h.allocateDevAddr([]byte{1, 1, 1, 1, 1, 1, 1, 1}, []byte{2, 2, 2, 2, 2, 2, 2, 2})
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantReadAlls, devStorage.ReadAlls, "Device lookups")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Keep the address of the device itself")
+
+		// Build
+		devStorage := &countingDevStorage{MockDevStorage: NewMockDevStorage()}
+		devStorage.OutReadAll.Entries = []devEntry{
+			{
+				AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				DevAddr: []byte{0x26, 0x01, 0x14, 0x42},
+			},
+		}
+		h := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			DevStorage: devStorage,
+			PktStorage: NewMockPktStorage(),
+		}, Options{
+			PublicNetAddr:       "localhost",
+			PrivateNetAddr:      "localhost",
+			DevAddrPrefix:       [4]byte{0x26, 0x01, 0x14, 0x42},
+			DevAddrPrefixLength: 32,
+		}).(*component)
+
+		// Expect
+		var wantErr *string
+		var wantDevAddr = [4]byte{0x26, 0x01, 0x14, 0x42}
+
+		// Operate
+		devAddr, err := h.allocateDevAddr([]byte{1, 1, 1, 1, 1, 1, 1, 1}, []byte{2, 2, 2, 2, 2, 2, 2, 2})
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDevAddr, devAddr, "DevAddrs")
+	}
+}
@@ -11,8 +11,10 @@ import (
 	"time"
 
 	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/core/band"
 	"github.com/TheThingsNetwork/ttn/core/dutycycle"
 	"github.com/TheThingsNetwork/ttn/core/otaa"
+	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
 	"github.com/TheThingsNetwork/ttn/utils/random"
 	"github.com/TheThingsNetwork/ttn/utils/stats"
@@ -22,7 +24,7 @@ import (
 	"google.golang.org/grpc"
 )
 
-// bufferDelay defines the timeframe length during which we bufferize packets
+// bufferDelay defines the default timeframe length during which we bufferize packets
 const bufferDelay time.Duration = time.Millisecond * 300
 
 // dataRates makes correspondance between string datarate identifier and lorawan uint descriptors
@@ -43,8 +45,15 @@ type component struct {
 	PublicNetAddr          string
 	PrivateNetAddr         string
 	PrivateNetAddrAnnounce string
+	MaxDevicesPerApp       uint
+	MaxMetadata            uint
+	BufferDelay            time.Duration
+	DevStatusInterval      time.Duration
+	DevAddrs               devAddrAllocator
+	DedupDownlinks         map[types.AppEUI]bool
 	Configuration          struct {
 		CFList      [5]uint32
+		ChMask      lorawan.ChMask
 		NetID       [3]byte
 		RX1DROffset uint8
 		RX2DataRate string
@@ -62,6 +71,8 @@ type component struct {
 type Interface interface {
 	core.HandlerServer
 	core.HandlerManagerServer
+	EnqueueMAC(appEUI types.AppEUI, devEUI types.DevEUI, cmd lorawan.MACCommand) error
+	DeleteDevices(appEUI types.AppEUI) (int, error)
 	Start() error
 }
 
@@ -76,10 +87,19 @@ type Components struct {
 
 // Options is used to make handler instantiation easier
 type Options struct {
-	PublicNetAddr          string // Net Address used to communicate with the handler from the outside
-	PrivateNetAddr         string // Net Address the handler listens on for internal communications
-	PrivateNetAddrAnnounce string // Net Address the handler announces to brokers for internal communications
-	ProcessedQueueSize     uint   // The maximum number of appEUI + devEUI the handler can process at the same time
+	PublicNetAddr          string         // Net Address used to communicate with the handler from the outside
+	PrivateNetAddr         string         // Net Address the handler listens on for internal communications
+	PrivateNetAddrAnnounce string         // Net Address the handler announces to brokers for internal communications
+	ProcessedQueueSize     uint           // The maximum number of appEUI + devEUI the handler can process at the same time
+	MaxDevicesPerApp       uint           // The maximum number of devices registered per application, 0 means no limit
+	DedupDownlinks         []types.AppEUI // Applications for which a downlink identical to the last queued one is discarded
+	MaxMetadata            uint           // The maximum number of gateway metadata kept per uplink, the best by SNR, 0 means no limit
+	BufferDelay            time.Duration  // The time during which duplicates of a packet are gathered, defaults to 300ms
+	DevAddrPrefix          [4]byte        // The NwkID prefix of allocated device addresses, left-aligned
+	DevAddrPrefixLength    uint           // The number of bits of DevAddrPrefix to use, 0 means the 7 lsb of the NetID
+	DevStatusInterval      time.Duration  // The interval at which devices are asked for their battery level and link margin, 0 means never
+	Band                   band.Band      // The regional parameters used to answer devices, defaults to EU_863_870
+	NetID                  [3]byte        // The network identifier sent to devices on join, 000000 being a valid one
 }
 
 // bundle are used to materialize an incoming request being bufferized, waiting for the others.
@@ -97,28 +117,52 @@ func New(c Components, o Options) Interface {
 	if o.ProcessedQueueSize == 0 {
 		o.ProcessedQueueSize = 5000
 	}
+	if o.BufferDelay == 0 {
+		o.BufferDelay = bufferDelay
+	}
+	if o.Band == nil {
+		o.Band, _ = band.Get(band.EU863870)
+	}
 
 	h := &component{
 		Components:             c,
 		PublicNetAddr:          o.PublicNetAddr,
 		PrivateNetAddr:         o.PrivateNetAddr,
 		PrivateNetAddrAnnounce: o.PrivateNetAddrAnnounce,
+		MaxDevicesPerApp:       o.MaxDevicesPerApp,
+		MaxMetadata:            o.MaxMetadata,
+		BufferDelay:            o.BufferDelay,
+		DevStatusInterval:      o.DevStatusInterval,
 		Processed:              newPQueue(o.ProcessedQueueSize),
+		DedupDownlinks:         make(map[types.AppEUI]bool),
+	}
+	for _, appEUI := range o.DedupDownlinks {
+		h.DedupDownlinks[appEUI] = true
 	}
 
+	rx2 := o.Band.RX2Params()
+	h.Configuration.CFList = o.Band.CFList()
+	h.Configuration.ChMask = channelMask(o.Band)
+	h.Configuration.RX1DROffset = o.Band.RX1Offset()
+	h.Configuration.RX2DataRate = rx2.DataRate
+	h.Configuration.RX2Freq = rx2.Frequency
+	h.Configuration.PowerRX1 = o.Band.RX1Power()
+	h.Configuration.PowerRX2 = rx2.Power
+
+	h.Configuration.NetID = o.NetID
+
 	// TODO Make it configurable
-	h.Configuration.CFList = [5]uint32{867100000, 867300000, 867500000, 867700000, 867900000}
-	h.Configuration.NetID = [3]byte{14, 14, 14}
-	h.Configuration.RX1DROffset = 0
-	h.Configuration.RX2DataRate = "SF9BW125"
-	h.Configuration.RX2Freq = 869.525
 	h.Configuration.RXDelay = 1
 	h.Configuration.JoinDelay = 5
-	h.Configuration.PowerRX1 = 14
-	h.Configuration.PowerRX2 = 27
 	h.Configuration.RFChain = 0
 	h.Configuration.InvPolarity = true
 
+	h.DevAddrs = devAddrAllocator{Prefix: o.DevAddrPrefix, Length: o.DevAddrPrefixLength}
+	if h.DevAddrs.Length == 0 {
+		h.DevAddrs.Prefix = [4]byte{h.Configuration.NetID[2] << 1} // DevAddr 7 msb are NetID 7 lsb
+		h.DevAddrs.Length = 7
+	}
+
 	set := make(chan bundle)
 	bundles := make(chan []bundle)
 
@@ -171,6 +215,7 @@ func (h component) HandleJoin(bctx context.Context, req *core.JoinHandlerReq) (*
 	ctx.Debug("Handle join request")
 
 	// 1. Lookup the associated entry or create new entry based on default
+	var isNew bool
 	entry, err := h.DevStorage.read(req.AppEUI, req.DevEUI)
 	if ferr, ok := err.(errors.Failure); ok && ferr.Nature == errors.NotFound { // The device is unknown, check if there are default settings
 		defaultEntry, err := h.DevStorage.getDefault(req.AppEUI)
@@ -182,17 +227,12 @@ func (h component) HandleJoin(bctx context.Context, req *core.JoinHandlerReq) (*
 			ctx.Debug("Device unknown and no default device settings configured")
 			return new(core.JoinHandlerRes), errors.New(errors.NotFound, "Device unknown and no default device settings configured")
 		}
-		// Register a new OTAA device based on default
-		ctx.Debug("Registering a new OTAA device based on default settings")
+		isNew = true
 		entry = devEntry{
 			AppEUI: req.AppEUI,
 			AppKey: &defaultEntry.AppKey,
 			DevEUI: req.DevEUI,
 		}
-		if err = h.DevStorage.upsert(entry); err != nil {
-			ctx.WithError(err).Debug("Failed to store new device based on default settings")
-			return new(core.JoinHandlerRes), err
-		}
 	} else if err != nil { // General error
 		ctx.WithError(err).Debug("Failed to retrieve device entry from storage")
 		return new(core.JoinHandlerRes), err
@@ -215,10 +255,25 @@ func (h component) HandleJoin(bctx context.Context, req *core.JoinHandlerReq) (*
 		return new(core.JoinHandlerRes), errors.New(errors.Structural, "Unable to validate MIC")
 	}
 
-	// 3. Prepare a channel to receive the response from the consumer
+	// 3. Register a new OTAA device based on default, only once the request is known to be genuine
+	if isNew {
+		if err := h.reserveDevice(req.AppEUI, req.DevEUI); err != nil {
+			ctx.WithError(err).Debug("Unable to register a new device based on default settings")
+			return new(core.JoinHandlerRes), err
+		}
+		ctx.Debug("Registering a new OTAA device based on default settings")
+		err := h.DevStorage.upsert(entry)
+		h.DevStorage.release(req.AppEUI, req.DevEUI)
+		if err != nil {
+			ctx.WithError(err).Debug("Failed to store new device based on default settings")
+			return new(core.JoinHandlerRes), err
+		}
+	}
+
+	// 4. Prepare a channel to receive the response from the consumer
 	chresp := make(chan interface{})
 
-	// 4. Create a "bundle" which holds info waiting for other related packets
+	// 5. Create a "bundle" which holds info waiting for other related packets
 	var bundleID [21]byte             // Type | AppEUI(8) | DevEUI(8) | DevNonce | [ 0 0 ]
 	buf := bytes.NewBuffer([]byte{0}) // 0 for join
 	binary.Write(buf, binary.BigEndian, req.AppEUI)
@@ -226,7 +281,7 @@ func (h component) HandleJoin(bctx context.Context, req *core.JoinHandlerReq) (*
 	binary.Write(buf, binary.BigEndian, req.DevNonce)
 	copy(bundleID[:], buf.Bytes())
 
-	// 5. Send the actual bundle to the consumer
+	// 6. Send the actual bundle to the consumer
 	ctx.WithField("BundleID", bundleID).Debug("Define new bundle")
 
 	h.ChBundles <- bundle{
@@ -238,7 +293,7 @@ func (h component) HandleJoin(bctx context.Context, req *core.JoinHandlerReq) (*
 		Time:     time.Now(),
 	}
 
-	// 6. Control the response
+	// 7. Control the response
 	resp := <-chresp
 	switch resp.(type) {
 	case *core.JoinHandlerRes:
@@ -282,14 +337,28 @@ func (h component) HandleDataDown(bctx context.Context, req *core.DataDownHandle
 		return new(core.DataDownHandlerRes), errors.New(errors.Structural, "Invalid TTL")
 	}
 
-	h.Ctx.WithField("DevEUI", req.DevEUI).WithField("AppEUI", req.AppEUI).Debug("Handle downlink - enqueue")
+	ctx := h.Ctx.WithField("DevEUI", req.DevEUI).WithField("AppEUI", req.AppEUI)
+	ctx.Debug("Handle downlink - enqueue")
 
-	return new(core.DataDownHandlerRes), h.PktStorage.enqueue(pktEntry{
+	entry := pktEntry{
 		Payload: req.Payload,
 		AppEUI:  req.AppEUI,
 		DevEUI:  req.DevEUI,
 		TTL:     time.Now().Add(ttl),
-	})
+	}
+
+	var appEUI types.AppEUI
+	appEUI.Unmarshal(req.AppEUI)
+	if !h.DedupDownlinks[appEUI] {
+		return new(core.DataDownHandlerRes), h.PktStorage.enqueue(entry)
+	}
+
+	queued, err := h.PktStorage.enqueueUnique(entry)
+	if err == nil && !queued {
+		stats.MarkMeter("handler.downlink.duplicate")
+		ctx.Debug("Identical downlink already queued - discarded")
+	}
+	return new(core.DataDownHandlerRes), err
 }
 
 // HandleDataUp implements the core.HandlerServer interface
@@ -412,7 +481,7 @@ func (h component) consumeSet(chbundles chan<- []bundle, chset <-chan bundle) {
 			bundles := append(buffers[b.ID], b)
 			if len(bundles) == 1 {
 				ctx.Debug("Start buffering")
-				go setAlarm(alarm, b.ID, bufferDelay)
+				go setAlarm(alarm, b.ID, h.BufferDelay)
 			}
 			buffers[b.ID] = bundles
 		}
@@ -480,13 +549,15 @@ func (h component) consumeJoin(appEUI []byte, devEUI []byte, appKey [16]byte, da
 	packet := bundles[best.ID].Packet.(*core.JoinHandlerReq)
 
 	// Generate a DevAddr - Note: this should be done by the Broker (issue #90).
-	var devAddr [4]byte
-	copy(devAddr[:], random.Bytes(4))
-	devAddr[0] = (h.Configuration.NetID[2] << 1) | (devAddr[0] & 1) // DevAddr 7 msb are NetID 7 lsb
+	devAddr, err := h.allocateDevAddr(appEUI, devEUI)
+	if err != nil {
+		ctx.WithError(err).Debug("Unable to allocate a DevAddr")
+		h.abortConsume(err, bundles)
+		return
+	}
 
-	// Generate appNonce
-	var appNonce [3]byte
-	copy(appNonce[:], random.Bytes(3))
+	// Generate appNonce, the device derives its session keys from it
+	appNonce := newAppNonce(bundles[0].Entry.AppNonce)
 
 	var devNonce [2]byte
 	copy(devNonce[:], packet.DevNonce)
@@ -509,6 +580,7 @@ func (h component) consumeJoin(appEUI []byte, devEUI []byte, appKey [16]byte, da
 		FCntUp:   0,
 		NwkSKey:  nwkSKey,
 		Flags:    0,
+		AppNonce: appNonce,
 	})
 	if err != nil {
 		ctx.WithError(err).Debug("Unable to initialize devEntry with activation")
@@ -528,7 +600,7 @@ func (h component) consumeJoin(appEUI []byte, devEUI []byte, appKey [16]byte, da
 
 	// Notify the application
 	_, err = h.AppAdapter.HandleJoin(context.Background(), &core.JoinAppReq{
-		Metadata: metadata,
+		Metadata: capMetadata(sortMetadata(metadata), h.MaxMetadata),
 		AppEUI:   appEUI,
 		DevEUI:   devEUI,
 	})
@@ -604,7 +676,7 @@ func (h component) consumeDown(appEUI []byte, devEUI []byte, dataRate string, bu
 		FPort:    fPort,
 		FCnt:     fCnt,
 		Payload:  payload,
-		Metadata: metadata,
+		Metadata: capMetadata(sortMetadata(metadata), h.MaxMetadata),
 	})
 	if err != nil {
 		h.abortConsume(errors.New(errors.Operational, err), bundles)
@@ -613,8 +685,23 @@ func (h component) consumeDown(appEUI []byte, devEUI []byte, dataRate string, bu
 
 	stats.MarkMeter("handler.uplink.out")
 
+	// Keep track of the link quality of devices relying on adaptive data rate
+	var cmds []lorawan.MACCommand
+	if (bundles[0].Entry.Flags & core.EnableADR) != 0 {
+		linkSNR := recordLinkSNR(bundles[0].Entry.LinkSNR, metadata)
+		for i := range bundles {
+			bundles[i].Entry.LinkSNR = linkSNR
+		}
+		if adr, ok := computeADR(dataRate, bundles[0].Entry.TxPower, linkSNR, h.Configuration.ChMask); ok {
+			cmds = append(cmds, lorawan.MACCommand{CID: lorawan.LinkADRReq, Payload: adr})
+		}
+	}
+
 	// Now handle the downlink and respond to node
 	best := computer.Get(scores)
+	if (bundles[0].Entry.Flags & core.ForceRX2) != 0 {
+		best = computer.GetRX2(scores)
+	}
 	var downlink pktEntry
 	if best != nil { // Avoid pulling when there's no gateway available for an answer
 		downlink, err = h.PktStorage.dequeue(appEUI, devEUI)
@@ -624,39 +711,78 @@ func (h component) consumeDown(appEUI []byte, devEUI []byte, dataRate string, bu
 		return
 	}
 
-	// One of those bundle might be available for a response
+	// Ask the device for its status from time to time, and gather the MAC commands to send
+	var queued []lorawan.MACCommand
+	var statusReq bool
+	if best != nil {
+		if h.DevStatusInterval > 0 && time.Since(bundles[0].Entry.StatusAt) >= h.DevStatusInterval {
+			if err := h.PktStorage.enqueueMAC(appEUI, devEUI, lorawan.MACCommand{CID: lorawan.DevStatusReq}); err != nil {
+				h.abortConsume(err, bundles)
+				return
+			}
+			stats.MarkMeter("handler.downlink.dev_status")
+			statusReq = true
+		}
+		queued, err = h.PktStorage.peekMAC(appEUI, devEUI, maxFOptsLen-macLen(cmds))
+		if err != nil {
+			h.abortConsume(err, bundles)
+			return
+		}
+	}
+
+	// One of those bundle might be available for a response. Besides a downlink or an
+	// acknowledgement, pending MAC commands are enough of a reason to answer.
 	upType := lorawan.MType(bundles[0].Packet.(*core.DataUpHandlerReq).MType)
+	answer := best != nil && (downlink.Payload != nil || upType == lorawan.ConfirmedDataUp || len(cmds) > 0 || len(queued) > 0)
+	cmds = append(queued, cmds...)
 	for i, bundle := range bundles {
-		if best != nil && best.ID == i && (downlink.Payload != nil || upType == lorawan.ConfirmedDataUp) {
+		if answer && best.ID == i {
 			stats.MarkMeter("handler.downlink.pull")
 			downType := lorawan.UnconfirmedDataDown
 			ack := (upType == lorawan.ConfirmedDataUp)
 			if bundle.Packet.(*core.DataUpHandlerReq).FCntUpReset {
 				bundle.Entry.FCntDown = 0
 			}
-			downlink, err := h.buildDownlink(downlink.Payload, downType, ack, *bundle.Packet.(*core.DataUpHandlerReq), bundle.Entry, best.IsRX2)
+			if statusReq {
+				bundle.Entry.StatusAt = time.Now()
+			}
+			res, err := h.buildDownlink(downlink.Payload, downType, ack, *bundle.Packet.(*core.DataUpHandlerReq), bundle.Entry, best.IsRX2, cmds...)
 			if err != nil {
 				h.abortConsume(errors.New(errors.Structural, err), bundles)
 				return
 			}
+			for _, cmd := range cmds {
+				if adr, ok := cmd.Payload.(*lorawan.LinkADRReqPayload); ok {
+					stats.MarkMeter("handler.downlink.adr")
+					bundle.Entry.TxPower = adr.TXPower
+					bundle.Entry.LinkSNR = nil // Measured at former settings
+				}
+			}
 
-			bundle.Entry.FCntDown = downlink.Payload.MACPayload.FHDR.FCnt
+			bundle.Entry.FCntDown = res.Payload.MACPayload.FHDR.FCnt
 			bundle.Entry.FCntUp = bundle.Packet.(*core.DataUpHandlerReq).FCnt
-			err = h.DevStorage.upsert(bundle.Entry)
-			if err != nil {
+			if err := h.updateEntry(bundle.Entry); err != nil {
+				if downlink.Payload != nil { // Keep it for a next uplink
+					if err := h.PktStorage.requeue(downlink); err != nil {
+						h.Ctx.WithError(err).Warn("Unable to requeue downlink")
+					}
+				}
 				h.abortConsume(err, bundles)
 				return
 			}
-			bundle.Chresp <- downlink
+			if err := h.PktStorage.commitMAC(appEUI, devEUI, len(queued)); err != nil { // They'll be sent again
+				h.Ctx.WithError(err).Warn("Unable to remove sent MAC commands from the queue")
+			}
+			bundle.Chresp <- res
 		} else {
 			bundle.Chresp <- nil
 		}
 	}
 
 	// Then, if there was no downlink, we still update the Frame Counter Up in the storage
-	if best == nil || downlink.Payload == nil && upType != lorawan.ConfirmedDataUp {
+	if !answer {
 		bundles[0].Entry.FCntUp = bundles[0].Packet.(*core.DataUpHandlerReq).FCnt
-		if err := h.DevStorage.upsert(bundles[0].Entry); err != nil {
+		if err := h.updateEntry(bundles[0].Entry); err != nil {
 			h.Ctx.WithError(err).Debug("Unable to update Frame Counter Up")
 		}
 	}
@@ -672,11 +798,12 @@ func (h component) abortConsume(err error, bundles []bundle) {
 }
 
 // constructs a downlink packet from something we pulled from the gathered downlink, and, the actual
-// uplink.
-func (h component) buildDownlink(down []byte, mtype lorawan.MType, ack bool, up core.DataUpHandlerReq, entry devEntry, isRX2 bool) (*core.DataUpHandlerRes, error) {
+// uplink. MAC commands, if any, are piggybacked in the frame header.
+func (h component) buildDownlink(down []byte, mtype lorawan.MType, ack bool, up core.DataUpHandlerReq, entry devEntry, isRX2 bool, cmds ...lorawan.MACCommand) (*core.DataUpHandlerRes, error) {
 	macpayload := &lorawan.MACPayload{}
 	macpayload.FHDR = lorawan.FHDR{
-		FCnt: entry.FCntDown + 1,
+		FCnt:  entry.FCntDown + 1,
+		FOpts: cmds,
 	}
 	copy(macpayload.FHDR.DevAddr[:], entry.DevAddr)
 	macpayload.FPort = new(uint8)
@@ -713,6 +840,15 @@ func (h component) buildDownlink(down []byte, mtype lorawan.MType, ack bool, up
 		}
 	}
 
+	var fopts [][]byte
+	for _, cmd := range cmds {
+		opt, err := cmd.MarshalBinary()
+		if err != nil {
+			return nil, errors.New(errors.Structural, err)
+		}
+		fopts = append(fopts, opt)
+	}
+
 	metadata := h.buildMetadata(*up.Metadata, uint32(len(data)), 1000000*uint32(h.Configuration.RXDelay), isRX2)
 
 	return &core.DataUpHandlerRes{
@@ -731,6 +867,7 @@ func (h component) buildDownlink(down []byte, mtype lorawan.MType, ack bool, up
 						Ack:       macpayload.FHDR.FCtrl.ACK,
 						FPending:  macpayload.FHDR.FCtrl.FPending,
 					},
+					FOpts: fopts,
 				},
 				FPort:      uint32(*macpayload.FPort),
 				FRMPayload: frmpayload,
@@ -741,6 +878,44 @@ func (h component) buildDownlink(down []byte, mtype lorawan.MType, ack bool, up
 	}, nil
 }
 
+// maxUpdateAttempts bounds the number of times an uplink is applied again on a device entry
+// modified concurrently
+const maxUpdateAttempts = 3
+
+// updateEntry stores the frame counters and link state of a device after an uplink. If the entry
+// was modified meanwhile, for instance re-registered through the manager, the uplink is applied
+// again on top of the stored entry, unless the device got a new session.
+func (h component) updateEntry(entry devEntry) error {
+	for attempt := 1; ; attempt++ {
+		err := h.DevStorage.upsertIfVersion(entry, entry.Version)
+		if ferr, ok := err.(errors.Failure); !ok || ferr.Nature != errors.Behavioural || attempt == maxUpdateAttempts {
+			return err
+		}
+		stored, err := h.DevStorage.read(entry.AppEUI, entry.DevEUI)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(stored.DevAddr, entry.DevAddr) || stored.NwkSKey != entry.NwkSKey || stored.AppSKey != entry.AppSKey {
+			return errors.New(errors.Behavioural, "Device got a new session meanwhile")
+		}
+		stored.FCntUp, stored.FCntDown = entry.FCntUp, entry.FCntDown
+		stored.TxPower, stored.LinkSNR, stored.StatusAt = entry.TxPower, entry.LinkSNR, entry.StatusAt
+		entry = stored
+	}
+}
+
+// newAppNonce draws a random AppNonce, different from the one of the previous activation of the
+// device so that it never gets the same session keys twice
+func newAppNonce(previous [3]byte) [3]byte {
+	var appNonce [3]byte
+	for {
+		copy(appNonce[:], random.Bytes(3))
+		if appNonce != previous {
+			return appNonce
+		}
+	}
+}
+
 func (h component) buildJoinAccept(joinReq *core.JoinHandlerReq, appKey [16]byte, appNonce []byte, devAddr [4]byte, isRX2 bool) (*core.JoinHandlerRes, error) {
 	payload := &lorawan.PHYPayload{}
 	payload.MHDR = lorawan.MHDR{
@@ -795,7 +970,6 @@ func (h component) buildMetadata(metadata core.Metadata, size uint32, baseDelay
 	}
 
 	if isRX2 { // Should we reply on RX2, metadata aren't the same
-		// TODO Handle different regions with non hard-coded values
 		m.Frequency = h.Configuration.RX2Freq
 		m.DataRate = h.Configuration.RX2DataRate
 		m.Power = h.Configuration.PowerRX2
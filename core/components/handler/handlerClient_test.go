@@ -514,6 +514,141 @@ func TestUpsertABP(t *testing.T) {
 		Check(t, wantBrkCall, br.InUpsertABP.Req, "Broker Calls")
 		Check(t, wantRes, res, "Handler responses")
 	}
+
+	// --------------------
+
+	{
+		Desc(t, "Valid request | new device beyond quota")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		st := NewMockDevStorage()
+		st.Failures["reserve"] = ErrDeviceQuotaExceeded
+		h := New(
+			Components{
+				Ctx:        GetLogger(t, "Handler"),
+				Broker:     br,
+				DevStorage: st,
+			}, Options{
+				PublicNetAddr:          "NetAddr",
+				PrivateNetAddr:         "PrivNetAddr",
+				PrivateNetAddrAnnounce: "PrivateNetAddrAnnounce",
+				MaxDevicesPerApp:       2,
+			})
+		req := &core.UpsertABPHandlerReq{
+			Token:   "==OAuth==Token==",
+			AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevAddr: []byte{14, 14, 14, 14},
+			NwkSKey: []byte{1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4},
+			AppSKey: []byte{1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2},
+		}
+
+		// Expect
+		var wantErr = ErrBehavioural
+		var wantBrkCall *core.UpsertABPBrokerReq
+		var wantUpsert devEntry
+		var wantRes = new(core.UpsertABPHandlerRes)
+
+		// Operate
+		res, err := h.UpsertABP(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, ErrDeviceQuotaExceeded, err, "Errors")
+		Check(t, wantBrkCall, br.InUpsertABP.Req, "Broker Calls")
+		Check(t, wantUpsert, st.InUpsert.Entry, "Device Entries")
+		Check(t, wantRes, res, "Handler responses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Valid request | new device within quota")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		st := NewMockDevStorage()
+		h := New(
+			Components{
+				Ctx:        GetLogger(t, "Handler"),
+				Broker:     br,
+				DevStorage: st,
+			}, Options{
+				PublicNetAddr:          "NetAddr",
+				PrivateNetAddr:         "PrivNetAddr",
+				PrivateNetAddrAnnounce: "PrivateNetAddrAnnounce",
+				MaxDevicesPerApp:       2,
+			})
+		req := &core.UpsertABPHandlerReq{
+			Token:   "==OAuth==Token==",
+			AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevAddr: []byte{14, 14, 14, 14},
+			NwkSKey: []byte{1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4},
+			AppSKey: []byte{1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2},
+		}
+
+		// Expect
+		var wantErr *string
+		var wantDevEUI = []byte{0, 0, 0, 0, 14, 14, 14, 14}
+		var wantMaxDevices uint = 2
+		var wantRes = new(core.UpsertABPHandlerRes)
+
+		// Operate
+		res, err := h.UpsertABP(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDevEUI, st.InReserve.DevEUI, "Reserved devices")
+		Check(t, wantMaxDevices, st.InReserve.MaxDevices, "Quota")
+		Check(t, wantDevEUI, st.InRelease.DevEUI, "Released devices")
+		Check(t, req.DevAddr, st.InUpsert.Entry.DevAddr, "Device Entries")
+		Check(t, wantRes, res, "Handler responses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Invalid token | quota reached")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		br.Failures["ValidateToken"] = errors.New(errors.Structural, "Mock Error")
+		st := NewMockDevStorage()
+		st.Failures["reserve"] = ErrDeviceQuotaExceeded
+		h := New(
+			Components{
+				Ctx:        GetLogger(t, "Handler"),
+				Broker:     br,
+				DevStorage: st,
+			}, Options{
+				PublicNetAddr:          "NetAddr",
+				PrivateNetAddr:         "PrivNetAddr",
+				PrivateNetAddrAnnounce: "PrivateNetAddrAnnounce",
+				MaxDevicesPerApp:       1,
+			})
+		req := &core.UpsertABPHandlerReq{
+			Token:   "==OAuth==Token==",
+			AppEUI:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevAddr: []byte{14, 14, 14, 14},
+			NwkSKey: []byte{1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4, 1, 2, 3, 4},
+			AppSKey: []byte{1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2},
+		}
+
+		// Expect
+		var wantErr = ErrOperational
+		var wantReserve []byte
+		var wantBrkCall *core.UpsertABPBrokerReq
+		var wantRes = new(core.UpsertABPHandlerRes)
+
+		// Operate
+		res, err := h.UpsertABP(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantReserve, st.InReserve.DevEUI, "Reserved devices")
+		Check(t, wantBrkCall, br.InUpsertABP.Req, "Broker Calls")
+		Check(t, wantRes, res, "Handler responses")
+	}
 }
 
 func TestUpsertOTAA(t *testing.T) {
@@ -762,6 +897,97 @@ func TestUpsertOTAA(t *testing.T) {
 		Check(t, wantBrkCall, br.InValidateOTAA.Req, "Broker Calls")
 		Check(t, wantRes, res, "Handler responses")
 	}
+
+	// --------------------
+
+	{
+		Desc(t, "Valid request | new device beyond quota")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		st := NewMockDevStorage()
+		st.Failures["reserve"] = ErrDeviceQuotaExceeded
+		h := New(
+			Components{
+				Ctx:        GetLogger(t, "Handler"),
+				Broker:     br,
+				DevStorage: st,
+			}, Options{
+				PublicNetAddr:          "NetAddr",
+				PrivateNetAddr:         "PrivNetAddr",
+				PrivateNetAddrAnnounce: "PrivateNetAddrAnnounce",
+				MaxDevicesPerApp:       1,
+			})
+		req := &core.UpsertOTAAHandlerReq{
+			Token:  "==OAuth==Token==",
+			AppEUI: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevEUI: []byte{14, 14, 14, 14, 14, 14, 14, 14},
+			AppKey: []byte{1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2},
+		}
+
+		// Expect
+		var wantErr = ErrBehavioural
+		var wantBrkCall *core.ValidateOTAABrokerReq
+		var wantUpsert devEntry
+		var wantRes = new(core.UpsertOTAAHandlerRes)
+
+		// Operate
+		res, err := h.UpsertOTAA(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, ErrDeviceQuotaExceeded, err, "Errors")
+		Check(t, wantBrkCall, br.InValidateOTAA.Req, "Broker Calls")
+		Check(t, wantUpsert, st.InUpsert.Entry, "Device Entries")
+		Check(t, wantRes, res, "Handler responses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Valid request | new device within quota")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		st := NewMockDevStorage()
+		h := New(
+			Components{
+				Ctx:        GetLogger(t, "Handler"),
+				Broker:     br,
+				DevStorage: st,
+			}, Options{
+				PublicNetAddr:          "NetAddr",
+				PrivateNetAddr:         "PrivNetAddr",
+				PrivateNetAddrAnnounce: "PrivateNetAddrAnnounce",
+				MaxDevicesPerApp:       2,
+			})
+		req := &core.UpsertOTAAHandlerReq{
+			Token:  "==OAuth==Token==",
+			AppEUI: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DevEUI: []byte{14, 14, 14, 14, 14, 14, 14, 14},
+			AppKey: []byte{1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2, 1, 2},
+		}
+
+		// Expect
+		var wantErr *string
+		var wantBrkCall = &core.ValidateOTAABrokerReq{
+			Token:      req.Token,
+			AppEUI:     req.AppEUI,
+			NetAddress: h.(*component).PrivateNetAddrAnnounce,
+		}
+		var wantRes = new(core.UpsertOTAAHandlerRes)
+
+		// Operate
+		res, err := h.UpsertOTAA(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantBrkCall, br.InValidateOTAA.Req, "Broker Calls")
+		Check(t, req.DevEUI, st.InReserve.DevEUI, "Reserved devices")
+		Check(t, req.DevEUI, st.InRelease.DevEUI, "Released devices")
+		Check(t, req.DevEUI, st.InUpsert.Entry.DevEUI, "Device Entries")
+		Check(t, wantRes, res, "Handler responses")
+	}
 }
 
 func TestGetDefault(t *testing.T) {
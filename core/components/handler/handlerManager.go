@@ -10,9 +10,15 @@ import (
 	"github.com/TheThingsNetwork/ttn/core/adapters/fields"
 	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"github.com/TheThingsNetwork/ttn/utils/stats"
+	"github.com/brocaar/lorawan"
 	"golang.org/x/net/context"
 )
 
+// ErrDeviceQuotaExceeded is returned when registering a new device would exceed the maximum
+// number of devices allowed for its application
+var ErrDeviceQuotaExceeded = errors.New(errors.Behavioural, "Device quota exceeded")
+
 func (h component) ListDevices(bctx context.Context, req *core.ListDevicesHandlerReq) (*core.ListDevicesHandlerRes, error) {
 	h.Ctx.Debug("Handle list devices request")
 
@@ -76,7 +82,21 @@ func (h component) UpsertABP(bctx context.Context, req *core.UpsertABPHandlerReq
 		return new(core.UpsertABPHandlerRes), err
 	}
 
-	// 2. Forward to the broker first -> The Broker also does the token verification
+	// 2. Validate the token, before telling anything about the application devices
+	if _, err := h.Broker.ValidateToken(context.Background(), &core.ValidateTokenBrokerReq{AppEUI: req.AppEUI, Token: req.Token}); err != nil {
+		h.Ctx.WithError(err).Debug("Unable to handle ABP request")
+		return new(core.UpsertABPHandlerRes), errors.New(errors.Operational, err)
+	}
+
+	// 3. Make room for a new device in the application quota, before involving the broker
+	devEUI := append([]byte{0, 0, 0, 0}, req.DevAddr...)
+	if err := h.reserveDevice(req.AppEUI, devEUI); err != nil {
+		h.Ctx.WithError(err).Debug("Unable to handle ABP request")
+		return new(core.UpsertABPHandlerRes), err
+	}
+	defer h.DevStorage.release(req.AppEUI, devEUI)
+
+	// 4. Forward to the broker -> The Broker also does the token verification
 	_, err := h.Broker.UpsertABP(context.Background(), &core.UpsertABPBrokerReq{
 		Token:      req.Token,
 		AppEUI:     req.AppEUI,
@@ -90,11 +110,11 @@ func (h component) UpsertABP(bctx context.Context, req *core.UpsertABPHandlerReq
 		return new(core.UpsertABPHandlerRes), errors.New(errors.Operational, err)
 	}
 
-	// 3. Save the device in the storage
+	// 5. Save the device in the storage
 	h.Ctx.WithField("AppEUI", req.AppEUI).WithField("DevAddr", req.DevAddr).Debug("Request accepted by broker. Registering device")
 	entry := devEntry{
 		AppEUI:   req.AppEUI,
-		DevEUI:   append([]byte{0, 0, 0, 0}, req.DevAddr...),
+		DevEUI:   devEUI,
 		DevAddr:  req.DevAddr,
 		FCntDown: 0,
 		FCntUp:   0,
@@ -121,7 +141,20 @@ func (h component) UpsertOTAA(bctx context.Context, req *core.UpsertOTAAHandlerR
 		return new(core.UpsertOTAAHandlerRes), err
 	}
 
-	// 2. Notify the broker -> The Broker also does the token verification
+	// 2. Validate the token, before telling anything about the application devices
+	if _, err := h.Broker.ValidateToken(context.Background(), &core.ValidateTokenBrokerReq{AppEUI: req.AppEUI, Token: req.Token}); err != nil {
+		h.Ctx.WithError(err).Debug("Unable to handle OTAA request")
+		return new(core.UpsertOTAAHandlerRes), errors.New(errors.Operational, err)
+	}
+
+	// 3. Make room for a new device in the application quota, before involving the broker
+	if err := h.reserveDevice(req.AppEUI, req.DevEUI); err != nil {
+		h.Ctx.WithError(err).Debug("Unable to handle OTAA request")
+		return new(core.UpsertOTAAHandlerRes), err
+	}
+	defer h.DevStorage.release(req.AppEUI, req.DevEUI)
+
+	// 4. Notify the broker -> The Broker also does the token verification
 	_, err := h.Broker.ValidateOTAA(context.Background(), &core.ValidateOTAABrokerReq{
 		Token:      req.Token,
 		NetAddress: h.PrivateNetAddrAnnounce,
@@ -132,7 +165,7 @@ func (h component) UpsertOTAA(bctx context.Context, req *core.UpsertOTAAHandlerR
 		return new(core.UpsertOTAAHandlerRes), errors.New(errors.Operational, err)
 	}
 
-	// 3. Save the device in the storage
+	// 5. Save the device in the storage
 	h.Ctx.WithField("AppEUI", req.AppEUI).WithField("DevEUI", req.DevEUI).Debug("Request accepted by broker. Registering device")
 	var appKey [16]byte
 	copy(appKey[:], req.AppKey)
@@ -143,12 +176,73 @@ func (h component) UpsertOTAA(bctx context.Context, req *core.UpsertOTAAHandlerR
 	})
 	if err != nil {
 		h.Ctx.WithError(err).Debug("Error while trying to handle valid request")
-		return new(core.UpsertOTAAHandlerRes), err
+		return new(core.UpsertOTAAHandlerRes), errors.New(errors.Operational, err)
 	}
 
 	return new(core.UpsertOTAAHandlerRes), nil
 }
 
+// EnqueueMAC queues a MAC command for the given device. It is piggybacked on the next downlink to
+// the device, after the ones already queued, as soon as there's room left in a frame header.
+func (h component) EnqueueMAC(appEUI types.AppEUI, devEUI types.DevEUI, cmd lorawan.MACCommand) error {
+	ctx := h.Ctx.WithField("AppEUI", appEUI).WithField("DevEUI", devEUI)
+	if _, err := h.DevStorage.read(appEUI[:], devEUI[:]); err != nil {
+		ctx.WithError(err).Debug("Unable to queue MAC command for unknown device")
+		return err
+	}
+	if err := h.PktStorage.enqueueMAC(appEUI[:], devEUI[:], cmd); err != nil {
+		ctx.WithError(err).Debug("Unable to queue MAC command")
+		return err
+	}
+	return nil
+}
+
+// DeleteDevices removes all devices of an application, when it is offboarded, along with the
+// packets and MAC commands queued for them, and gives the number of devices removed. The default
+// device settings are kept. The broker keeps its own devices, see broker.DeleteDevices.
+func (h component) DeleteDevices(appEUI types.AppEUI) (int, error) {
+	ctx := h.Ctx.WithField("AppEUI", appEUI)
+	entries, err := h.DevStorage.readAll(appEUI[:])
+	if err != nil {
+		if err.(errors.Failure).Nature == errors.NotFound {
+			return 0, nil
+		}
+		ctx.WithError(err).Debug("Unable to list devices to delete")
+		return 0, err
+	}
+
+	n, err := h.DevStorage.deleteAll(appEUI[:])
+	if err != nil {
+		ctx.WithError(err).Debug("Unable to delete devices")
+		return n, err
+	}
+	for _, entry := range entries {
+		if entry.DevEUI == nil { // The default device shares the bucket and has no DevEUI
+			continue
+		}
+		if err := h.PktStorage.purge(appEUI[:], entry.DevEUI); err != nil {
+			ctx.WithError(err).WithField("DevEUI", entry.DevEUI).Warn("Unable to purge queues of deleted device")
+			return n, err
+		}
+	}
+	ctx.WithField("Deleted", n).Info("Deleted devices of application")
+	return n, nil
+}
+
+// reserveDevice makes room for the given device in the quota of its application until the slot is
+// released, see DevStorage.reserve. Existing devices can always be updated.
+func (h component) reserveDevice(appEUI []byte, devEUI []byte) error {
+	err := h.DevStorage.reserve(appEUI, devEUI, h.MaxDevicesPerApp)
+	if err == ErrDeviceQuotaExceeded {
+		stats.MarkMeter("handler.devices.quota_exceeded")
+		return err
+	}
+	if err != nil {
+		return errors.New(errors.Operational, err)
+	}
+	return nil
+}
+
 func (h component) GetDefaultDevice(bctx context.Context, req *core.GetDefaultDeviceReq) (*core.GetDefaultDeviceRes, error) {
 	h.Ctx.Debug("Handle get default device request")
 
@@ -11,10 +11,12 @@ import (
 	"github.com/TheThingsNetwork/ttn/core"
 	"github.com/TheThingsNetwork/ttn/core/dutycycle"
 	"github.com/TheThingsNetwork/ttn/core/mocks"
+	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
 	. "github.com/TheThingsNetwork/ttn/utils/testing"
 	"github.com/brocaar/lorawan"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 func TestHandleDataDown(t *testing.T) {
@@ -205,6 +207,68 @@ func TestHandleDataDown(t *testing.T) {
 		Check(t, wantRes, res, "Data Down Handler Responses")
 		Check(t, wantEntry, pktStorage.InEnqueue.Entry, "Packet Entries")
 	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle valid downlink | de-duplication enabled")
+
+		// Build
+		devStorage := NewMockDevStorage()
+		pktStorage := NewMockPktStorage()
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		req := &core.DataDownHandlerReq{
+			AppEUI:  []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			Payload: []byte("TheThingsNetwork"),
+			TTL:     "2h",
+		}
+
+		// Expect
+		var wantError *string
+		var wantRes = new(core.DataDownHandlerRes)
+		var wantEntry = pktEntry{Payload: req.Payload}
+		var wantEnqueue pktEntry
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{
+			PublicNetAddr:  "localhost",
+			PrivateNetAddr: "localhost",
+			DedupDownlinks: []types.AppEUI{{1, 1, 1, 1, 1, 1, 1, 1}},
+		})
+		res, err := handler.HandleDataDown(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantError, err)
+		Check(t, wantRes, res, "Data Down Handler Responses")
+		Check(t, wantEntry.Payload, pktStorage.InEnqueueUnique.Entry.Payload, "Packet Entries")
+		Check(t, wantEnqueue, pktStorage.InEnqueue.Entry, "Packet Entries")
+	}
+}
+
+// conflictingDevStorage simulates a device modified through the manager while an uplink is
+// handled: the first versioned writes fail and the stored entry becomes the updated one
+type conflictingDevStorage struct {
+	*MockDevStorage
+	Conflicts int
+	Updated   devEntry
+}
+
+// upsertIfVersion implements the DevStorage interface
+func (m *conflictingDevStorage) upsertIfVersion(entry devEntry, version uint64) error {
+	if m.Conflicts > 0 {
+		m.Conflicts--
+		m.OutRead.Entry = m.Updated
+		return errors.New(errors.Behavioural, "Mock Error")
+	}
+	return m.MockDevStorage.upsertIfVersion(entry, version)
 }
 
 func TestHandleDataUp(t *testing.T) {
@@ -247,7 +311,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -290,7 +354,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -333,7 +397,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -376,7 +440,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -419,7 +483,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -487,7 +551,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -599,7 +663,148 @@ func TestHandleDataUp(t *testing.T) {
 		ok1, ok2 := <-chack, <-chack
 		Check(t, true, ok1 && ok2, "Acknowledgements")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "3 packets in a row, same device, different SNR | No Downlink")
+
+		// Build
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+		}
+		pktStorage := NewMockPktStorage()
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req1 := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate: "SF7BW125",
+				DutyRX1:  uint32(dutycycle.StateWarning),
+				DutyRX2:  uint32(dutycycle.StateWarning),
+				Rssi:     -20,
+				Lsnr:     2.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  10,
+			MType:  uint32(lorawan.UnconfirmedDataUp),
+		}
+		req2 := &core.DataUpHandlerReq{
+			Payload: req1.Payload,
+			Metadata: &core.Metadata{
+				DataRate: "SF7BW125",
+				DutyRX1:  uint32(dutycycle.StateAvailable),
+				DutyRX2:  uint32(dutycycle.StateAvailable),
+				Rssi:     -20,
+				Lsnr:     9.0,
+			},
+			AppEUI: req1.AppEUI,
+			DevEUI: req1.DevEUI,
+			FCnt:   req1.FCnt,
+			FPort:  req1.FPort,
+			MType:  req1.MType,
+		}
+		req3 := &core.DataUpHandlerReq{
+			Payload: req1.Payload,
+			Metadata: &core.Metadata{
+				DataRate: "SF7BW125",
+				DutyRX1:  uint32(dutycycle.StateAvailable),
+				DutyRX2:  uint32(dutycycle.StateAvailable),
+				Rssi:     -20,
+				Lsnr:     5.0,
+			},
+			AppEUI: req1.AppEUI,
+			DevEUI: req1.DevEUI,
+			FCnt:   req1.FCnt,
+			FPort:  req1.FPort,
+			MType:  req1.MType,
+		}
+
+		// Expect
+		var wantErr1 *string
+		var wantErr2 *string
+		var wantErr3 *string
+		var wantRes1 = new(core.DataUpHandlerRes)
+		var wantRes2 = new(core.DataUpHandlerRes)
+		var wantRes3 = new(core.DataUpHandlerRes)
+		var wantData = &core.DataAppReq{
+			Payload:  payload,
+			Metadata: []*core.Metadata{req2.Metadata, req3.Metadata, req1.Metadata},
+			AppEUI:   req1.AppEUI,
+			DevEUI:   req1.DevEUI,
+			FPort:    10,
+			FCnt:     14,
+		}
+		var wantFCnt = devStorage.OutRead.Entry.FCntDown
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+
+		chack := make(chan bool)
+		go func() {
+			var ok bool
+			defer func(ok *bool) { chack <- *ok }(&ok)
+			res, err := handler.HandleDataUp(context.Background(), req1)
+
+			// Check
+			CheckErrors(t, wantErr1, err)
+			Check(t, wantRes1, res, "Data Up Handler Responses")
+			ok = true
+		}()
+
+		go func() {
+			<-time.After(time.Millisecond * 50)
+			var ok bool
+			defer func(ok *bool) { chack <- *ok }(&ok)
+			res, err := handler.HandleDataUp(context.Background(), req2)
+
+			// Check
+			CheckErrors(t, wantErr2, err)
+			Check(t, wantRes2, res, "Data Up Handler Responses")
+			ok = true
+		}()
+
+		go func() {
+			<-time.After(time.Millisecond * 100)
+			var ok bool
+			defer func(ok *bool) { chack <- *ok }(&ok)
+			res, err := handler.HandleDataUp(context.Background(), req3)
+
+			// Check
+			CheckErrors(t, wantErr3, err)
+			Check(t, wantRes3, res, "Data Up Handler Responses")
+			ok = true
+		}()
+
+		// Check
+		ok1, ok2, ok3 := <-chack, <-chack, <-chack
+		Check(t, true, ok1 && ok2 && ok3, "Acknowledgements")
+		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -710,7 +915,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -819,7 +1024,7 @@ func TestHandleDataUp(t *testing.T) {
 	// 	ok1, ok2 := <-chack, <-chack
 	// 	Check(t, true, ok1 && ok2, "Acknowledgements")
 	// 	Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-	// 	Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+	// 	Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	// }
 
 	// --------------------
@@ -888,7 +1093,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -957,7 +1162,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -1066,7 +1271,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr1, err1)
 		Check(t, wantRes1, res1, "Data Up Handler Responses")
 		Check(t, wantData1, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt1, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt1, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 
 		// Operate
 		devStorage.OutRead.Entry = devEntry{
@@ -1081,7 +1286,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr2, err2)
 		Check(t, wantRes2, res2, "Data Up Handler Responses")
 		Check(t, wantData2, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt2, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt2, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -1192,13 +1397,13 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
 
 	{
-		Desc(t, "Handle uplink, 1 packet | one downlink ready | Update FCnt fails")
+		Desc(t, "Handle uplink, 1 packet | one downlink ready | Device forces RX2")
 
 		// Build
 		tmst := time.Now()
@@ -1209,8 +1414,8 @@ func TestHandleDataUp(t *testing.T) {
 			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
 			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
 			FCntDown: 3,
+			Flags:    core.ForceRX2,
 		}
-		devStorage.Failures["upsert"] = errors.New(errors.Operational, "Mock Error")
 		pktStorage := NewMockPktStorage()
 		pktStorage.OutDequeue.Entry.Payload = []byte("Downlink")
 		appAdapter := mocks.NewAppClient()
@@ -1231,7 +1436,7 @@ func TestHandleDataUp(t *testing.T) {
 				Frequency:  865.5,
 				Timestamp:  uint32(tmst.Unix() * 1000000),
 				CodingRate: "4/5",
-				DutyRX1:    uint32(dutycycle.StateBlocked),
+				DutyRX1:    uint32(dutycycle.StateHighlyAvailable),
 				DutyRX2:    uint32(dutycycle.StateAvailable),
 				Rssi:       -20,
 				Lsnr:       5.0,
@@ -1244,8 +1449,42 @@ func TestHandleDataUp(t *testing.T) {
 		}
 
 		// Expect
-		var wantErr = ErrOperational
-		var wantRes = new(core.DataUpHandlerRes)
+		var wantErr *string
+		encodedDown, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			false,
+			devAddr,
+			devStorage.OutRead.Entry.FCntDown+1,
+			pktStorage.OutDequeue.Entry.Payload,
+		)
+		FatalUnless(t, err)
+		var wantRes = &core.DataUpHandlerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
+						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      uint32(1),
+					FRMPayload: encodedDown,
+				},
+				MIC: []byte{0, 0, 0, 0},
+			},
+			Metadata: &core.Metadata{
+				DataRate:    "SF9BW125",
+				Frequency:   869.525,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(2*time.Second).Unix() * 1000000),
+				PayloadSize: 21,
+				Power:       27,
+				InvPolarity: true,
+			},
+		}
 		var wantData = &core.DataAppReq{
 			Payload:  payload,
 			Metadata: []*core.Metadata{req.Metadata},
@@ -1254,7 +1493,7 @@ func TestHandleDataUp(t *testing.T) {
 			FPort:    1,
 			FCnt:     14,
 		}
-		var wantFCnt = devStorage.OutRead.Entry.FCntDown + 1
+		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
 
 		// Operate
 		handler := New(Components{
@@ -1270,13 +1509,13 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
 
 	{
-		Desc(t, "Handle confirmed uplink, 1 packet | one downlink ready")
+		Desc(t, "Handle uplink, 1 packet | one downlink ready | Update FCnt fails")
 
 		// Build
 		tmst := time.Now()
@@ -1288,7 +1527,9 @@ func TestHandleDataUp(t *testing.T) {
 			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
 			FCntDown: 3,
 		}
+		devStorage.Failures["upsertIfVersion"] = errors.New(errors.Operational, "Mock Error")
 		pktStorage := NewMockPktStorage()
+		pktStorage.OutPeekMAC.Commands = []lorawan.MACCommand{{CID: lorawan.DevStatusReq}}
 		pktStorage.OutDequeue.Entry.Payload = []byte("Downlink")
 		appAdapter := mocks.NewAppClient()
 		broker := mocks.NewAuthBrokerClient()
@@ -1308,7 +1549,7 @@ func TestHandleDataUp(t *testing.T) {
 				Frequency:  865.5,
 				Timestamp:  uint32(tmst.Unix() * 1000000),
 				CodingRate: "4/5",
-				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX1:    uint32(dutycycle.StateBlocked),
 				DutyRX2:    uint32(dutycycle.StateAvailable),
 				Rssi:       -20,
 				Lsnr:       5.0,
@@ -1317,48 +1558,292 @@ func TestHandleDataUp(t *testing.T) {
 			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
 			FCnt:   fcnt,
 			FPort:  1,
-			MType:  uint32(lorawan.ConfirmedDataUp),
+			MType:  uint32(lorawan.UnconfirmedDataUp),
 		}
 
 		// Expect
-		var wantErr *string
-		encodedDown, err := lorawan.EncryptFRMPayload(
-			devStorage.OutRead.Entry.AppSKey,
-			false,
-			devAddr,
-			devStorage.OutRead.Entry.FCntDown+1,
-			pktStorage.OutDequeue.Entry.Payload,
-		)
-		FatalUnless(t, err)
-		var wantRes = &core.DataUpHandlerRes{
-			Payload: &core.LoRaWANData{
-				MHDR: &core.LoRaWANMHDR{
-					MType: uint32(lorawan.UnconfirmedDataDown),
-					Major: uint32(lorawan.LoRaWANR1),
-				},
-				MACPayload: &core.LoRaWANMACPayload{
-					FHDR: &core.LoRaWANFHDR{
-						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
-						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
-						FCtrl: &core.LoRaWANFCtrl{
-							Ack: true,
-						},
-					},
-					FPort:      uint32(1),
-					FRMPayload: encodedDown,
-				},
-				MIC: []byte{0, 0, 0, 0},
-			},
-			Metadata: &core.Metadata{
-				DataRate:    "SF7BW125",
-				Frequency:   865.5,
-				CodingRate:  "4/5",
-				Timestamp:   uint32(tmst.Add(time.Second).Unix() * 1000000),
-				PayloadSize: 21,
-				Power:       14,
-				InvPolarity: true,
-			},
-		}
+		var wantErr = ErrOperational
+		var wantRes = new(core.DataUpHandlerRes)
+		var wantData = &core.DataAppReq{
+			Payload:  payload,
+			Metadata: []*core.Metadata{req.Metadata},
+			AppEUI:   req.AppEUI,
+			DevEUI:   req.DevEUI,
+			FPort:    1,
+			FCnt:     14,
+		}
+		var wantFCnt = devStorage.OutRead.Entry.FCntDown + 1
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+		Check(t, pktStorage.OutDequeue.Entry, pktStorage.InRequeue.Entry, "Requeued downlinks")
+		Check(t, 0, pktStorage.InCommitMAC.N, "Committed MAC commands")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle uplink, 1 packet | one downlink ready | Device updated meanwhile")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+			Version:  7,
+		}
+		devStorage.Failures["upsertIfVersion"] = errors.New(errors.Behavioural, "Mock Error")
+		pktStorage := NewMockPktStorage()
+		pktStorage.OutDequeue.Entry.Payload = []byte("Downlink")
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateBlocked),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.UnconfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr = ErrBehavioural
+		var wantRes = new(core.DataUpHandlerRes)
+		var wantData = &core.DataAppReq{
+			Payload:  payload,
+			Metadata: []*core.Metadata{req.Metadata},
+			AppEUI:   req.AppEUI,
+			DevEUI:   req.DevEUI,
+			FPort:    1,
+			FCnt:     14,
+		}
+		var wantVersion uint64 = 7
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
+		Check(t, wantVersion, devStorage.InUpsertIfVersion.Version, "Device versions")
+		Check(t, pktStorage.OutDequeue.Entry, pktStorage.InRequeue.Entry, "Requeued downlinks")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle uplink, 1 packet | one downlink ready | Device re-registered meanwhile")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := &conflictingDevStorage{MockDevStorage: NewMockDevStorage(), Conflicts: 1}
+		devStorage.OutRead.Entry = devEntry{
+			AppEUI:   []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:   []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+			Version:  7,
+		}
+		devStorage.Updated = devStorage.OutRead.Entry
+		devStorage.Updated.Flags = core.ForceRX2
+		devStorage.Updated.Version = 8
+		pktStorage := NewMockPktStorage()
+		pktStorage.OutDequeue.Entry = pktEntry{
+			AppEUI:  devStorage.OutRead.Entry.AppEUI,
+			DevEUI:  devStorage.OutRead.Entry.DevEUI,
+			Payload: []byte("Downlink"),
+		}
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateBlocked),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+			AppEUI: devStorage.OutRead.Entry.AppEUI,
+			DevEUI: devStorage.OutRead.Entry.DevEUI,
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.UnconfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantFlags = devStorage.Updated.Flags
+		var wantFCntDown uint32 = 4
+		var wantFCntUp = fcnt
+		var wantVersion uint64 = 8
+		var wantRequeued pktEntry
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantFCntDown, res.Payload.MACPayload.FHDR.FCnt, "Downlink frame counters")
+		Check(t, wantFCntDown, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters down")
+		Check(t, wantFCntUp, devStorage.InUpsertIfVersion.Entry.FCntUp, "Frame counters up")
+		Check(t, wantFlags, devStorage.InUpsertIfVersion.Entry.Flags, "Device flags")
+		Check(t, wantVersion, devStorage.InUpsertIfVersion.Version, "Device versions")
+		Check(t, wantRequeued, pktStorage.InRequeue.Entry, "Requeued downlinks")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle confirmed uplink, 1 packet | one downlink ready")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+		}
+		pktStorage := NewMockPktStorage()
+		pktStorage.OutDequeue.Entry.Payload = []byte("Downlink")
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.ConfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr *string
+		encodedDown, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			false,
+			devAddr,
+			devStorage.OutRead.Entry.FCntDown+1,
+			pktStorage.OutDequeue.Entry.Payload,
+		)
+		FatalUnless(t, err)
+		var wantRes = &core.DataUpHandlerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
+						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
+						FCtrl: &core.LoRaWANFCtrl{
+							Ack: true,
+						},
+					},
+					FPort:      uint32(1),
+					FRMPayload: encodedDown,
+				},
+				MIC: []byte{0, 0, 0, 0},
+			},
+			Metadata: &core.Metadata{
+				DataRate:    "SF7BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(time.Second).Unix() * 1000000),
+				PayloadSize: 21,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
 		var wantData = &core.DataAppReq{
 			Payload:  payload,
 			Metadata: []*core.Metadata{req.Metadata},
@@ -1383,7 +1868,7 @@ func TestHandleDataUp(t *testing.T) {
 		CheckErrors(t, wantErr, err)
 		Check(t, wantRes, res, "Data Up Handler Responses")
 		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
 	}
 
 	// --------------------
@@ -1472,7 +1957,865 @@ func TestHandleDataUp(t *testing.T) {
 			FPort:    1,
 			FCnt:     14,
 		}
-		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
+		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle confirmed uplink, 1 packet | ADR enabled, enough link margin")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+			Flags:    core.EnableADR,
+			LinkSNR:  make([]float32, adrHistorySize-1),
+		}
+		pktStorage := NewMockPktStorage()
+		pktStorage.Failures["dequeue"] = errors.New(errors.NotFound, "Mock Error")
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF8BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       10.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.ConfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantRes = &core.DataUpHandlerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
+						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
+						FCtrl: &core.LoRaWANFCtrl{
+							Ack: true,
+						},
+						FOpts: [][]byte{
+							{0x03, 0x50, 0xff, 0x00, 0x01}, // LinkADRReq: SF7BW125, max power, 8 channels
+						},
+					},
+					FPort:      uint32(1),
+					FRMPayload: nil,
+				},
+				MIC: []byte{0, 0, 0, 0},
+			},
+			Metadata: &core.Metadata{
+				DataRate:    "SF8BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(time.Second).Unix() * 1000000),
+				PayloadSize: 18,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
+		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
+		var wantLinkSNR []float32
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+		Check(t, wantLinkSNR, devStorage.InUpsertIfVersion.Entry.LinkSNR, "Link SNR history")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle unconfirmed uplink, 1 packet | ADR enabled, enough link margin, no downlink")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+			Flags:    core.EnableADR,
+			LinkSNR:  make([]float32, adrHistorySize-1),
+		}
+		pktStorage := NewMockPktStorage()
+		pktStorage.Failures["dequeue"] = errors.New(errors.NotFound, "Mock Error")
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF8BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       10.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.UnconfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantRes = &core.DataUpHandlerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
+						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
+						FCtrl:   new(core.LoRaWANFCtrl),
+						FOpts: [][]byte{
+							{0x03, 0x50, 0xff, 0x00, 0x01}, // LinkADRReq: SF7BW125, max power, 8 channels
+						},
+					},
+					FPort:      uint32(1),
+					FRMPayload: nil,
+				},
+				MIC: []byte{0, 0, 0, 0},
+			},
+			Metadata: &core.Metadata{
+				DataRate:    "SF8BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(time.Second).Unix() * 1000000),
+				PayloadSize: 18,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
+		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
+		var wantLinkSNR []float32
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+		Check(t, wantLinkSNR, devStorage.InUpsertIfVersion.Entry.LinkSNR, "Link SNR history")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle confirmed uplink, 1 packet | MAC commands queued")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+		}
+		pktStorage := NewMockPktStorage()
+		pktStorage.Failures["dequeue"] = errors.New(errors.NotFound, "Mock Error")
+		pktStorage.OutPeekMAC.Commands = []lorawan.MACCommand{{CID: lorawan.DevStatusReq}}
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.ConfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantRes = &core.DataUpHandlerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
+						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
+						FCtrl: &core.LoRaWANFCtrl{
+							Ack: true,
+						},
+						FOpts: [][]byte{
+							{0x06}, // DevStatusReq
+						},
+					},
+					FPort:      uint32(1),
+					FRMPayload: nil,
+				},
+				MIC: []byte{0, 0, 0, 0},
+			},
+			Metadata: &core.Metadata{
+				DataRate:    "SF7BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(time.Second).Unix() * 1000000),
+				PayloadSize: 14,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
+		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
+		var wantMaxLen = maxFOptsLen
+		var wantCommitted = 1
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+		Check(t, wantMaxLen, pktStorage.InPeekMAC.MaxLen, "MAC commands length")
+		Check(t, wantCommitted, pktStorage.InCommitMAC.N, "Committed MAC commands")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle confirmed uplink, 1 packet | device status due")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+		}
+		pktStorage := NewMockPktStorage()
+		pktStorage.Failures["dequeue"] = errors.New(errors.NotFound, "Mock Error")
+		pktStorage.OutPeekMAC.Commands = []lorawan.MACCommand{{CID: lorawan.DevStatusReq}} // As just queued
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.ConfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantRes = &core.DataUpHandlerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
+						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
+						FCtrl: &core.LoRaWANFCtrl{
+							Ack: true,
+						},
+						FOpts: [][]byte{
+							{0x06}, // DevStatusReq
+						},
+					},
+					FPort:      uint32(1),
+					FRMPayload: nil,
+				},
+				MIC: []byte{0, 0, 0, 0},
+			},
+			Metadata: &core.Metadata{
+				DataRate:    "SF7BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(time.Second).Unix() * 1000000),
+				PayloadSize: 14,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
+		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
+		var wantQueued = lorawan.MACCommand{CID: lorawan.DevStatusReq}
+		var wantCommitted = 1
+		var wantStatusAt = true
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", DevStatusInterval: time.Hour})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+		Check(t, wantQueued, pktStorage.InEnqueueMAC.Command, "Queued MAC commands")
+		Check(t, wantCommitted, pktStorage.InCommitMAC.N, "Committed MAC commands")
+		Check(t, wantStatusAt, time.Since(devStorage.InUpsertIfVersion.Entry.StatusAt) < time.Minute, "Device status requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle unconfirmed uplink, 1 packet | device status due, no downlink")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+		}
+		pktStorage := NewMockPktStorage()
+		pktStorage.Failures["dequeue"] = errors.New(errors.NotFound, "Mock Error")
+		pktStorage.OutPeekMAC.Commands = []lorawan.MACCommand{{CID: lorawan.DevStatusReq}} // As just queued
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.UnconfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantRes = &core.DataUpHandlerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
+						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
+						FCtrl:   new(core.LoRaWANFCtrl),
+						FOpts: [][]byte{
+							{0x06}, // DevStatusReq
+						},
+					},
+					FPort:      uint32(1),
+					FRMPayload: nil,
+				},
+				MIC: []byte{0, 0, 0, 0},
+			},
+			Metadata: &core.Metadata{
+				DataRate:    "SF7BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(time.Second).Unix() * 1000000),
+				PayloadSize: 14,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
+		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
+		var wantQueued = lorawan.MACCommand{CID: lorawan.DevStatusReq}
+		var wantCommitted = 1
+		var wantStatusAt = true
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", DevStatusInterval: time.Hour})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+		Check(t, wantQueued, pktStorage.InEnqueueMAC.Command, "Queued MAC commands")
+		Check(t, wantCommitted, pktStorage.InCommitMAC.N, "Committed MAC commands")
+		Check(t, wantStatusAt, time.Since(devStorage.InUpsertIfVersion.Entry.StatusAt) < time.Minute, "Device status requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle confirmed uplink, 1 packet | device status not due yet")
+
+		// Build
+		tmst := time.Now()
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+			StatusAt: time.Now().Add(-30 * time.Minute),
+		}
+		pktStorage := NewMockPktStorage()
+		pktStorage.Failures["dequeue"] = errors.New(errors.NotFound, "Mock Error")
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		req := &core.DataUpHandlerReq{
+			Payload: encoded,
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			FCnt:   fcnt,
+			FPort:  1,
+			MType:  uint32(lorawan.ConfirmedDataUp),
+		}
+
+		// Expect
+		var wantErr *string
+		var wantRes = &core.DataUpHandlerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: devStorage.OutRead.Entry.DevAddr[:],
+						FCnt:    devStorage.OutRead.Entry.FCntDown + 1,
+						FCtrl: &core.LoRaWANFCtrl{
+							Ack: true,
+						},
+					},
+					FPort:      uint32(1),
+					FRMPayload: nil,
+				},
+				MIC: []byte{0, 0, 0, 0},
+			},
+			Metadata: &core.Metadata{
+				DataRate:    "SF7BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(time.Second).Unix() * 1000000),
+				PayloadSize: 13,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
+		var wantFCnt = wantRes.Payload.MACPayload.FHDR.FCnt
+		var wantMaxLen = maxFOptsLen
+		var wantQueued lorawan.MACCommand
+		var wantStatusAt = devStorage.OutRead.Entry.StatusAt
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", DevStatusInterval: time.Hour})
+		res, err := handler.HandleDataUp(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Data Up Handler Responses")
+		Check(t, wantFCnt, devStorage.InUpsertIfVersion.Entry.FCntDown, "Frame counters")
+		Check(t, wantMaxLen, pktStorage.InPeekMAC.MaxLen, "MAC commands length")
+		Check(t, wantQueued, pktStorage.InEnqueueMAC.Command, "Queued MAC commands")
+		Check(t, wantStatusAt, devStorage.InUpsertIfVersion.Entry.StatusAt, "Device status requests")
+	}
+
+}
+
+func TestHandleJoin(t *testing.T) {
+	{
+		Desc(t, "Handle valid join-request | get join-accept")
+
+		// Build
+		tmst := time.Now()
+
+		req := &core.JoinHandlerReq{
+			AppEUI:   []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:   []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevNonce: []byte{14, 42},
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+		}
+
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			AppKey: &[16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			AppEUI: req.AppEUI,
+			DevEUI: req.DevEUI,
+		}
+		pktStorage := NewMockPktStorage()
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+
+		payload := &lorawan.PHYPayload{}
+		payload.MHDR = lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1}
+		joinPayload := lorawan.JoinRequestPayload{}
+		copy(joinPayload.AppEUI[:], req.AppEUI)
+		copy(joinPayload.DevEUI[:], req.DevEUI)
+		copy(joinPayload.DevNonce[:], req.DevNonce)
+		payload.MACPayload = &joinPayload
+		err := payload.SetMIC(lorawan.AES128Key(*devStorage.OutRead.Entry.AppKey))
+		FatalUnless(t, err)
+		req.MIC = payload.MIC[:]
+
+		// Expect
+		var wantErr *string
+		var wantRes = &core.JoinHandlerRes{
+			Payload: &core.LoRaWANJoinAccept{}, // We'll check it by decoding
+			NwkSKey: nil,                       // We'll assume it's correct if payload is okay
+			Metadata: &core.Metadata{
+				DataRate:    "SF7BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(5*time.Second).Unix() * 1000000),
+				PayloadSize: 33,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
+		var wantAppReq = &core.JoinAppReq{
+			Metadata: []*core.Metadata{req.Metadata},
+			AppEUI:   req.AppEUI,
+			DevEUI:   req.DevEUI,
+		}
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleJoin(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes.Metadata, res.Metadata, "Join Handler Responses")
+		Check(t, 16, len(res.NwkSKey), "Network session keys' length")
+		Check(t, 4, len(res.DevAddr), "Device addresses' length")
+		Check(t, wantAppReq, appAdapter.InHandleJoin.Req, "Join Application Requests")
+		joinaccept := &lorawan.PHYPayload{}
+		err = joinaccept.UnmarshalBinary(res.Payload.Payload)
+		CheckErrors(t, nil, err)
+		err = joinaccept.DecryptJoinAcceptPayload(lorawan.AES128Key(*devStorage.InUpsert.Entry.AppKey))
+		CheckErrors(t, nil, err)
+		Check(t, handler.(*component).Configuration.NetID, joinaccept.MACPayload.(*lorawan.JoinAcceptPayload).NetID, "Network IDs")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle two join-requests of a device | different AppNonces, configured NetID")
+
+		// Build
+		tmst := time.Now()
+
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			AppKey: &[16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		}
+		pktStorage := NewMockPktStorage()
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+
+		// Expect
+		var wantErr *string
+		var wantNetID = lorawan.NetID([3]byte{0, 0, 0x13})
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", NetID: [3]byte{0, 0, 0x13}})
+
+		var appNonces [][3]byte
+		for _, devNonce := range [][]byte{{14, 42}, {14, 43}} {
+			req := &core.JoinHandlerReq{
+				AppEUI:   devStorage.OutRead.Entry.AppEUI,
+				DevEUI:   devStorage.OutRead.Entry.DevEUI,
+				DevNonce: devNonce,
+				Metadata: &core.Metadata{
+					DataRate:   "SF7BW125",
+					Frequency:  865.5,
+					Timestamp:  uint32(tmst.Unix() * 1000000),
+					CodingRate: "4/5",
+					DutyRX1:    uint32(dutycycle.StateAvailable),
+					DutyRX2:    uint32(dutycycle.StateAvailable),
+					Rssi:       -20,
+					Lsnr:       5.0,
+				},
+			}
+			payload := &lorawan.PHYPayload{}
+			payload.MHDR = lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1}
+			joinPayload := lorawan.JoinRequestPayload{}
+			copy(joinPayload.AppEUI[:], req.AppEUI)
+			copy(joinPayload.DevEUI[:], req.DevEUI)
+			copy(joinPayload.DevNonce[:], req.DevNonce)
+			payload.MACPayload = &joinPayload
+			err := payload.SetMIC(lorawan.AES128Key(*devStorage.OutRead.Entry.AppKey))
+			FatalUnless(t, err)
+			req.MIC = payload.MIC[:]
+
+			res, err := handler.HandleJoin(context.Background(), req)
+
+			// Check
+			CheckErrors(t, wantErr, err)
+			joinaccept := &lorawan.PHYPayload{}
+			err = joinaccept.UnmarshalBinary(res.Payload.Payload)
+			CheckErrors(t, nil, err)
+			err = joinaccept.DecryptJoinAcceptPayload(lorawan.AES128Key(*devStorage.OutRead.Entry.AppKey))
+			CheckErrors(t, nil, err)
+			Check(t, wantNetID, joinaccept.MACPayload.(*lorawan.JoinAcceptPayload).NetID, "Network IDs")
+			Check(t, devStorage.InUpsert.Entry.AppNonce, [3]byte(joinaccept.MACPayload.(*lorawan.JoinAcceptPayload).AppNonce), "Stored AppNonce")
+
+			// The next join sees the stored entry
+			appNonces = append(appNonces, devStorage.InUpsert.Entry.AppNonce)
+			devStorage.OutRead.Entry.AppNonce = devStorage.InUpsert.Entry.AppNonce
+		}
+
+		// Check
+		Check(t, true, appNonces[0] != appNonces[1], "Different AppNonces")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle valid join-request | NetID 000000")
+
+		// Build
+		tmst := time.Now()
+
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			AppKey: &[16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		}
+		pktStorage := NewMockPktStorage()
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+
+		req := &core.JoinHandlerReq{
+			AppEUI:   devStorage.OutRead.Entry.AppEUI,
+			DevEUI:   devStorage.OutRead.Entry.DevEUI,
+			DevNonce: []byte{14, 42},
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+		}
+		payload := &lorawan.PHYPayload{}
+		payload.MHDR = lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1}
+		joinPayload := lorawan.JoinRequestPayload{}
+		copy(joinPayload.AppEUI[:], req.AppEUI)
+		copy(joinPayload.DevEUI[:], req.DevEUI)
+		copy(joinPayload.DevNonce[:], req.DevNonce)
+		payload.MACPayload = &joinPayload
+		err := payload.SetMIC(lorawan.AES128Key(*devStorage.OutRead.Entry.AppKey))
+		FatalUnless(t, err)
+		req.MIC = payload.MIC[:]
+
+		// Expect
+		var wantErr *string
+		var wantNetID = lorawan.NetID([3]byte{0, 0, 0})
+		var wantNwkID = byte(0)
 
 		// Operate
 		handler := New(Components{
@@ -1481,21 +2824,27 @@ func TestHandleDataUp(t *testing.T) {
 			AppAdapter: appAdapter,
 			DevStorage: devStorage,
 			PktStorage: pktStorage,
-		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
-		res, err := handler.HandleDataUp(context.Background(), req)
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", NetID: [3]byte{0, 0, 0}})
+		res, err := handler.HandleJoin(context.Background(), req)
 
 		// Check
 		CheckErrors(t, wantErr, err)
-		Check(t, wantRes, res, "Data Up Handler Responses")
-		Check(t, wantData, appAdapter.InHandleData.Req, "Data Application Requests")
-		Check(t, wantFCnt, devStorage.InUpsert.Entry.FCntDown, "Frame counters")
+		joinaccept := &lorawan.PHYPayload{}
+		err = joinaccept.UnmarshalBinary(res.Payload.Payload)
+		CheckErrors(t, nil, err)
+		err = joinaccept.DecryptJoinAcceptPayload(lorawan.AES128Key(*devStorage.OutRead.Entry.AppKey))
+		CheckErrors(t, nil, err)
+		Check(t, wantNetID, joinaccept.MACPayload.(*lorawan.JoinAcceptPayload).NetID, "Network IDs")
+		Check(t, 4, len(res.DevAddr), "Device addresses' length")
+		if len(res.DevAddr) == 4 {
+			Check(t, wantNwkID, res.DevAddr[0]>>1, "Device addresses' NwkID")
+		}
 	}
 
-}
+	// --------------------
 
-func TestHandleJoin(t *testing.T) {
 	{
-		Desc(t, "Handle valid join-request | get join-accept")
+		Desc(t, "Handle valid join-request, fails to notify app.")
 
 		// Build
 		tmst := time.Now()
@@ -1524,6 +2873,7 @@ func TestHandleJoin(t *testing.T) {
 		}
 		pktStorage := NewMockPktStorage()
 		appAdapter := mocks.NewAppClient()
+		appAdapter.Failures["HandleJoin"] = errors.New(errors.Operational, "Mock Error")
 		broker := mocks.NewAuthBrokerClient()
 
 		payload := &lorawan.PHYPayload{}
@@ -1585,7 +2935,7 @@ func TestHandleJoin(t *testing.T) {
 	// --------------------
 
 	{
-		Desc(t, "Handle valid join-request, fails to notify app.")
+		Desc(t, "Handle valid join-request, fails to store")
 
 		// Build
 		tmst := time.Now()
@@ -1612,9 +2962,9 @@ func TestHandleJoin(t *testing.T) {
 			AppEUI: req.AppEUI,
 			DevEUI: req.DevEUI,
 		}
+		devStorage.Failures["upsert"] = errors.New(errors.Operational, "Mock Error")
 		pktStorage := NewMockPktStorage()
 		appAdapter := mocks.NewAppClient()
-		appAdapter.Failures["HandleJoin"] = errors.New(errors.Operational, "Mock Error")
 		broker := mocks.NewAuthBrokerClient()
 
 		payload := &lorawan.PHYPayload{}
@@ -1629,25 +2979,9 @@ func TestHandleJoin(t *testing.T) {
 		req.MIC = payload.MIC[:]
 
 		// Expect
-		var wantErr *string
-		var wantRes = &core.JoinHandlerRes{
-			Payload: &core.LoRaWANJoinAccept{}, // We'll check it by decoding
-			NwkSKey: nil,                       // We'll assume it's correct if payload is okay
-			Metadata: &core.Metadata{
-				DataRate:    "SF7BW125",
-				Frequency:   865.5,
-				CodingRate:  "4/5",
-				Timestamp:   uint32(tmst.Add(5*time.Second).Unix() * 1000000),
-				PayloadSize: 33,
-				Power:       14,
-				InvPolarity: true,
-			},
-		}
-		var wantAppReq = &core.JoinAppReq{
-			Metadata: []*core.Metadata{req.Metadata},
-			AppEUI:   req.AppEUI,
-			DevEUI:   req.DevEUI,
-		}
+		var wantErr = ErrOperational
+		var wantRes = new(core.JoinHandlerRes)
+		var wantAppReq *core.JoinAppReq
 
 		// Operate
 		handler := New(Components{
@@ -1661,22 +2995,14 @@ func TestHandleJoin(t *testing.T) {
 
 		// Check
 		CheckErrors(t, wantErr, err)
-		Check(t, wantRes.Metadata, res.Metadata, "Join Handler Responses")
-		Check(t, 16, len(res.NwkSKey), "Network session keys' length")
-		Check(t, 4, len(res.DevAddr), "Device addresses' length")
+		Check(t, wantRes, res, "Join Handler Responses")
 		Check(t, wantAppReq, appAdapter.InHandleJoin.Req, "Join Application Requests")
-		joinaccept := &lorawan.PHYPayload{}
-		err = joinaccept.UnmarshalBinary(res.Payload.Payload)
-		CheckErrors(t, nil, err)
-		err = joinaccept.DecryptJoinAcceptPayload(lorawan.AES128Key(*devStorage.InUpsert.Entry.AppKey))
-		CheckErrors(t, nil, err)
-		Check(t, handler.(*component).Configuration.NetID, joinaccept.MACPayload.(*lorawan.JoinAcceptPayload).NetID, "Network IDs")
 	}
 
 	// --------------------
 
 	{
-		Desc(t, "Handle valid join-request, fails to store")
+		Desc(t, "Handle valid join-request, no gateway available")
 
 		// Build
 		tmst := time.Now()
@@ -1690,8 +3016,8 @@ func TestHandleJoin(t *testing.T) {
 				Frequency:  865.5,
 				Timestamp:  uint32(tmst.Unix() * 1000000),
 				CodingRate: "4/5",
-				DutyRX1:    uint32(dutycycle.StateAvailable),
-				DutyRX2:    uint32(dutycycle.StateAvailable),
+				DutyRX1:    uint32(dutycycle.StateBlocked),
+				DutyRX2:    uint32(dutycycle.StateBlocked),
 				Rssi:       -20,
 				Lsnr:       5.0,
 			},
@@ -1703,7 +3029,6 @@ func TestHandleJoin(t *testing.T) {
 			AppEUI: req.AppEUI,
 			DevEUI: req.DevEUI,
 		}
-		devStorage.Failures["upsert"] = errors.New(errors.Operational, "Mock Error")
 		pktStorage := NewMockPktStorage()
 		appAdapter := mocks.NewAppClient()
 		broker := mocks.NewAuthBrokerClient()
@@ -1743,7 +3068,7 @@ func TestHandleJoin(t *testing.T) {
 	// --------------------
 
 	{
-		Desc(t, "Handle valid join-request, no gateway available")
+		Desc(t, "Handle invalid join request: invalid datarate")
 
 		// Build
 		tmst := time.Now()
@@ -1753,12 +3078,12 @@ func TestHandleJoin(t *testing.T) {
 			DevEUI:   []byte{2, 2, 2, 2, 2, 2, 2, 2},
 			DevNonce: []byte{14, 42},
 			Metadata: &core.Metadata{
-				DataRate:   "SF7BW125",
+				DataRate:   "Not A DataRate",
 				Frequency:  865.5,
 				Timestamp:  uint32(tmst.Unix() * 1000000),
 				CodingRate: "4/5",
-				DutyRX1:    uint32(dutycycle.StateBlocked),
-				DutyRX2:    uint32(dutycycle.StateBlocked),
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
 				Rssi:       -20,
 				Lsnr:       5.0,
 			},
@@ -1786,7 +3111,7 @@ func TestHandleJoin(t *testing.T) {
 		req.MIC = payload.MIC[:]
 
 		// Expect
-		var wantErr = ErrOperational
+		var wantErr = ErrStructural
 		var wantRes = new(core.JoinHandlerRes)
 		var wantAppReq *core.JoinAppReq
 
@@ -1809,7 +3134,7 @@ func TestHandleJoin(t *testing.T) {
 	// --------------------
 
 	{
-		Desc(t, "Handle invalid join request: invalid datarate")
+		Desc(t, "Handle invalid join-request: lookup fails")
 
 		// Build
 		tmst := time.Now()
@@ -1818,8 +3143,9 @@ func TestHandleJoin(t *testing.T) {
 			AppEUI:   []byte{1, 1, 1, 1, 1, 1, 1, 1},
 			DevEUI:   []byte{2, 2, 2, 2, 2, 2, 2, 2},
 			DevNonce: []byte{14, 42},
+			MIC:      []byte{1, 2, 3, 4},
 			Metadata: &core.Metadata{
-				DataRate:   "Not A DataRate",
+				DataRate:   "SF7BW125",
 				Frequency:  865.5,
 				Timestamp:  uint32(tmst.Unix() * 1000000),
 				CodingRate: "4/5",
@@ -1831,10 +3157,61 @@ func TestHandleJoin(t *testing.T) {
 		}
 
 		devStorage := NewMockDevStorage()
-		devStorage.OutRead.Entry = devEntry{
-			AppKey: &[16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
-			AppEUI: req.AppEUI,
-			DevEUI: req.DevEUI,
+		devStorage.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+		pktStorage := NewMockPktStorage()
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+
+		// Expect
+		var wantErr = ErrNotFound
+		var wantRes = new(core.JoinHandlerRes)
+		var wantAppReq *core.JoinAppReq
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		res, err := handler.HandleJoin(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Join Handler Responses")
+		Check(t, wantAppReq, appAdapter.InHandleJoin.Req, "Join Application Requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle valid join-request | create new device with default AppKey")
+
+		// Build
+		tmst := time.Now()
+		appKey := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6}
+
+		req := &core.JoinHandlerReq{
+			AppEUI:   []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
+			DevNonce: []byte{14, 42},
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+		}
+
+		devStorage := NewMockDevStorage()
+		devStorage.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+		devStorage.OutGetDefault.Entry = &devDefaultEntry{
+			AppKey: appKey,
 		}
 		pktStorage := NewMockPktStorage()
 		appAdapter := mocks.NewAppClient()
@@ -1847,14 +3224,30 @@ func TestHandleJoin(t *testing.T) {
 		copy(joinPayload.DevEUI[:], req.DevEUI)
 		copy(joinPayload.DevNonce[:], req.DevNonce)
 		payload.MACPayload = &joinPayload
-		err := payload.SetMIC(lorawan.AES128Key(*devStorage.OutRead.Entry.AppKey))
+		err := payload.SetMIC(lorawan.AES128Key(appKey))
 		FatalUnless(t, err)
 		req.MIC = payload.MIC[:]
 
 		// Expect
-		var wantErr = ErrStructural
-		var wantRes = new(core.JoinHandlerRes)
-		var wantAppReq *core.JoinAppReq
+		var wantErr *string
+		var wantRes = &core.JoinHandlerRes{
+			Payload: &core.LoRaWANJoinAccept{}, // We'll check it by decoding
+			NwkSKey: nil,                       // We'll assume it's correct if payload is okay
+			Metadata: &core.Metadata{
+				DataRate:    "SF7BW125",
+				Frequency:   865.5,
+				CodingRate:  "4/5",
+				Timestamp:   uint32(tmst.Add(5*time.Second).Unix() * 1000000),
+				PayloadSize: 33,
+				Power:       14,
+				InvPolarity: true,
+			},
+		}
+		var wantAppReq = &core.JoinAppReq{
+			Metadata: []*core.Metadata{req.Metadata},
+			AppEUI:   req.AppEUI,
+			DevEUI:   req.DevEUI,
+		}
 
 		// Operate
 		handler := New(Components{
@@ -1868,23 +3261,108 @@ func TestHandleJoin(t *testing.T) {
 
 		// Check
 		CheckErrors(t, wantErr, err)
-		Check(t, wantRes, res, "Join Handler Responses")
+		Check(t, wantRes.Metadata, res.Metadata, "Join Handler Responses")
+		Check(t, 16, len(res.NwkSKey), "Network session keys' length")
+		Check(t, 4, len(res.DevAddr), "Device addresses' length")
 		Check(t, wantAppReq, appAdapter.InHandleJoin.Req, "Join Application Requests")
+		joinaccept := &lorawan.PHYPayload{}
+		err = joinaccept.UnmarshalBinary(res.Payload.Payload)
+		CheckErrors(t, nil, err)
+		err = joinaccept.DecryptJoinAcceptPayload(lorawan.AES128Key(appKey))
+		CheckErrors(t, nil, err)
+		Check(t, handler.(*component).Configuration.NetID, joinaccept.MACPayload.(*lorawan.JoinAcceptPayload).NetID, "Network IDs")
+		Check(t, req.AppEUI, devStorage.InUpsert.Entry.AppEUI, "New Device's AppEUI")
+		Check(t, appKey, *devStorage.InUpsert.Entry.AppKey, "New Device's AppKey")
+		Check(t, req.DevEUI, devStorage.InUpsert.Entry.DevEUI, "New Device's DevEUI")
 	}
 
 	// --------------------
 
 	{
-		Desc(t, "Handle invalid join-request: lookup fails")
+		Desc(t, "Handle valid join-request | create new device with default AppKey, under quota")
 
 		// Build
 		tmst := time.Now()
+		appKey := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6}
 
 		req := &core.JoinHandlerReq{
 			AppEUI:   []byte{1, 1, 1, 1, 1, 1, 1, 1},
-			DevEUI:   []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevEUI:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
+			DevNonce: []byte{14, 42},
+			Metadata: &core.Metadata{
+				DataRate:   "SF7BW125",
+				Frequency:  865.5,
+				Timestamp:  uint32(tmst.Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+		}
+
+		devStorage := NewMockDevStorage()
+		devStorage.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+		devStorage.OutGetDefault.Entry = &devDefaultEntry{
+			AppKey: appKey,
+		}
+		devStorage.OutReadAll.Entries = []devEntry{
+			{
+				AppEUI:  req.AppEUI,
+				DevEUI:  []byte{4, 4, 4, 4, 4, 4, 4, 4},
+				DevAddr: []byte{4, 4, 4, 4},
+			},
+		}
+		pktStorage := NewMockPktStorage()
+		appAdapter := mocks.NewAppClient()
+		broker := mocks.NewAuthBrokerClient()
+
+		payload := &lorawan.PHYPayload{}
+		payload.MHDR = lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1}
+		joinPayload := lorawan.JoinRequestPayload{}
+		copy(joinPayload.AppEUI[:], req.AppEUI)
+		copy(joinPayload.DevEUI[:], req.DevEUI)
+		copy(joinPayload.DevNonce[:], req.DevNonce)
+		payload.MACPayload = &joinPayload
+		err := payload.SetMIC(lorawan.AES128Key(appKey))
+		FatalUnless(t, err)
+		req.MIC = payload.MIC[:]
+
+		// Expect
+		var wantErr *string
+		var wantDevEUI = req.DevEUI
+		var wantMaxDevices uint = 2
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     broker,
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", MaxDevicesPerApp: 2})
+		_, err = handler.HandleJoin(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantDevEUI, devStorage.InReserve.DevEUI, "New Device's DevEUI")
+		Check(t, wantMaxDevices, devStorage.InReserve.MaxDevices, "Quota")
+		Check(t, wantDevEUI, devStorage.InRelease.DevEUI, "Released devices")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle valid join-request | create new device with default AppKey, quota reached")
+
+		// Build
+		tmst := time.Now()
+		appKey := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6}
+
+		req := &core.JoinHandlerReq{
+			AppEUI:   []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
 			DevNonce: []byte{14, 42},
-			MIC:      []byte{1, 2, 3, 4},
 			Metadata: &core.Metadata{
 				DataRate:   "SF7BW125",
 				Frequency:  865.5,
@@ -1899,13 +3377,28 @@ func TestHandleJoin(t *testing.T) {
 
 		devStorage := NewMockDevStorage()
 		devStorage.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+		devStorage.Failures["reserve"] = ErrDeviceQuotaExceeded
+		devStorage.OutGetDefault.Entry = &devDefaultEntry{
+			AppKey: appKey,
+		}
 		pktStorage := NewMockPktStorage()
 		appAdapter := mocks.NewAppClient()
 		broker := mocks.NewAuthBrokerClient()
 
+		payload := &lorawan.PHYPayload{}
+		payload.MHDR = lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1}
+		joinPayload := lorawan.JoinRequestPayload{}
+		copy(joinPayload.AppEUI[:], req.AppEUI)
+		copy(joinPayload.DevEUI[:], req.DevEUI)
+		copy(joinPayload.DevNonce[:], req.DevNonce)
+		payload.MACPayload = &joinPayload
+		err := payload.SetMIC(lorawan.AES128Key(appKey))
+		FatalUnless(t, err)
+		req.MIC = payload.MIC[:]
+
 		// Expect
-		var wantErr = ErrNotFound
-		var wantRes = new(core.JoinHandlerRes)
+		var wantErr = ErrDeviceQuotaExceeded
+		var wantDevEUI []byte
 		var wantAppReq *core.JoinAppReq
 
 		// Operate
@@ -1915,19 +3408,19 @@ func TestHandleJoin(t *testing.T) {
 			AppAdapter: appAdapter,
 			DevStorage: devStorage,
 			PktStorage: pktStorage,
-		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
-		res, err := handler.HandleJoin(context.Background(), req)
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", MaxDevicesPerApp: 1})
+		_, err = handler.HandleJoin(context.Background(), req)
 
 		// Check
-		CheckErrors(t, wantErr, err)
-		Check(t, wantRes, res, "Join Handler Responses")
+		Check(t, wantErr, err, "Errors")
+		Check(t, wantDevEUI, devStorage.InUpsert.Entry.DevEUI, "New Device's DevEUI")
 		Check(t, wantAppReq, appAdapter.InHandleJoin.Req, "Join Application Requests")
 	}
 
 	// --------------------
 
 	{
-		Desc(t, "Handle valid join-request | create new device with default AppKey")
+		Desc(t, "Handle join-request with an invalid MIC | device unknown, default AppKey")
 
 		// Build
 		tmst := time.Now()
@@ -1937,6 +3430,7 @@ func TestHandleJoin(t *testing.T) {
 			AppEUI:   []byte{1, 1, 1, 1, 1, 1, 1, 1},
 			DevEUI:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
 			DevNonce: []byte{14, 42},
+			MIC:      []byte{0, 0, 0, 0},
 			Metadata: &core.Metadata{
 				DataRate:   "SF7BW125",
 				Frequency:  865.5,
@@ -1958,37 +3452,11 @@ func TestHandleJoin(t *testing.T) {
 		appAdapter := mocks.NewAppClient()
 		broker := mocks.NewAuthBrokerClient()
 
-		payload := &lorawan.PHYPayload{}
-		payload.MHDR = lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1}
-		joinPayload := lorawan.JoinRequestPayload{}
-		copy(joinPayload.AppEUI[:], req.AppEUI)
-		copy(joinPayload.DevEUI[:], req.DevEUI)
-		copy(joinPayload.DevNonce[:], req.DevNonce)
-		payload.MACPayload = &joinPayload
-		err := payload.SetMIC(lorawan.AES128Key(appKey))
-		FatalUnless(t, err)
-		req.MIC = payload.MIC[:]
-
 		// Expect
-		var wantErr *string
-		var wantRes = &core.JoinHandlerRes{
-			Payload: &core.LoRaWANJoinAccept{}, // We'll check it by decoding
-			NwkSKey: nil,                       // We'll assume it's correct if payload is okay
-			Metadata: &core.Metadata{
-				DataRate:    "SF7BW125",
-				Frequency:   865.5,
-				CodingRate:  "4/5",
-				Timestamp:   uint32(tmst.Add(5*time.Second).Unix() * 1000000),
-				PayloadSize: 33,
-				Power:       14,
-				InvPolarity: true,
-			},
-		}
-		var wantAppReq = &core.JoinAppReq{
-			Metadata: []*core.Metadata{req.Metadata},
-			AppEUI:   req.AppEUI,
-			DevEUI:   req.DevEUI,
-		}
+		var wantErr = ErrStructural
+		var wantDevEUI []byte
+		var wantQuotaAppEUI []byte
+		var wantAppReq *core.JoinAppReq
 
 		// Operate
 		handler := New(Components{
@@ -1997,24 +3465,14 @@ func TestHandleJoin(t *testing.T) {
 			AppAdapter: appAdapter,
 			DevStorage: devStorage,
 			PktStorage: pktStorage,
-		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
-		res, err := handler.HandleJoin(context.Background(), req)
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", MaxDevicesPerApp: 1})
+		_, err := handler.HandleJoin(context.Background(), req)
 
 		// Check
 		CheckErrors(t, wantErr, err)
-		Check(t, wantRes.Metadata, res.Metadata, "Join Handler Responses")
-		Check(t, 16, len(res.NwkSKey), "Network session keys' length")
-		Check(t, 4, len(res.DevAddr), "Device addresses' length")
+		Check(t, wantDevEUI, devStorage.InReserve.DevEUI, "New Device's DevEUI")
+		Check(t, wantQuotaAppEUI, devStorage.InReadAll.AppEUI, "Quota lookups")
 		Check(t, wantAppReq, appAdapter.InHandleJoin.Req, "Join Application Requests")
-		joinaccept := &lorawan.PHYPayload{}
-		err = joinaccept.UnmarshalBinary(res.Payload.Payload)
-		CheckErrors(t, nil, err)
-		err = joinaccept.DecryptJoinAcceptPayload(lorawan.AES128Key(appKey))
-		CheckErrors(t, nil, err)
-		Check(t, handler.(*component).Configuration.NetID, joinaccept.MACPayload.(*lorawan.JoinAcceptPayload).NetID, "Network IDs")
-		Check(t, req.AppEUI, devStorage.InUpsert.Entry.AppEUI, "New Device's AppEUI")
-		Check(t, appKey, *devStorage.InUpsert.Entry.AppKey, "New Device's AppKey")
-		Check(t, req.DevEUI, devStorage.InUpsert.Entry.DevEUI, "New Device's DevEUI")
 	}
 
 	// --------------------
@@ -2339,6 +3797,292 @@ func TestHandleJoin(t *testing.T) {
 		Check(t, wantAppReq, appAdapter.InHandleJoin.Req, "Join Application Requests")
 	}
 
+	// -------------------
+
+	{
+		Desc(t, "Handle valid join-request (2 packets, second after a custom buffer delay)")
+
+		// Build
+		req := &core.JoinHandlerReq{
+			AppEUI:   []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:   []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevNonce: []byte{14, 42},
+			Metadata: &core.Metadata{
+				DataRate:   "SF8BW125",
+				Frequency:  867.234,
+				Timestamp:  uint32(time.Now().Unix() * 1000000),
+				CodingRate: "4/5",
+				DutyRX1:    uint32(dutycycle.StateAvailable),
+				DutyRX2:    uint32(dutycycle.StateAvailable),
+				Rssi:       -20,
+				Lsnr:       5.0,
+			},
+		}
+
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			AppKey: &[16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			AppEUI: req.AppEUI,
+			DevEUI: req.DevEUI,
+		}
+
+		payload := &lorawan.PHYPayload{}
+		payload.MHDR = lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1}
+		joinPayload := lorawan.JoinRequestPayload{}
+		copy(joinPayload.AppEUI[:], req.AppEUI)
+		copy(joinPayload.DevEUI[:], req.DevEUI)
+		copy(joinPayload.DevNonce[:], req.DevNonce)
+		payload.MACPayload = &joinPayload
+		err := payload.SetMIC(lorawan.AES128Key(*devStorage.OutRead.Entry.AppKey))
+		FatalUnless(t, err)
+		req.MIC = payload.MIC[:]
+
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     mocks.NewAuthBrokerClient(),
+			AppAdapter: mocks.NewAppClient(),
+			DevStorage: devStorage,
+			PktStorage: NewMockPktStorage(),
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost", BufferDelay: 50 * time.Millisecond})
+
+		// Expect
+		var wantErr1 *string
+		var wantErr2 = ErrBehavioural
+		var wantAccept = true
+
+		// Operate
+		start := time.Now()
+		res1, err1 := handler.HandleJoin(context.Background(), req)
+		elapsed := time.Since(start)
+		_, err2 := handler.HandleJoin(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr1, err1)
+		CheckErrors(t, wantErr2, err2)
+		Check(t, wantAccept, res1.Payload != nil, "Join accepts")
+		Check(t, true, elapsed < bufferDelay, "Buffering delays")
+	}
+}
+
+// countingAppClient is an application adapter counting the uplinks it is given
+type countingAppClient struct {
+	*mocks.AppClient
+	Calls int
+}
+
+// HandleData implements the core.AppClient interface
+func (m *countingAppClient) HandleData(ctx context.Context, in *core.DataAppReq, opts ...grpc.CallOption) (*core.DataAppRes, error) {
+	m.Calls++
+	return m.AppClient.HandleData(ctx, in, opts...)
+}
+
+func TestConsumeDuplicates(t *testing.T) {
+	{
+		Desc(t, "Consume 3 duplicates of a confirmed uplink | one application uplink, best SNR answers")
+
+		// Build
+		devAddr := lorawan.DevAddr([4]byte{3, 4, 2, 4})
+		devStorage := NewMockDevStorage()
+		devStorage.OutRead.Entry = devEntry{
+			DevAddr:  devAddr[:],
+			AppSKey:  [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6},
+			NwkSKey:  [16]byte{6, 5, 4, 3, 2, 1, 0, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			FCntDown: 3,
+		}
+		pktStorage := NewMockPktStorage()
+		pktStorage.Failures["dequeue"] = errors.New(errors.NotFound, "Mock Error")
+		appAdapter := &countingAppClient{AppClient: mocks.NewAppClient()}
+		payload, fcnt := []byte("Payload"), uint32(14)
+		encoded, err := lorawan.EncryptFRMPayload(
+			devStorage.OutRead.Entry.AppSKey,
+			true,
+			devAddr,
+			fcnt,
+			payload,
+		)
+		FatalUnless(t, err)
+		var bundles []bundle
+		for _, lsnr := range []float32{2.0, 9.0, 5.0} {
+			bundles = append(bundles, bundle{
+				ID: [21]byte{1},
+				Packet: &core.DataUpHandlerReq{
+					Payload: encoded,
+					Metadata: &core.Metadata{
+						DataRate: "SF7BW125",
+						DutyRX1:  uint32(dutycycle.StateAvailable),
+						DutyRX2:  uint32(dutycycle.StateAvailable),
+						Rssi:     -20,
+						Lsnr:     lsnr,
+					},
+					AppEUI: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+					DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+					FCnt:   fcnt,
+					FPort:  1,
+					MType:  uint32(lorawan.ConfirmedDataUp),
+				},
+				DataRate: "SF7BW125",
+				Entry:    devStorage.OutRead.Entry,
+				Chresp:   make(chan interface{}, 1),
+				Time:     time.Now(),
+			})
+		}
+
+		// Expect
+		var wantCalls = 1
+		var wantBestLsnr float32 = 9.0
+		var wantAnswered = []bool{false, true, false}
+
+		// Operate
+		h := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			Broker:     mocks.NewAuthBrokerClient(),
+			AppAdapter: appAdapter,
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"}).(*component)
+		h.consumeDown(bundles[0].Packet.(*core.DataUpHandlerReq).AppEUI, bundles[0].Packet.(*core.DataUpHandlerReq).DevEUI, "SF7BW125", bundles)
+
+		// Check
+		var answered []bool
+		for _, b := range bundles {
+			res, ok := (<-b.Chresp).(*core.DataUpHandlerRes)
+			answered = append(answered, ok && res != nil)
+		}
+		Check(t, wantCalls, appAdapter.Calls, "Application uplinks")
+		Check(t, wantAnswered, answered, "Answered duplicates")
+		if appAdapter.InHandleData.Req != nil {
+			Check(t, wantBestLsnr, appAdapter.InHandleData.Req.Metadata[0].Lsnr, "Best gateways")
+		}
+	}
+}
+
+func TestEnqueueMAC(t *testing.T) {
+	appEUI := types.AppEUI{1, 1, 1, 1, 1, 1, 1, 1}
+	devEUI := types.DevEUI{2, 2, 2, 2, 2, 2, 2, 2}
+	cmd := lorawan.MACCommand{CID: lorawan.DevStatusReq}
+
+	// --------------------
+
+	{
+		Desc(t, "Queue a MAC command for a known device")
+
+		// Build
+		devStorage := NewMockDevStorage()
+		pktStorage := NewMockPktStorage()
+
+		// Expect
+		var wantErr *string
+		var wantCommand = cmd
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		err := handler.EnqueueMAC(appEUI, devEUI, cmd)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantCommand, pktStorage.InEnqueueMAC.Command, "Queued MAC commands")
+		Check(t, devEUI[:], pktStorage.InEnqueueMAC.DevEUI, "DevEUIs")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Queue a MAC command for an unknown device")
+
+		// Build
+		devStorage := NewMockDevStorage()
+		devStorage.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+		pktStorage := NewMockPktStorage()
+
+		// Expect
+		var wantErr = ErrNotFound
+		var wantCommand lorawan.MACCommand
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		err := handler.EnqueueMAC(appEUI, devEUI, cmd)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantCommand, pktStorage.InEnqueueMAC.Command, "Queued MAC commands")
+	}
+}
+
+func TestDeleteDevices(t *testing.T) {
+	appEUI := types.AppEUI{1, 1, 1, 1, 1, 1, 1, 1}
+
+	// --------------------
+
+	{
+		Desc(t, "Delete the devices of an application and their queues")
+
+		// Build
+		devStorage := NewMockDevStorage()
+		devStorage.OutReadAll.Entries = []devEntry{
+			{AppEUI: appEUI[:], AppKey: &[16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6}}, // Default device
+			{AppEUI: appEUI[:], DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2}},
+			{AppEUI: appEUI[:], DevEUI: []byte{3, 3, 3, 3, 3, 3, 3, 3}},
+		}
+		devStorage.OutDeleteAll.Count = 2
+		pktStorage := NewMockPktStorage()
+
+		// Expect
+		var wantErr *string
+		var wantCount = 2
+		var wantPurged = [][]byte{{2, 2, 2, 2, 2, 2, 2, 2}, {3, 3, 3, 3, 3, 3, 3, 3}}
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		n, err := handler.DeleteDevices(appEUI)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantCount, n, "Deleted devices")
+		Check(t, appEUI[:], devStorage.InDeleteAll.AppEUI, "AppEUIs")
+		Check(t, wantPurged, pktStorage.InPurge.DevEUIs, "Purged queues")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Delete the devices of an application | deletion fails")
+
+		// Build
+		devStorage := NewMockDevStorage()
+		devStorage.OutReadAll.Entries = []devEntry{
+			{AppEUI: appEUI[:], DevEUI: []byte{2, 2, 2, 2, 2, 2, 2, 2}},
+		}
+		devStorage.Failures["deleteAll"] = errors.New(errors.Operational, "Mock Error")
+		pktStorage := NewMockPktStorage()
+
+		// Expect
+		var wantErr = ErrOperational
+		var wantPurged [][]byte
+
+		// Operate
+		handler := New(Components{
+			Ctx:        GetLogger(t, "Handler"),
+			DevStorage: devStorage,
+			PktStorage: pktStorage,
+		}, Options{PublicNetAddr: "localhost", PrivateNetAddr: "localhost"})
+		_, err := handler.DeleteDevices(appEUI)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantPurged, pktStorage.InPurge.DevEUIs, "Purged queues")
+	}
 }
 
 func TestStart(t *testing.T) {
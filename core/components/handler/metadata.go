@@ -0,0 +1,47 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"sort"
+
+	"github.com/TheThingsNetwork/ttn/core"
+)
+
+// bySNR sorts indexes of a metadata list by decreasing SNR
+type bySNR struct {
+	indexes  []int
+	metadata []*core.Metadata
+}
+
+func (s bySNR) Len() int      { return len(s.indexes) }
+func (s bySNR) Swap(i, j int) { s.indexes[i], s.indexes[j] = s.indexes[j], s.indexes[i] }
+func (s bySNR) Less(i, j int) bool {
+	return s.metadata[s.indexes[i]].Lsnr > s.metadata[s.indexes[j]].Lsnr
+}
+
+// sortMetadata gives the metadata of all gateways which received a packet, by decreasing SNR.
+// Gateways with the same SNR are kept in their arrival order.
+func sortMetadata(metadata []*core.Metadata) []*core.Metadata {
+	s := bySNR{metadata: metadata}
+	for i := range metadata {
+		s.indexes = append(s.indexes, i)
+	}
+	sort.Stable(s)
+
+	var sorted []*core.Metadata
+	for _, i := range s.indexes {
+		sorted = append(sorted, metadata[i])
+	}
+	return sorted
+}
+
+// capMetadata keeps at most max metadata, the first ones of a list already sorted by sortMetadata.
+// A max of 0 means no limit.
+func capMetadata(metadata []*core.Metadata, max uint) []*core.Metadata {
+	if max == 0 || uint(len(metadata)) <= max {
+		return metadata
+	}
+	return metadata[:max]
+}
@@ -0,0 +1,71 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+)
+
+func TestCapMetadata(t *testing.T) {
+	metadata := []*core.Metadata{
+		{GatewayEUI: "0000000000000004", Lsnr: 9.0},
+		{GatewayEUI: "0000000000000002", Lsnr: 7.5},
+		{GatewayEUI: "0000000000000003", Lsnr: 2.0},
+		{GatewayEUI: "0000000000000005", Lsnr: 2.0},
+		{GatewayEUI: "0000000000000001", Lsnr: -5.0},
+	}
+
+	{
+		Desc(t, "No limit")
+		Check(t, metadata, capMetadata(metadata, 0), "Metadata")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Limit above the number of gateways")
+		Check(t, metadata, capMetadata(metadata, 10), "Metadata")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Keep the two best by SNR")
+		want := []*core.Metadata{metadata[0], metadata[1]}
+		Check(t, want, capMetadata(metadata, 2), "Metadata")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Keep the order of the sorted list on equal SNR")
+		want := []*core.Metadata{metadata[0], metadata[1], metadata[2]}
+		Check(t, want, capMetadata(metadata, 3), "Metadata")
+	}
+}
+
+func TestSortMetadata(t *testing.T) {
+	{
+		Desc(t, "No metadata")
+		Check(t, []*core.Metadata(nil), sortMetadata(nil), "Metadata")
+	}
+
+	// ----------
+
+	{
+		Desc(t, "Sort by decreasing SNR, keep the arrival order on equal SNR")
+		metadata := []*core.Metadata{
+			{GatewayEUI: "0000000000000001", Lsnr: -5.0},
+			{GatewayEUI: "0000000000000002", Lsnr: 7.5},
+			{GatewayEUI: "0000000000000003", Lsnr: 2.0},
+			{GatewayEUI: "0000000000000004", Lsnr: 9.0},
+			{GatewayEUI: "0000000000000005", Lsnr: 2.0},
+		}
+		want := []*core.Metadata{metadata[3], metadata[1], metadata[2], metadata[4], metadata[0]}
+		Check(t, want, sortMetadata(metadata), "Metadata")
+	}
+}
@@ -3,6 +3,10 @@
 
 package handler
 
+import (
+	"github.com/brocaar/lorawan"
+)
+
 // NOTE: All the code below could be generated
 
 // MockDevStorage mocks the DevStorage interface
@@ -24,6 +28,25 @@ type MockDevStorage struct {
 	InUpsert struct {
 		Entry devEntry
 	}
+	InReserve struct {
+		AppEUI     []byte
+		DevEUI     []byte
+		MaxDevices uint
+	}
+	InRelease struct {
+		AppEUI []byte
+		DevEUI []byte
+	}
+	InUpsertIfVersion struct {
+		Entry   devEntry
+		Version uint64
+	}
+	InDeleteAll struct {
+		AppEUI []byte
+	}
+	OutDeleteAll struct {
+		Count int
+	}
 	InGetDefault struct {
 		AppEUI []byte
 	}
@@ -65,6 +88,33 @@ func (m *MockDevStorage) upsert(entry devEntry) error {
 	return m.Failures["upsert"]
 }
 
+// reserve implements the DevStorage interface
+func (m *MockDevStorage) reserve(appEUI []byte, devEUI []byte, maxDevices uint) error {
+	m.InReserve.AppEUI = appEUI
+	m.InReserve.DevEUI = devEUI
+	m.InReserve.MaxDevices = maxDevices
+	return m.Failures["reserve"]
+}
+
+// release implements the DevStorage interface
+func (m *MockDevStorage) release(appEUI []byte, devEUI []byte) {
+	m.InRelease.AppEUI = appEUI
+	m.InRelease.DevEUI = devEUI
+}
+
+// upsertIfVersion implements the DevStorage interface
+func (m *MockDevStorage) upsertIfVersion(entry devEntry, version uint64) error {
+	m.InUpsertIfVersion.Entry = entry
+	m.InUpsertIfVersion.Version = version
+	return m.Failures["upsertIfVersion"]
+}
+
+// deleteAll implements the DevStorage interface
+func (m *MockDevStorage) deleteAll(appEUI []byte) (int, error) {
+	m.InDeleteAll.AppEUI = appEUI
+	return m.OutDeleteAll.Count, m.Failures["deleteAll"]
+}
+
 // getDefault implements the DevStorage interface
 func (m *MockDevStorage) getDefault(appEUI []byte) (*devDefaultEntry, error) {
 	m.InGetDefault.AppEUI = appEUI
@@ -93,6 +143,9 @@ type MockPktStorage struct {
 	OutDequeue struct {
 		Entry pktEntry
 	}
+	InRequeue struct {
+		Entry pktEntry
+	}
 	InPeek struct {
 		AppEUI []byte
 		DevEUI []byte
@@ -103,6 +156,34 @@ type MockPktStorage struct {
 	InEnqueue struct {
 		Entry pktEntry
 	}
+	InEnqueueUnique struct {
+		Entry pktEntry
+	}
+	OutEnqueueUnique struct {
+		Queued bool
+	}
+	InEnqueueMAC struct {
+		AppEUI  []byte
+		DevEUI  []byte
+		Command lorawan.MACCommand
+	}
+	InPeekMAC struct {
+		AppEUI []byte
+		DevEUI []byte
+		MaxLen int
+	}
+	OutPeekMAC struct {
+		Commands []lorawan.MACCommand
+	}
+	InCommitMAC struct {
+		AppEUI []byte
+		DevEUI []byte
+		N      int
+	}
+	InPurge struct {
+		AppEUI  []byte
+		DevEUIs [][]byte
+	}
 	InDone struct {
 		Called bool
 	}
@@ -127,6 +208,12 @@ func (m *MockPktStorage) enqueue(entry pktEntry) error {
 	return m.Failures["enqueue"]
 }
 
+// enqueueUnique implements the PktStorage interface
+func (m *MockPktStorage) enqueueUnique(entry pktEntry) (bool, error) {
+	m.InEnqueueUnique.Entry = entry
+	return m.OutEnqueueUnique.Queued, m.Failures["enqueueUnique"]
+}
+
 // dequeue implements the PktStorage interface
 func (m *MockPktStorage) dequeue(appEUI []byte, devEUI []byte) (pktEntry, error) {
 	m.InDequeue.AppEUI = appEUI
@@ -134,6 +221,43 @@ func (m *MockPktStorage) dequeue(appEUI []byte, devEUI []byte) (pktEntry, error)
 	return m.OutDequeue.Entry, m.Failures["dequeue"]
 }
 
+// requeue implements the PktStorage interface
+func (m *MockPktStorage) requeue(entry pktEntry) error {
+	m.InRequeue.Entry = entry
+	return m.Failures["requeue"]
+}
+
+// enqueueMAC implements the PktStorage interface
+func (m *MockPktStorage) enqueueMAC(appEUI []byte, devEUI []byte, cmd lorawan.MACCommand) error {
+	m.InEnqueueMAC.AppEUI = appEUI
+	m.InEnqueueMAC.DevEUI = devEUI
+	m.InEnqueueMAC.Command = cmd
+	return m.Failures["enqueueMAC"]
+}
+
+// peekMAC implements the PktStorage interface
+func (m *MockPktStorage) peekMAC(appEUI []byte, devEUI []byte, maxLen int) ([]lorawan.MACCommand, error) {
+	m.InPeekMAC.AppEUI = appEUI
+	m.InPeekMAC.DevEUI = devEUI
+	m.InPeekMAC.MaxLen = maxLen
+	return m.OutPeekMAC.Commands, m.Failures["peekMAC"]
+}
+
+// commitMAC implements the PktStorage interface
+func (m *MockPktStorage) commitMAC(appEUI []byte, devEUI []byte, n int) error {
+	m.InCommitMAC.AppEUI = appEUI
+	m.InCommitMAC.DevEUI = devEUI
+	m.InCommitMAC.N = n
+	return m.Failures["commitMAC"]
+}
+
+// purge implements the PktStorage interface
+func (m *MockPktStorage) purge(appEUI []byte, devEUI []byte) error {
+	m.InPurge.AppEUI = appEUI
+	m.InPurge.DevEUIs = append(m.InPurge.DevEUIs, devEUI)
+	return m.Failures["purge"]
+}
+
 // peek implements the PktStorage interface
 func (m *MockPktStorage) peek(appEUI []byte, devEUI []byte) (pktEntry, error) {
 	m.InPeek.AppEUI = appEUI
@@ -4,6 +4,7 @@
 package handler
 
 import (
+	"bytes"
 	"encoding"
 	"sync"
 	"time"
@@ -11,18 +12,31 @@ import (
 	dbutil "github.com/TheThingsNetwork/ttn/core/storage"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
 	"github.com/TheThingsNetwork/ttn/utils/readwriter"
+	"github.com/brocaar/lorawan"
 )
 
 // PktStorage gives a facade to manipulate the handler packets database
 type PktStorage interface {
 	enqueue(entry pktEntry) error
+	enqueueUnique(entry pktEntry) (bool, error)
 	dequeue(appEUI []byte, devEUI []byte) (pktEntry, error)
+	requeue(entry pktEntry) error
 	peek(appEUI []byte, devEUI []byte) (pktEntry, error)
+	enqueueMAC(appEUI []byte, devEUI []byte, cmd lorawan.MACCommand) error
+	peekMAC(appEUI []byte, devEUI []byte, maxLen int) ([]lorawan.MACCommand, error)
+	commitMAC(appEUI []byte, devEUI []byte, n int) error
+	purge(appEUI []byte, devEUI []byte) error
 	done() error
 }
 
 const dbPackets = "packets"
 
+// bucketMAC holds the MAC commands queues, aside from the packets queues
+var bucketMAC = []byte("mac")
+
+// maxFOptsLen is the maximum number of bytes of MAC commands a frame header can carry
+const maxFOptsLen = 15
+
 type pktStorage struct {
 	sync.RWMutex
 	size uint
@@ -36,9 +50,13 @@ type pktEntry struct {
 	TTL     time.Time
 }
 
-// NewPktStorage creates a new PktStorage
-func NewPktStorage(name string, size uint) (PktStorage, error) {
-	itf, err := dbutil.New(name)
+type macEntry struct {
+	Command []byte
+}
+
+// NewPktStorage creates a new PktStorage, optionally wrapped (e.g. cached)
+func NewPktStorage(name string, size uint, wrappers ...dbutil.Wrapper) (PktStorage, error) {
+	itf, err := dbutil.New(name, wrappers...)
 	if err != nil {
 		return nil, errors.New(errors.Operational, err)
 	}
@@ -67,23 +85,39 @@ func pop(entries []pktEntry) (pktEntry, []encoding.BinaryMarshaler) {
 
 // enqueue implements the PktStorage interface
 func (s *pktStorage) enqueue(entry pktEntry) error {
+	_, err := s.push(entry, false)
+	return err
+}
+
+// enqueueUnique implements the PktStorage interface
+//
+// The entry is discarded if its payload is identical to the one of the most recently queued
+// and still valid entry for the same device. It returns whether the entry has been queued.
+func (s *pktStorage) enqueueUnique(entry pktEntry) (bool, error) {
+	return s.push(entry, true)
+}
+
+func (s *pktStorage) push(entry pktEntry, unique bool) (bool, error) {
 	s.Lock()
 	defer s.Unlock()
 	itf, err := s.db.Read(entry.DevEUI, &pktEntry{}, entry.AppEUI)
 	if err != nil && err.(errors.Failure).Nature != errors.NotFound {
-		return err
+		return false, err
 	}
 	var entries []pktEntry
 	if itf != nil {
 		entries = filterExpired(itf.([]pktEntry))
 	}
+	if unique && len(entries) > 0 && bytes.Equal(entries[len(entries)-1].Payload, entry.Payload) {
+		return false, nil
+	}
 	if len(entries) >= int(s.size) {
 		_, tail := pop(entries)
-		return s.db.Update(entry.DevEUI, append(tail, entry), entry.AppEUI)
+		return true, s.db.Update(entry.DevEUI, append(tail, entry), entry.AppEUI)
 	}
 	// NOTE: We append, even if there're still expired entries, we'll filter them
 	// during dequeuing
-	return s.db.Append(entry.DevEUI, []encoding.BinaryMarshaler{entry}, entry.AppEUI)
+	return true, s.db.Append(entry.DevEUI, []encoding.BinaryMarshaler{entry}, entry.AppEUI)
 }
 
 // dequeue implements the PktStorage interface
@@ -116,6 +150,31 @@ func (s *pktStorage) dequeue(appEUI []byte, devEUI []byte) (pktEntry, error) {
 	return head, nil
 }
 
+// requeue implements the PktStorage interface
+//
+// It puts back at the head of the queue an entry which couldn't be delivered after being dequeued.
+// The entry is discarded if the queue filled up meanwhile, as it would be the first one evicted.
+func (s *pktStorage) requeue(entry pktEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	itf, err := s.db.Read(entry.DevEUI, &pktEntry{}, entry.AppEUI)
+	if err != nil && err.(errors.Failure).Nature != errors.NotFound {
+		return err
+	}
+	var entries []pktEntry
+	if itf != nil {
+		entries = filterExpired(itf.([]pktEntry))
+	}
+	if len(entries) >= int(s.size) {
+		return nil
+	}
+	replaces := []encoding.BinaryMarshaler{entry}
+	for _, e := range entries {
+		replaces = append(replaces, e)
+	}
+	return s.db.Update(entry.DevEUI, replaces, entry.AppEUI)
+}
+
 // peek implements the PktStorage interface
 func (s *pktStorage) peek(appEUI []byte, devEUI []byte) (pktEntry, error) {
 	s.RLock()
@@ -131,6 +190,101 @@ func (s *pktStorage) peek(appEUI []byte, devEUI []byte) (pktEntry, error) {
 	return entries[0], nil
 }
 
+// macLen gives the number of bytes the given MAC commands take in a frame header
+func macLen(cmds []lorawan.MACCommand) int {
+	var n int
+	for _, cmd := range cmds {
+		if data, err := cmd.MarshalBinary(); err == nil {
+			n += len(data)
+		}
+	}
+	return n
+}
+
+// enqueueMAC implements the PktStorage interface
+func (s *pktStorage) enqueueMAC(appEUI []byte, devEUI []byte, cmd lorawan.MACCommand) error {
+	data, err := cmd.MarshalBinary()
+	if err != nil {
+		return errors.New(errors.Structural, err)
+	}
+	if len(data) > maxFOptsLen {
+		return errors.New(errors.Structural, "MAC command too long")
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.db.Append(devEUI, []encoding.BinaryMarshaler{macEntry{Command: data}}, bucketMAC, appEUI)
+}
+
+// peekMAC implements the PktStorage interface
+//
+// Commands are given in the order they were queued, as many as fit in maxLen bytes. The first one
+// which doesn't fit and all the following ones are left aside. Nothing is removed from the queue
+// until commitMAC is called, once the commands are actually sent.
+func (s *pktStorage) peekMAC(appEUI []byte, devEUI []byte, maxLen int) ([]lorawan.MACCommand, error) {
+	s.RLock()
+	defer s.RUnlock()
+	itf, err := s.db.Read(devEUI, &macEntry{}, bucketMAC, appEUI)
+	if err != nil {
+		if err.(errors.Failure).Nature == errors.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var cmds []lorawan.MACCommand
+	var size int
+	for _, e := range itf.([]macEntry) {
+		if size+len(e.Command) > maxLen {
+			break
+		}
+		var cmd lorawan.MACCommand
+		if err := cmd.UnmarshalBinary(false, e.Command); err != nil {
+			return nil, errors.New(errors.Structural, err)
+		}
+		cmds = append(cmds, cmd)
+		size += len(e.Command)
+	}
+	return cmds, nil
+}
+
+// commitMAC implements the PktStorage interface
+//
+// It removes the n first commands of the queue, as previously given by peekMAC. Commands are only
+// ever appended, so the ones queued meanwhile are kept.
+func (s *pktStorage) commitMAC(appEUI []byte, devEUI []byte, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	itf, err := s.db.Read(devEUI, &macEntry{}, bucketMAC, appEUI)
+	if err != nil {
+		return err
+	}
+	entries := itf.([]macEntry)
+	if n > len(entries) {
+		n = len(entries)
+	}
+
+	var tail []encoding.BinaryMarshaler
+	for _, e := range entries[n:] {
+		tail = append(tail, e)
+	}
+	return s.db.Update(devEUI, tail, bucketMAC, appEUI)
+}
+
+// purge implements the PktStorage interface
+//
+// It drops the packets and MAC commands queued for a device, once it is deleted
+func (s *pktStorage) purge(appEUI []byte, devEUI []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.db.Delete(devEUI, appEUI); err != nil {
+		return err
+	}
+	return s.db.Delete(devEUI, bucketMAC, appEUI)
+}
+
 // done implements the PktStorage interface
 func (s *pktStorage) done() error {
 	return s.db.Close()
@@ -168,3 +322,20 @@ func (e *pktEntry) UnmarshalBinary(data []byte) error {
 	rw.TryRead(func(data []byte) error { return e.TTL.UnmarshalBinary(data) })
 	return rw.Err()
 }
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface
+func (e macEntry) MarshalBinary() ([]byte, error) {
+	rw := readwriter.New(nil)
+	rw.Write(e.Command)
+	return rw.Bytes()
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface
+func (e *macEntry) UnmarshalBinary(data []byte) error {
+	rw := readwriter.New(data)
+	rw.Read(func(data []byte) {
+		e.Command = make([]byte, len(data))
+		copy(e.Command, data)
+	})
+	return rw.Err()
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	"github.com/brocaar/lorawan"
 )
 
 const pktDB = "TestPktStorage.db"
@@ -197,9 +198,202 @@ func TestPullSize2(t *testing.T) {
 
 	// ------------------
 
+	{
+		Desc(t, "Queue the same payload twice, unique")
+		entry1 := pktEntry{AppEUI: []byte{1, 2}, DevEUI: []byte{5, 6}, TTL: time.Now().Add(time.Hour), Payload: []byte{14, 42}}
+		entry2 := pktEntry{AppEUI: []byte{1, 2}, DevEUI: []byte{5, 6}, TTL: time.Now().Add(time.Hour), Payload: []byte{14, 42}}
+		queued1, err := db.enqueueUnique(entry1)
+		FatalUnless(t, err)
+		queued2, err := db.enqueueUnique(entry2)
+		FatalUnless(t, err)
+		got, err := db.dequeue(entry1.AppEUI, entry1.DevEUI)
+		FatalUnless(t, err)
+		_, err = db.dequeue(entry1.AppEUI, entry1.DevEUI)
+		CheckErrors(t, ErrNotFound, err)
+		Check(t, true, queued1, "Queued flags")
+		Check(t, false, queued2, "Queued flags")
+		Check(t, entry1, got, "Packet Entries")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Queue two different payloads, unique")
+		entry1 := pktEntry{AppEUI: []byte{1, 2}, DevEUI: []byte{5, 6}, TTL: time.Now().Add(time.Hour), Payload: []byte{14, 42}}
+		entry2 := pktEntry{AppEUI: []byte{1, 2}, DevEUI: []byte{5, 6}, TTL: time.Now().Add(time.Hour), Payload: []byte{42, 14}}
+		queued1, err := db.enqueueUnique(entry1)
+		FatalUnless(t, err)
+		queued2, err := db.enqueueUnique(entry2)
+		FatalUnless(t, err)
+		got1, err := db.dequeue(entry1.AppEUI, entry1.DevEUI)
+		FatalUnless(t, err)
+		got2, err := db.dequeue(entry1.AppEUI, entry1.DevEUI)
+		FatalUnless(t, err)
+		Check(t, true, queued1, "Queued flags")
+		Check(t, true, queued2, "Queued flags")
+		Check(t, entry1, got1, "Packet Entries")
+		Check(t, entry2, got2, "Packet Entries")
+	}
+
+	// ------------------
+
 	{
 		Desc(t, "Close")
 		err := db.done()
 		CheckErrors(t, nil, err)
 	}
 }
+
+func TestMACQueue(t *testing.T) {
+	db, err := NewPktStorage(path.Join(os.TempDir(), pktDB), 1)
+	FatalUnless(t, err)
+	defer func() {
+		db.done()
+		os.Remove(path.Join(os.TempDir(), pktDB))
+	}()
+	appEUI, devEUI := []byte{1, 2}, []byte{3, 4}
+	linkADR := func(dataRate uint8) lorawan.MACCommand {
+		return lorawan.MACCommand{
+			CID: lorawan.LinkADRReq,
+			Payload: &lorawan.LinkADRReqPayload{
+				DataRate:   dataRate,
+				ChMask:     lorawan.ChMask{true, true, true},
+				Redundancy: lorawan.Redundancy{NbRep: 1},
+			},
+		}
+	}
+	devStatus := lorawan.MACCommand{CID: lorawan.DevStatusReq}
+
+	// ------------------
+
+	{
+		Desc(t, "Peek an empty MAC queue")
+		got, err := db.peekMAC(appEUI, devEUI, maxFOptsLen)
+		CheckErrors(t, nil, err)
+		Check(t, []lorawan.MACCommand(nil), got, "MAC commands")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Queue four, peek and commit in order as many as fit")
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI, linkADR(1))) // 5 bytes
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI, devStatus))  // 1 byte
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI, linkADR(2))) // 5 bytes
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI, devStatus))  // 1 byte
+
+		got1, err := db.peekMAC(appEUI, devEUI, 10)
+		FatalUnless(t, err)
+		FatalUnless(t, db.commitMAC(appEUI, devEUI, len(got1)))
+		got2, err := db.peekMAC(appEUI, devEUI, 10)
+		FatalUnless(t, err)
+		FatalUnless(t, db.commitMAC(appEUI, devEUI, len(got2)))
+		got3, err := db.peekMAC(appEUI, devEUI, 10)
+		FatalUnless(t, err)
+
+		Check(t, []lorawan.MACCommand{linkADR(1), devStatus}, got1, "MAC commands")
+		Check(t, []lorawan.MACCommand{linkADR(2), devStatus}, got2, "MAC commands")
+		Check(t, []lorawan.MACCommand(nil), got3, "MAC commands")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Keep a command which doesn't fit")
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI, linkADR(3)))
+
+		got1, err := db.peekMAC(appEUI, devEUI, 4)
+		FatalUnless(t, err)
+		FatalUnless(t, db.commitMAC(appEUI, devEUI, len(got1)))
+		got2, err := db.peekMAC(appEUI, devEUI, maxFOptsLen)
+		FatalUnless(t, err)
+		FatalUnless(t, db.commitMAC(appEUI, devEUI, len(got2)))
+
+		Check(t, []lorawan.MACCommand(nil), got1, "MAC commands")
+		Check(t, []lorawan.MACCommand{linkADR(3)}, got2, "MAC commands")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Keep peeked commands until committed")
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI, linkADR(4)))
+
+		got1, err := db.peekMAC(appEUI, devEUI, maxFOptsLen)
+		FatalUnless(t, err)
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI, devStatus)) // Queued meanwhile
+		got2, err := db.peekMAC(appEUI, devEUI, maxFOptsLen)
+		FatalUnless(t, err)
+		FatalUnless(t, db.commitMAC(appEUI, devEUI, len(got1)))
+		got3, err := db.peekMAC(appEUI, devEUI, maxFOptsLen)
+		FatalUnless(t, err)
+		FatalUnless(t, db.commitMAC(appEUI, devEUI, len(got3)))
+
+		Check(t, []lorawan.MACCommand{linkADR(4)}, got1, "MAC commands")
+		Check(t, []lorawan.MACCommand{linkADR(4), devStatus}, got2, "MAC commands")
+		Check(t, []lorawan.MACCommand{devStatus}, got3, "MAC commands")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Queues of packets and MAC commands are distinct")
+		entry := pktEntry{AppEUI: appEUI, DevEUI: devEUI, TTL: time.Now().Add(time.Hour), Payload: []byte{14, 42}}
+		FatalUnless(t, db.enqueue(entry))
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI, devStatus))
+
+		gotPkt, err := db.dequeue(appEUI, devEUI)
+		FatalUnless(t, err)
+		gotMAC, err := db.peekMAC(appEUI, devEUI, maxFOptsLen)
+		FatalUnless(t, err)
+
+		Check(t, entry, gotPkt, "Packet Entries")
+		Check(t, []lorawan.MACCommand{devStatus}, gotMAC, "MAC commands")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	db, err := NewPktStorage(path.Join(os.TempDir(), pktDB), 1)
+	FatalUnless(t, err)
+	defer func() {
+		db.done()
+		os.Remove(path.Join(os.TempDir(), pktDB))
+	}()
+	appEUI, devEUI1, devEUI2 := []byte{1, 2}, []byte{3, 4}, []byte{5, 6}
+	devStatus := lorawan.MACCommand{CID: lorawan.DevStatusReq}
+
+	// ------------------
+
+	{
+		Desc(t, "Purge the queues of a device only")
+		entry1 := pktEntry{AppEUI: appEUI, DevEUI: devEUI1, TTL: time.Now().Add(time.Hour), Payload: []byte{14, 42}}
+		entry2 := pktEntry{AppEUI: appEUI, DevEUI: devEUI2, TTL: time.Now().Add(time.Hour), Payload: []byte{14, 43}}
+		FatalUnless(t, db.enqueue(entry1))
+		FatalUnless(t, db.enqueue(entry2))
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI1, devStatus))
+		FatalUnless(t, db.enqueueMAC(appEUI, devEUI2, devStatus))
+
+		err := db.purge(appEUI, devEUI1)
+		_, errPkt1 := db.peek(appEUI, devEUI1)
+		gotMAC1, errMAC1 := db.peekMAC(appEUI, devEUI1, maxFOptsLen)
+		gotPkt2, errPkt2 := db.peek(appEUI, devEUI2)
+		gotMAC2, errMAC2 := db.peekMAC(appEUI, devEUI2, maxFOptsLen)
+
+		CheckErrors(t, nil, err)
+		CheckErrors(t, ErrNotFound, errPkt1)
+		CheckErrors(t, nil, errMAC1)
+		Check(t, []lorawan.MACCommand(nil), gotMAC1, "MAC commands")
+		CheckErrors(t, nil, errPkt2)
+		Check(t, entry2, gotPkt2, "Packet Entries")
+		CheckErrors(t, nil, errMAC2)
+		Check(t, []lorawan.MACCommand{devStatus}, gotMAC2, "MAC commands")
+	}
+
+	// ------------------
+
+	{
+		Desc(t, "Purge the queues of a device without queues")
+		err := db.purge(appEUI, []byte{7, 8})
+		CheckErrors(t, nil, err)
+	}
+}
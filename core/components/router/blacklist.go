@@ -0,0 +1,48 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"sync"
+
+	"github.com/TheThingsNetwork/ttn/core/types"
+)
+
+// blacklist holds the gateways from which traffic is no longer forwarded
+type blacklist struct {
+	sync.RWMutex
+	gateways map[types.GatewayEUI]bool
+}
+
+// newBlacklist constructs an empty blacklist
+func newBlacklist() *blacklist {
+	return &blacklist{gateways: make(map[types.GatewayEUI]bool)}
+}
+
+// contains checks whether the given gateway identifier is blacklisted
+func (b *blacklist) contains(gid []byte) bool {
+	var eui types.GatewayEUI
+	if len(gid) != len(eui) {
+		return false
+	}
+	copy(eui[:], gid)
+
+	b.RLock()
+	defer b.RUnlock()
+	return b.gateways[eui]
+}
+
+// BlacklistGateway implements the router.Server interface
+func (r component) BlacklistGateway(eui types.GatewayEUI) {
+	r.blacklist.Lock()
+	defer r.blacklist.Unlock()
+	r.blacklist.gateways[eui] = true
+}
+
+// WhitelistGateway implements the router.Server interface
+func (r component) WhitelistGateway(eui types.GatewayEUI) {
+	r.blacklist.Lock()
+	defer r.blacklist.Unlock()
+	delete(r.blacklist.gateways, eui)
+}
@@ -0,0 +1,37 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"sync/atomic"
+)
+
+// Stats gives an aggregated view of the traffic handled by the router since it started
+type Stats struct {
+	UplinksIn          uint64 // Uplinks received from gateways
+	DownlinksOut       uint64 // Downlinks and join-accepts sent back to gateways
+	JoinsAccepted      uint64 // Join requests answered with a join-accept
+	JoinsRejected      uint64 // Join requests that got no join-accept
+	BrokersUnreachable uint64 // Broker requests that failed for other reason than the broker not being responsible or turning them down
+}
+
+// counters holds the router traffic counters, safe for concurrent use
+type counters struct {
+	uplinksIn          uint64
+	downlinksOut       uint64
+	joinsAccepted      uint64
+	joinsRejected      uint64
+	brokersUnreachable uint64
+}
+
+// Stats implements the router.Server interface
+func (r component) Stats() Stats {
+	return Stats{
+		UplinksIn:          atomic.LoadUint64(&r.counters.uplinksIn),
+		DownlinksOut:       atomic.LoadUint64(&r.counters.downlinksOut),
+		JoinsAccepted:      atomic.LoadUint64(&r.counters.joinsAccepted),
+		JoinsRejected:      atomic.LoadUint64(&r.counters.joinsRejected),
+		BrokersUnreachable: atomic.LoadUint64(&r.counters.brokersUnreachable),
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	"github.com/TheThingsNetwork/ttn/utils/stats"
+)
+
+// StatusReport is a gateway status report, as received by the router
+type StatusReport struct {
+	Time     time.Time
+	Metadata core.StatsMetadata
+}
+
+// gatewayStatus holds the last status reports of a gateway in a ring buffer
+type gatewayStatus struct {
+	lastSeen time.Time
+	reports  []StatusReport
+	next     int       // Index of the slot to overwrite once the buffer is full
+	tokens   float64   // Reports the gateway may still send before being rate limited
+	refilled time.Time // Last time tokens were added
+}
+
+// gatewayRegistry remembers the recent status reports of each gateway
+type gatewayRegistry struct {
+	sync.RWMutex
+	historySize int
+	rate        float64 // Reports accepted per second and per gateway, 0 means no limit
+	burst       float64 // Reports accepted in a row before the rate applies
+	gateways    map[types.GatewayEUI]*gatewayStatus
+}
+
+// newGatewayRegistry constructs an empty gateway registry keeping historySize reports per gateway
+// and accepting rate reports per second from each of them, after an initial burst
+func newGatewayRegistry(historySize int, rate float64, burst uint) *gatewayRegistry {
+	return &gatewayRegistry{
+		historySize: historySize,
+		rate:        rate,
+		burst:       float64(burst),
+		gateways:    make(map[types.GatewayEUI]*gatewayStatus),
+	}
+}
+
+// take consumes a token from the bucket of a gateway, refilled at the given rate up to burst
+func (s *gatewayStatus) take(t time.Time, rate float64, burst float64) bool {
+	if rate <= 0 {
+		return true
+	}
+	if s.refilled.IsZero() {
+		s.tokens = burst
+	} else if elapsed := t.Sub(s.refilled).Seconds(); elapsed > 0 {
+		s.tokens += elapsed * rate
+		if s.tokens > burst {
+			s.tokens = burst
+		}
+	}
+	s.refilled = t
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// record stores a status report from the given gateway. When the gateway exceeds the accepted
+// rate, the report replaces the newest one instead and record returns false.
+func (g *gatewayRegistry) record(gid []byte, t time.Time, metadata core.StatsMetadata) bool {
+	var eui types.GatewayEUI
+	copy(eui[:], gid)
+
+	g.Lock()
+	defer g.Unlock()
+	status, ok := g.gateways[eui]
+	if !ok {
+		status = new(gatewayStatus)
+		g.gateways[eui] = status
+	}
+	status.lastSeen = t
+
+	report := StatusReport{Time: t, Metadata: metadata}
+	if !status.take(t, g.rate, g.burst) && len(status.reports) > 0 {
+		// The newest report sits right before the next slot to overwrite
+		size := len(status.reports)
+		status.reports[(status.next-1+size)%size] = report
+		return false
+	}
+	if len(status.reports) < g.historySize {
+		status.reports = append(status.reports, report)
+		return true
+	}
+	status.reports[status.next] = report
+	status.next = (status.next + 1) % g.historySize
+	return true
+}
+
+// history gives at most the n last status reports of a gateway, newest first
+func (g *gatewayRegistry) history(eui types.GatewayEUI, n int) []StatusReport {
+	g.RLock()
+	defer g.RUnlock()
+	status, ok := g.gateways[eui]
+	if !ok {
+		return nil
+	}
+	size := len(status.reports)
+	if n > size {
+		n = size
+	}
+	var reports []StatusReport
+	for i := 1; i <= n; i++ {
+		// The newest report sits right before the next slot to overwrite
+		reports = append(reports, status.reports[(status.next-i+size)%size])
+	}
+	return reports
+}
+
+// countSince gives the number of gateways which reported their status after the given time
+func (g *gatewayRegistry) countSince(t time.Time) uint {
+	g.RLock()
+	defer g.RUnlock()
+	var n uint
+	for _, status := range g.gateways {
+		if status.lastSeen.After(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// sweep forgets the gateways which haven't reported their status since the given time, and
+// gives how many were evicted
+func (g *gatewayRegistry) sweep(before time.Time) int {
+	g.Lock()
+	defer g.Unlock()
+	var n int
+	for eui, status := range g.gateways {
+		if status.lastSeen.Before(before) {
+			delete(g.gateways, eui)
+			n++
+		}
+	}
+	return n
+}
+
+// StartSweeper implements the router.Server interface. Every interval, it evicts the gateways
+// which haven't reported their status for longer than threshold. The returned function stops it.
+func (r component) StartSweeper(interval time.Duration, threshold time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if n := r.gateways.sweep(time.Now().Add(-threshold)); n > 0 {
+					stats.MarkMeter("router.gateways.evicted")
+					r.Ctx.WithField("Evicted", n).Debug("Evict stale gateways")
+				}
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// GatewayHistory implements the router.Server interface
+func (r component) GatewayHistory(eui types.GatewayEUI, n int) []StatusReport {
+	return r.gateways.history(eui, n)
+}
@@ -0,0 +1,370 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+	"github.com/TheThingsNetwork/ttn/core/mocks"
+	"github.com/TheThingsNetwork/ttn/core/types"
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	"github.com/brocaar/lorawan"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestGatewayHistory(t *testing.T) {
+	gid := types.GatewayEUI{1, 2, 3, 4, 5, 6, 7, 8}
+	newRouter := func(t *testing.T) Server {
+		return New(Components{
+			Ctx:        GetLogger(t, "Router"),
+			BrkStorage: NewMockBrkStorage(),
+			GtwStorage: NewMockGtwStorage(),
+		}, Options{StatusHistory: 3})
+	}
+	report := func(t *testing.T, r Server, altitudes ...int32) {
+		for _, altitude := range altitudes {
+			_, err := r.HandleStats(context.Background(), &core.StatsReq{
+				GatewayID: gid.Bytes(),
+				Metadata:  &core.StatsMetadata{Altitude: altitude},
+			})
+			FatalUnless(t, err)
+		}
+	}
+	altitudes := func(reports []StatusReport) []int32 {
+		var altitudes []int32
+		for _, r := range reports {
+			altitudes = append(altitudes, r.Metadata.Altitude)
+		}
+		return altitudes
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Unknown gateway")
+
+		// Build
+		r := newRouter(t)
+
+		// Expect
+		var want []StatusReport
+
+		// Operate
+		got := r.GatewayHistory(gid, 3)
+
+		// Check
+		Check(t, want, got, "Status Reports")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Fewer reports than the history size")
+
+		// Build
+		r := newRouter(t)
+		report(t, r, 1, 2)
+
+		// Expect
+		var want = []int32{2, 1}
+
+		// Operate
+		got := r.GatewayHistory(gid, 3)
+
+		// Check
+		Check(t, want, altitudes(got), "Status Reports")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "More reports than the history size")
+
+		// Build
+		r := newRouter(t)
+		report(t, r, 1, 2, 3, 4, 5)
+
+		// Expect
+		var want = []int32{5, 4, 3}
+
+		// Operate
+		got := r.GatewayHistory(gid, 10)
+
+		// Check
+		Check(t, want, altitudes(got), "Status Reports")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Ask for fewer reports than available")
+
+		// Build
+		r := newRouter(t)
+		report(t, r, 1, 2, 3, 4)
+
+		// Expect
+		var want = []int32{4, 3}
+
+		// Operate
+		got := r.GatewayHistory(gid, 2)
+
+		// Check
+		Check(t, want, altitudes(got), "Status Reports")
+		Check(t, true, !got[0].Time.Before(got[1].Time), "Report times")
+	}
+}
+
+func TestStatusRateLimit(t *testing.T) {
+	gid := types.GatewayEUI{1, 2, 3, 4, 5, 6, 7, 8}
+	altitudes := func(reports []StatusReport) []int32 {
+		var altitudes []int32
+		for _, r := range reports {
+			altitudes = append(altitudes, r.Metadata.Altitude)
+		}
+		return altitudes
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Reports sent faster than the rate are coalesced")
+
+		// Build
+		st := NewMockGtwStorage()
+		r := New(Components{
+			Ctx:        GetLogger(t, "Router"),
+			BrkStorage: NewMockBrkStorage(),
+			GtwStorage: st,
+		}, Options{StatusHistory: 10, StatusRate: 1, StatusBurst: 2})
+
+		// Expect
+		var want = []int32{5, 1}
+		var wantStored int32 = 2
+
+		// Operate
+		for altitude := int32(1); altitude <= 5; altitude++ {
+			_, err := r.HandleStats(context.Background(), &core.StatsReq{
+				GatewayID: gid.Bytes(),
+				Metadata:  &core.StatsMetadata{Altitude: altitude},
+			})
+			FatalUnless(t, err)
+		}
+		got := r.GatewayHistory(gid, 10)
+
+		// Check
+		Check(t, want, altitudes(got), "Status Reports")
+		Check(t, wantStored, st.InUpsert.Entry.Metadata.Altitude, "Stored Status")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Reports are accepted again once the bucket refilled")
+
+		// Build
+		g := newGatewayRegistry(10, 1, 1)
+		now := time.Now()
+
+		// Expect
+		var wantAccepted = []bool{true, false, true}
+		var want = []int32{3, 2}
+
+		// Operate
+		var accepted []bool
+		accepted = append(accepted, g.record(gid.Bytes(), now, core.StatsMetadata{Altitude: 1}))
+		accepted = append(accepted, g.record(gid.Bytes(), now.Add(100*time.Millisecond), core.StatsMetadata{Altitude: 2}))
+		accepted = append(accepted, g.record(gid.Bytes(), now.Add(1200*time.Millisecond), core.StatsMetadata{Altitude: 3}))
+		got := g.history(gid, 10)
+
+		// Check
+		Check(t, wantAccepted, accepted, "Accepted Reports")
+		Check(t, want, altitudes(got), "Status Reports")
+	}
+}
+
+func TestGatewaySweep(t *testing.T) {
+	gid1 := types.GatewayEUI{1, 2, 3, 4, 5, 6, 7, 8}
+	gid2 := types.GatewayEUI{8, 7, 6, 5, 4, 3, 2, 1}
+
+	{
+		Desc(t, "Sweep a stale and a fresh gateway")
+
+		// Build
+		g := newGatewayRegistry(3, 0, 0)
+		now := time.Now()
+		g.record(gid1.Bytes(), now.Add(-2*time.Hour), core.StatsMetadata{Altitude: 1})
+		g.record(gid2.Bytes(), now, core.StatsMetadata{Altitude: 2})
+
+		// Expect
+		var wantEvicted = 1
+		var wantHistory1 []StatusReport
+		var wantHistory2 = []StatusReport{{Time: now, Metadata: core.StatsMetadata{Altitude: 2}}}
+
+		// Operate
+		evicted := g.sweep(now.Add(-time.Hour))
+
+		// Check
+		Check(t, wantEvicted, evicted, "Evicted gateways")
+		Check(t, wantHistory1, g.history(gid1, 3), "Status Reports")
+		Check(t, wantHistory2, g.history(gid2, 3), "Status Reports")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Background sweeper evicts a gateway which stopped reporting")
+
+		// Build
+		r := New(Components{
+			Ctx:        GetLogger(t, "Router"),
+			BrkStorage: NewMockBrkStorage(),
+			GtwStorage: NewMockGtwStorage(),
+		}, Options{})
+		_, err := r.HandleStats(context.Background(), &core.StatsReq{
+			GatewayID: gid1.Bytes(),
+			Metadata:  &core.StatsMetadata{Altitude: 1},
+		})
+		FatalUnless(t, err)
+
+		// Expect
+		var wantBefore = 1
+		var wantAfter []StatusReport
+
+		// Operate
+		before := len(r.GatewayHistory(gid1, 1))
+		stop := r.StartSweeper(10*time.Millisecond, 20*time.Millisecond)
+		<-time.After(100 * time.Millisecond)
+		stop()
+		after := r.GatewayHistory(gid1, 1)
+
+		// Check
+		Check(t, wantBefore, before, "Status Reports")
+		Check(t, wantAfter, after, "Status Reports")
+	}
+}
+
+// silentBrokerClient is a broker which never answers with a downlink and keeps no state, so it can
+// be used concurrently
+type silentBrokerClient struct {
+	*mocks.AuthBrokerClient
+}
+
+// HandleData implements the core.BrokerClient interface
+func (m silentBrokerClient) HandleData(ctx context.Context, in *core.DataBrokerReq, opts ...grpc.CallOption) (*core.DataBrokerRes, error) {
+	return nil, nil
+}
+
+func TestConcurrentGateways(t *testing.T) {
+	brokersDB := path.Join(os.TempDir(), "TestConcurrentGatewaysBrokers.db")
+	gatewaysDB := path.Join(os.TempDir(), "TestConcurrentGatewaysGateways.db")
+	dutyDB := path.Join(os.TempDir(), "TestConcurrentGatewaysDuty.db")
+	defer func() {
+		os.Remove(brokersDB)
+		os.Remove(gatewaysDB)
+		os.Remove(dutyDB)
+	}()
+
+	{
+		Desc(t, "Handle uplinks and status reports of overlapping gateways concurrently")
+
+		// Build
+		bs, err := NewBrkStorage(brokersDB, time.Hour)
+		FatalUnless(t, err)
+		defer bs.done()
+		gs, err := NewGtwStorage(gatewaysDB)
+		FatalUnless(t, err)
+		defer gs.done()
+		dm, err := dutycycle.NewManager(dutyDB, time.Hour, dutycycle.Europe)
+		FatalUnless(t, err)
+		defer dm.Close()
+		r := New(Components{
+			DutyManager: dm,
+			Brokers:     []core.BrokerClient{silentBrokerClient{mocks.NewAuthBrokerClient()}},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  bs,
+			GtwStorage:  gs,
+		}, Options{StatusHistory: 5})
+		gateways := []types.GatewayEUI{
+			{1, 1, 1, 1, 1, 1, 1, 1},
+			{2, 2, 2, 2, 2, 2, 2, 2},
+			{3, 3, 3, 3, 3, 3, 3, 3},
+		}
+		newDataReq := func(gid types.GatewayEUI, fcnt uint32) *core.DataRouterReq {
+			return &core.DataRouterReq{
+				Payload: &core.LoRaWANData{
+					MHDR: &core.LoRaWANMHDR{
+						MType: uint32(lorawan.UnconfirmedDataUp),
+						Major: uint32(lorawan.LoRaWANR1),
+					},
+					MACPayload: &core.LoRaWANMACPayload{
+						FHDR: &core.LoRaWANFHDR{
+							DevAddr: []byte{1, 2, 3, 4},
+							FCnt:    fcnt,
+							FCtrl:   new(core.LoRaWANFCtrl),
+						},
+						FPort:      1,
+						FRMPayload: []byte{14, 14, 42, 42},
+					},
+					MIC: []byte{4, 3, 2, 1},
+				},
+				Metadata: &core.Metadata{
+					Frequency: 868.5,
+				},
+				GatewayID: gid.Bytes(),
+			}
+		}
+
+		// Expect
+		var wantErrors int
+		var wantUplinks uint64 = 8 * 20
+		var wantGateways uint = 3
+
+		// Operate
+		var wg sync.WaitGroup
+		errs := make(chan error, 8*20*2)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					gid := gateways[(i+j)%len(gateways)]
+					if _, err := r.HandleStats(context.Background(), &core.StatsReq{
+						GatewayID: gid.Bytes(),
+						Metadata:  &core.StatsMetadata{Altitude: int32(j)},
+					}); err != nil {
+						errs <- err
+					}
+					if _, err := r.HandleData(context.Background(), newDataReq(gid, uint32(j))); err != nil {
+						errs <- err
+					}
+					r.BlacklistGateway(types.GatewayEUI{9, 9, 9, 9, 9, 9, 9, byte(i)})
+					r.WhitelistGateway(types.GatewayEUI{9, 9, 9, 9, 9, 9, 9, byte(i)})
+					_ = r.GatewayHistory(gid, 5)
+					_ = r.Stats()
+					_ = r.Healthy()
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		var nbErrors int
+		for err := range errs {
+			t.Logf("Unexpected error: %s", err)
+			nbErrors++
+		}
+
+		// Check
+		Check(t, wantErrors, nbErrors, "Errors")
+		Check(t, wantUplinks, r.Stats().UplinksIn, "Uplinks")
+		Check(t, wantGateways, r.(component).gateways.countSince(time.Time{}), "Gateways")
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+)
+
+// Healthy implements the router.Server interface
+func (r component) Healthy() error {
+	if len(r.Brokers) == 0 {
+		return errors.New(errors.Operational, "No broker configured")
+	}
+	if r.MinGateways == 0 {
+		return nil
+	}
+	if n := r.gateways.countSince(time.Now().Add(-r.GatewayStaleness)); n < r.MinGateways {
+		return errors.New(errors.Operational, fmt.Sprintf("Only %d gateway(s) reported their status in the last %s, %d required", n, r.GatewayStaleness, r.MinGateways))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/core"
+	"github.com/TheThingsNetwork/ttn/utils/errors"
+	"golang.org/x/net/context"
+)
+
+// joinCall materializes a join request forwarded to the brokers, and its outcome once known
+type joinCall struct {
+	done     chan struct{}
+	inFlight bool
+	until    time.Time
+	err      error
+}
+
+// joinSuppressor makes the retransmissions of a join request received from a gateway within a
+// short window share a single broker fan-out. Copies heard by other gateways are keyed apart and
+// still reach the handler, which picks the best gateway to answer through.
+type joinSuppressor struct {
+	sync.Mutex
+	window time.Duration
+	calls  map[string]*joinCall
+}
+
+// newJoinSuppressor constructs a suppressor for the given window
+func newJoinSuppressor(window time.Duration) *joinSuppressor {
+	return &joinSuppressor{window: window, calls: make(map[string]*joinCall)}
+}
+
+// do runs handle unless a request identified by the same key is in flight or got a join-accept
+// within the window. Suppressed requests wait for the outcome of that one and get an empty
+// response, the join-accept being only transmitted once. The returned boolean tells whether the
+// request was suppressed.
+func (s *joinSuppressor) do(bctx context.Context, key string, handle func() (*core.JoinRouterRes, error)) (*core.JoinRouterRes, bool, error) {
+	s.Lock()
+	now := time.Now()
+	for k, c := range s.calls {
+		if !c.inFlight && now.After(c.until) {
+			delete(s.calls, k)
+		}
+	}
+	if c, ok := s.calls[key]; ok {
+		s.Unlock()
+		select {
+		case <-c.done:
+			return new(core.JoinRouterRes), true, c.err
+		case <-bctx.Done():
+			return new(core.JoinRouterRes), true, errors.New(errors.Operational, bctx.Err())
+		}
+	}
+	c := &joinCall{done: make(chan struct{}), inFlight: true}
+	s.calls[key] = c
+	s.Unlock()
+
+	res, err := handle()
+
+	s.Lock()
+	c.err = err
+	c.inFlight = false
+	c.until = time.Now().Add(s.window)
+	if err != nil || res == nil || res.Payload == nil { // No join-accept, let the device try again
+		delete(s.calls, key)
+	}
+	s.Unlock()
+	close(c.done)
+	return res, false, err
+}
@@ -8,10 +8,12 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TheThingsNetwork/ttn/core"
 	"github.com/TheThingsNetwork/ttn/core/dutycycle"
+	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
 	"github.com/TheThingsNetwork/ttn/utils/stats"
 	"github.com/apex/log"
@@ -30,24 +32,75 @@ type Components struct {
 
 // Options defines a structure to make the instantiation easier to read
 type Options struct {
-	NetAddr string
+	NetAddr            string
+	BrokerTimeout      time.Duration // Time after which a broker that hasn't answered is abandoned, defaults to 2s
+	MinGateways        uint          // Gateways that must have reported their status recently for the router to be healthy, 0 means no check
+	GatewayStaleness   time.Duration // Time after which a gateway status report is considered outdated, defaults to 2 minutes
+	JoinSuppression    time.Duration // Time during which further join requests of a device through a gateway aren't forwarded, defaults to 5s
+	StatusHistory      int           // Number of status reports kept per gateway, defaults to 10
+	StatusRate         float64       // Status reports stored per second and per gateway, the excess is coalesced, 0 means no limit
+	StatusBurst        uint          // Status reports a gateway may send in a row before StatusRate applies, defaults to 5
+	MaxConcurrentSends int           // Number of brokers a single packet is forwarded to concurrently, defaults to 16
 }
 
 // component implements the core.RouterServer interface
 type component struct {
 	Components
-	NetAddr string
+	NetAddr            string
+	BrokerTimeout      time.Duration
+	MinGateways        uint
+	GatewayStaleness   time.Duration
+	MaxConcurrentSends int
+	blacklist          *blacklist
+	counters           *counters
+	gateways           *gatewayRegistry
+	joins              *joinSuppressor
 }
 
 // Server defines the Router Server interface
 type Server interface {
 	core.RouterServer
 	Start() error
+	BlacklistGateway(eui types.GatewayEUI)
+	WhitelistGateway(eui types.GatewayEUI)
+	Stats() Stats
+	Healthy() error
+	GatewayHistory(eui types.GatewayEUI, n int) []StatusReport
+	StartSweeper(interval time.Duration, threshold time.Duration) func()
 }
 
 // New constructs a new router
 func New(c Components, o Options) Server {
-	return component{Components: c, NetAddr: o.NetAddr}
+	if o.BrokerTimeout == 0 {
+		o.BrokerTimeout = 2 * time.Second
+	}
+	if o.GatewayStaleness == 0 {
+		o.GatewayStaleness = 2 * time.Minute
+	}
+	if o.JoinSuppression == 0 {
+		o.JoinSuppression = 5 * time.Second
+	}
+	if o.StatusHistory <= 0 {
+		o.StatusHistory = 10
+	}
+	if o.StatusBurst == 0 {
+		o.StatusBurst = 5
+	}
+	if o.MaxConcurrentSends <= 0 {
+		o.MaxConcurrentSends = 16
+	}
+	return component{
+		Components:         c,
+		NetAddr:            o.NetAddr,
+		BrokerTimeout:      o.BrokerTimeout,
+		MinGateways:        o.MinGateways,
+		GatewayStaleness:   o.GatewayStaleness,
+		MaxConcurrentSends: o.MaxConcurrentSends,
+		blacklist:          newBlacklist(),
+		counters:           new(counters),
+		gateways:           newGatewayRegistry(o.StatusHistory, o.StatusRate, o.StatusBurst),
+		joins:              newJoinSuppressor(o.JoinSuppression),
+	}
 }
 
 // Start actually runs the component and starts the rpc server
@@ -81,6 +134,11 @@ func (r component) HandleStats(ctx context.Context, req *core.StatsReq) (*core.S
 	}
 
 	stats.MarkMeter("router.stat.in")
+	if !r.gateways.record(req.GatewayID, time.Now(), *req.Metadata) {
+		// The gateway reports too often, only keep its last status in memory
+		stats.MarkMeter("router.stat.coalesced")
+		return new(core.StatsRes), nil
+	}
 	return new(core.StatsRes), r.GtwStorage.upsert(gtwEntry{
 		GatewayID: req.GatewayID,
 		Metadata:  *req.Metadata,
@@ -88,7 +146,7 @@ func (r component) HandleStats(ctx context.Context, req *core.StatsReq) (*core.S
 }
 
 // HandleJoin implements the core.RouterClient interface
-func (r component) HandleJoin(_ context.Context, req *core.JoinRouterReq) (routerRes *core.JoinRouterRes, err error) {
+func (r component) HandleJoin(bctx context.Context, req *core.JoinRouterReq) (routerRes *core.JoinRouterRes, err error) {
 	ctx := r.Ctx.WithField("GatewayID", req.GatewayID)
 	stats.MarkMeter("router.join.in")
 
@@ -97,10 +155,10 @@ func (r component) HandleJoin(_ context.Context, req *core.JoinRouterReq) (route
 		return new(core.JoinRouterRes), errors.New(errors.Structural, "Invalid Request")
 	}
 
-	// Update Metadata with Gateway infos
-	req.Metadata, err = r.injectMetadata(req.GatewayID, *req.Metadata)
-	if err != nil {
-		return new(core.JoinRouterRes), err
+	if r.blacklist.contains(req.GatewayID) {
+		stats.MarkMeter("router.join.blacklisted")
+		ctx.Debug("Gateway is blacklisted")
+		return new(core.JoinRouterRes), errors.New(errors.Behavioural, "Blacklisted gateway")
 	}
 
 	ctx = ctx.WithFields(log.Fields{
@@ -108,6 +166,28 @@ func (r component) HandleJoin(_ context.Context, req *core.JoinRouterReq) (route
 		"DevEUI": req.DevEUI,
 	})
 
+	// A device retransmits its join request until it gets a join-accept, forward it only once per
+	// gateway. Copies from other gateways go through, the handler gathers them to pick the best one.
+	key := string(req.AppEUI) + string(req.DevEUI) + string(req.GatewayID)
+	res, suppressed, err := r.joins.do(bctx, key, func() (*core.JoinRouterRes, error) {
+		return r.handleJoin(bctx, ctx, req)
+	})
+	if suppressed {
+		stats.MarkMeter("router.join.suppressed")
+		ctx.Debug("Join request of the device already handled")
+	}
+	return res, err
+}
+
+// handleJoin forwards a join request to the brokers and handles their answer
+func (r component) handleJoin(bctx context.Context, ctx log.Interface, req *core.JoinRouterReq) (*core.JoinRouterRes, error) {
+	// Update Metadata with Gateway infos
+	metadata, err := r.injectMetadata(req.GatewayID, *req.Metadata)
+	if err != nil {
+		return new(core.JoinRouterRes), err
+	}
+	req.Metadata = metadata
+
 	ctx.WithField("Metadata", req.Metadata).Debug("Inject Metadata")
 
 	// Broadcast the join request
@@ -118,8 +198,9 @@ func (r component) HandleJoin(_ context.Context, req *core.JoinRouterReq) (route
 		MIC:      req.MIC,
 		Metadata: req.Metadata,
 	}
-	response, err := r.send(bpacket, true, r.Brokers...)
+	response, err := r.send(bctx, bpacket, true, r.Brokers...)
 	if err != nil {
+		atomic.AddUint64(&r.counters.joinsRejected, 1)
 		return new(core.JoinRouterRes), err
 	}
 
@@ -127,21 +208,25 @@ func (r component) HandleJoin(_ context.Context, req *core.JoinRouterReq) (route
 	res := response.(*core.JoinBrokerRes)
 	if res == nil || res.Payload == nil { // No response
 		ctx.Debug("No join-accept received")
+		atomic.AddUint64(&r.counters.joinsRejected, 1)
 		return new(core.JoinRouterRes), nil
 	}
 	ctx.Debug("Handle join-accept")
+	atomic.AddUint64(&r.counters.joinsAccepted, 1)
 
 	if err := r.handleDown(req.GatewayID, res.Metadata); err != nil {
 		return new(core.JoinRouterRes), err
 	}
+	atomic.AddUint64(&r.counters.downlinksOut, 1)
 	return &core.JoinRouterRes{Payload: res.Payload, Metadata: res.Metadata}, nil
 }
 
 // HandleData implements the core.RouterClient interface
-func (r component) HandleData(_ context.Context, req *core.DataRouterReq) (*core.DataRouterRes, error) {
+func (r component) HandleData(bctx context.Context, req *core.DataRouterReq) (*core.DataRouterRes, error) {
 	// Get some logs / analytics
 	ctx := r.Ctx.WithField("GatewayID", req.GatewayID)
 	stats.MarkMeter("router.uplink.in")
+	atomic.AddUint64(&r.counters.uplinksIn, 1)
 
 	// Validate coming data
 	_, _, fhdr, _, err := core.ValidateLoRaWANData(req.Payload)
@@ -157,6 +242,11 @@ func (r component) HandleData(_ context.Context, req *core.DataRouterReq) (*core
 		ctx.Debug("Invalid request GatewayID")
 		return new(core.DataRouterRes), errors.New(errors.Structural, "Invalid gatewayID")
 	}
+	if r.blacklist.contains(req.GatewayID) {
+		stats.MarkMeter("router.uplink.blacklisted")
+		ctx.Debug("Gateway is blacklisted")
+		return new(core.DataRouterRes), errors.New(errors.Behavioural, "Blacklisted gateway")
+	}
 
 	// Update Metadata with Gateway infos
 	req.Metadata, err = r.injectMetadata(req.GatewayID, *req.Metadata)
@@ -186,7 +276,7 @@ func (r component) HandleData(_ context.Context, req *core.DataRouterReq) (*core
 		// No Recipient available -> broadcast
 		stats.MarkMeter("router.broadcast")
 		ctx.Debug("Broadcast to brokers")
-		response, err = r.send(bpacket, true, r.Brokers...)
+		response, err = r.send(bctx, bpacket, true, r.Brokers...)
 	} else {
 		// Recipients are available
 		stats.MarkMeter("router.send")
@@ -195,11 +285,11 @@ func (r component) HandleData(_ context.Context, req *core.DataRouterReq) (*core
 		for _, e := range entries {
 			brokers = append(brokers, r.Brokers[e.BrokerIndex])
 		}
-		response, err = r.send(bpacket, false, brokers...)
+		response, err = r.send(bctx, bpacket, false, brokers...)
 		if err != nil && err.(errors.Failure).Nature == errors.NotFound {
 			ctx.Debug("Retry with broadcast")
 			// Might be a collision with the dev addr, we better broadcast
-			response, err = r.send(bpacket, true, r.Brokers...)
+			response, err = r.send(bctx, bpacket, true, r.Brokers...)
 		}
 		stats.MarkMeter("router.uplink.out")
 	}
@@ -227,6 +317,7 @@ func (r component) HandleData(_ context.Context, req *core.DataRouterReq) (*core
 	if err := r.handleDown(req.GatewayID, res.Metadata); err != nil {
 		return new(core.DataRouterRes), err
 	}
+	atomic.AddUint64(&r.counters.downlinksOut, 1)
 
 	// Send Back the response
 	return &core.DataRouterRes{Payload: res.Payload, Metadata: res.Metadata}, nil
@@ -286,54 +377,39 @@ func (r component) handleDown(gatewayID []byte, metadata *core.Metadata) error {
 	return nil
 }
 
-func (r component) send(req interface{}, isBroadcast bool, brokers ...core.BrokerClient) (interface{}, error) {
+func (r component) send(bctx context.Context, req interface{}, isBroadcast bool, brokers ...core.BrokerClient) (interface{}, error) {
 	// Define a more helpful context
 	nb := len(brokers)
 	stats.UpdateHistogram("router.send_recipients", int64(nb))
 
 	// Prepare ground for parrallel requests
 	cherr := make(chan error, nb)
-	chresp := make(chan struct {
-		Response    interface{}
-		BrokerIndex uint16
-	}, nb)
-	wg := sync.WaitGroup{}
-	wg.Add(nb)
+	chresp := make(chan brokerResponse, nb)
+	chindex := make(chan uint16, nb)
+	for i := range brokers {
+		chindex <- uint16(i)
+	}
+	close(chindex)
 
-	// Run each request
-	for i, broker := range brokers {
-		go func(index uint16, broker core.BrokerClient) {
+	// Run each request, a bounded number of workers share the recipients
+	workers := r.MaxConcurrentSends
+	if workers > nb {
+		workers = nb
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
 			defer wg.Done()
-
-			// Send request
-			var resp interface{}
-			var err error
-			switch req.(type) {
-			case *core.DataBrokerReq:
-				resp, err = broker.HandleData(context.Background(), req.(*core.DataBrokerReq))
-			case *core.JoinBrokerReq:
-				resp, err = broker.HandleJoin(context.Background(), req.(*core.JoinBrokerReq))
-			default:
-				cherr <- errors.New(errors.Structural, "Unknown request type")
-				return
-			}
-
-			// Handle error
-			if err != nil {
-				if strings.Contains(err.Error(), string(errors.NotFound)) { // FIXME Find a better way to analyze the error
-					cherr <- errors.New(errors.NotFound, "Broker not responsible for the node")
-					return
+			for index := range chindex {
+				resp, err := r.sendOne(bctx, req, brokers[index])
+				if err != nil {
+					cherr <- err
+					continue
 				}
-				cherr <- errors.New(errors.Operational, err)
-				return
+				chresp <- brokerResponse{Response: resp, BrokerIndex: index}
 			}
-
-			// Transfer the response
-			chresp <- struct {
-				Response    interface{}
-				BrokerIndex uint16
-			}{resp, index}
-		}(uint16(i), broker)
+		}()
 	}
 
 	// Wait for each request to be done
@@ -343,19 +419,39 @@ func (r component) send(req interface{}, isBroadcast bool, brokers ...core.Broke
 	close(cherr)
 	close(chresp)
 
+	// The caller gave up, no need to look at the responses
+	if err := bctx.Err(); err != nil {
+		return nil, errors.New(errors.Operational, err)
+	}
+
 	var errored uint8
 	var notFound uint8
+	var rejected uint8
 	for err := range cherr {
-		if err.(errors.Failure).Nature != errors.NotFound {
+		switch err.(errors.Failure).Nature {
+		case errors.NotFound:
+			notFound++
+		case errors.Behavioural: // The broker handled the request and turned it down, e.g. join rate limited
+			rejected++
+		default:
 			errored++
+			atomic.AddUint64(&r.counters.brokersUnreachable, 1)
 			r.Ctx.WithError(err).Warn("Unexpected response")
-		} else {
-			notFound++
 		}
 	}
 
 	// Collect response
 	if len(chresp) > 1 {
+		// Several brokers claim the same device, which hints at a routing misconfiguration
+		ctx := r.Ctx.WithField("Extra", len(chresp)-1)
+		switch req.(type) {
+		case *core.DataBrokerReq:
+			ctx = ctx.WithField("DevAddr", req.(*core.DataBrokerReq).Payload.MACPayload.FHDR.DevAddr)
+		case *core.JoinBrokerReq:
+			ctx = ctx.WithField("DevEUI", req.(*core.JoinBrokerReq).DevEUI)
+		}
+		ctx.Warn("Duplicate positive broker responses")
+		stats.MarkMeter("router.send.duplicate_responses")
 		return nil, errors.New(errors.Behavioural, "Too many positive answers")
 	}
 
@@ -363,6 +459,10 @@ func (r component) send(req interface{}, isBroadcast bool, brokers ...core.Broke
 		return nil, errors.New(errors.Operational, "Unexpected response")
 	}
 
+	if len(chresp) == 0 && rejected > 0 {
+		return nil, errors.New(errors.Behavioural, "Request rejected by broker")
+	}
+
 	if len(chresp) == 0 && notFound > 0 {
 		return nil, errors.New(errors.NotFound, "No available recipient found")
 	}
@@ -391,3 +491,38 @@ func (r component) send(req interface{}, isBroadcast bool, brokers ...core.Broke
 	}
 	return resp.Response, nil
 }
+
+// brokerResponse is a positive answer of a broker, along with its index among the recipients
+type brokerResponse struct {
+	Response    interface{}
+	BrokerIndex uint16
+}
+
+// sendOne forwards a request to a single broker, a slow broker is abandoned so that it doesn't
+// stall the others
+func (r component) sendOne(bctx context.Context, req interface{}, broker core.BrokerClient) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(bctx, r.BrokerTimeout)
+	defer cancel()
+
+	var resp interface{}
+	var err error
+	switch req.(type) {
+	case *core.DataBrokerReq:
+		resp, err = broker.HandleData(ctx, req.(*core.DataBrokerReq))
+	case *core.JoinBrokerReq:
+		resp, err = broker.HandleJoin(ctx, req.(*core.JoinBrokerReq))
+	default:
+		return nil, errors.New(errors.Structural, "Unknown request type")
+	}
+
+	if err != nil {
+		if strings.Contains(err.Error(), string(errors.NotFound)) { // FIXME Find a better way to analyze the error
+			return nil, errors.New(errors.NotFound, "Broker not responsible for the node")
+		}
+		if strings.Contains(err.Error(), string(errors.Behavioural)) {
+			return nil, errors.New(errors.Behavioural, err)
+		}
+		return nil, errors.New(errors.Operational, err)
+	}
+	return resp, nil
+}
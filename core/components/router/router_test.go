@@ -4,15 +4,19 @@
 package router
 
 import (
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/TheThingsNetwork/ttn/core"
 	"github.com/TheThingsNetwork/ttn/core/mocks"
+	"github.com/TheThingsNetwork/ttn/core/types"
 	"github.com/TheThingsNetwork/ttn/utils/errors"
 	. "github.com/TheThingsNetwork/ttn/utils/testing"
+	"github.com/apex/log"
 	"github.com/brocaar/lorawan"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 func TestHandleStats(t *testing.T) {
@@ -2043,6 +2047,59 @@ func TestHandleJoin(t *testing.T) {
 
 	// --------------------
 
+	{
+		Desc(t, "Handle valid join request | both brokers accept")
+
+		// Build
+		dm := mocks.NewDutyManager()
+		res := &core.JoinBrokerRes{
+			Payload: &core.LoRaWANJoinAccept{
+				Payload: []byte{1, 2, 3, 4},
+			},
+			DevAddr:  []byte{1, 2, 3, 4},
+			Metadata: &core.Metadata{},
+		}
+		br1 := mocks.NewAuthBrokerClient()
+		br1.OutHandleJoin.Res = res
+		br2 := mocks.NewAuthBrokerClient()
+		br2.OutHandleJoin.Res = res
+		st := NewMockBrkStorage()
+		r := New(Components{
+			DutyManager: dm,
+			Brokers:     []core.BrokerClient{br1, br2},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  st,
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{})
+		req := &core.JoinRouterReq{
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			AppEUI:    []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:    []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevNonce:  []byte{3, 3},
+			MIC:       []byte{14, 14, 14, 14},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+		}
+
+		// Expect
+		var wantErr = ErrBehavioural
+		var wantRes = new(core.JoinRouterRes)
+		var wantStore []byte
+		var wantUpdateGtw []byte
+
+		// Operate
+		got, err := r.HandleJoin(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, got, "Router Join Responses")
+		Check(t, wantStore, st.InCreate.Entry.DevAddr, "Brokers stored")
+		Check(t, wantUpdateGtw, dm.InUpdate.ID, "Gateway updated")
+	}
+
+	// --------------------
+
 	{
 		Desc(t, "Handle invalid join request -> bad frequency")
 
@@ -2105,25 +2162,1081 @@ func TestHandleJoin(t *testing.T) {
 
 }
 
-func TestStart(t *testing.T) {
-	router := New(Components{
-		Ctx:         GetLogger(t, "Router"),
-		DutyManager: mocks.NewDutyManager(),
-		Brokers:     []core.BrokerClient{mocks.NewAuthBrokerClient()},
-		BrkStorage:  NewMockBrkStorage(),
-		GtwStorage:  NewMockGtwStorage(),
-	}, Options{NetAddr: "localhost:8886"})
+// countingBrokerClient is a broker that counts the join requests it receives
+type countingBrokerClient struct {
+	*mocks.AuthBrokerClient
+	joins *int32
+}
 
-	cherr := make(chan error)
-	go func() {
-		err := router.Start()
-		cherr <- err
-	}()
+// HandleJoin implements the core.BrokerClient interface
+func (m countingBrokerClient) HandleJoin(ctx context.Context, in *core.JoinBrokerReq, opts ...grpc.CallOption) (*core.JoinBrokerRes, error) {
+	atomic.AddInt32(m.joins, 1)
+	<-time.After(20 * time.Millisecond)
+	return m.AuthBrokerClient.HandleJoin(ctx, in, opts...)
+}
 
-	var err error
-	select {
-	case err = <-cherr:
-	case <-time.After(time.Millisecond * 250):
+func TestJoinSuppression(t *testing.T) {
+	newJoinReq := func(devEUI []byte, devNonce []byte) *core.JoinRouterReq {
+		return &core.JoinRouterReq{
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			AppEUI:    []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:    devEUI,
+			DevNonce:  devNonce,
+			MIC:       []byte{14, 14, 14, 14},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+		}
+	}
+	newRouter := func(t *testing.T, joins *int32, o Options) Server {
+		br := mocks.NewAuthBrokerClient()
+		br.OutHandleJoin.Res = &core.JoinBrokerRes{
+			Payload: &core.LoRaWANJoinAccept{
+				Payload: []byte{1, 2, 3, 4},
+			},
+			DevAddr:  []byte{1, 2, 3, 4},
+			Metadata: &core.Metadata{},
+		}
+		return New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{countingBrokerClient{br, joins}},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  NewMockBrkStorage(),
+			GtwStorage:  NewMockGtwStorage(),
+		}, o)
+	}
+	devEUI := []byte{2, 2, 2, 2, 2, 2, 2, 2}
+
+	{
+		Desc(t, "Two identical join requests back-to-back")
+
+		// Build
+		var joins int32
+		r := newRouter(t, &joins, Options{})
+
+		// Expect
+		var wantErr *string
+		var wantJoins int32 = 1
+		var wantRes1 = &core.JoinRouterRes{
+			Payload:  &core.LoRaWANJoinAccept{Payload: []byte{1, 2, 3, 4}},
+			Metadata: &core.Metadata{},
+		}
+		var wantRes2 = new(core.JoinRouterRes)
+
+		// Operate
+		res1, err1 := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+		res2, err2 := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+
+		// Check
+		CheckErrors(t, wantErr, err1)
+		CheckErrors(t, wantErr, err2)
+		Check(t, wantRes1, res1, "First Router Join Responses")
+		Check(t, wantRes2, res2, "Second Router Join Responses")
+		Check(t, wantJoins, atomic.LoadInt32(&joins), "Broker join requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Two identical join requests concurrently")
+
+		// Build
+		var joins int32
+		r := newRouter(t, &joins, Options{})
+
+		// Expect
+		var wantErr *string
+		var wantJoins int32 = 1
+
+		// Operate
+		cherr := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				_, err := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+				cherr <- err
+			}()
+		}
+
+		// Check
+		CheckErrors(t, wantErr, <-cherr)
+		CheckErrors(t, wantErr, <-cherr)
+		Check(t, wantJoins, atomic.LoadInt32(&joins), "Broker join requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Same join request heard by two gateways")
+
+		// Build
+		var joins int32
+		r := newRouter(t, &joins, Options{})
+		req1 := newJoinReq(devEUI, []byte{3, 3})
+		req2 := newJoinReq(devEUI, []byte{3, 3})
+		req2.GatewayID = []byte{8, 7, 6, 5, 4, 3, 2, 1}
+
+		// Expect
+		var wantErr *string
+		var wantJoins int32 = 2
+		var wantRes = &core.JoinRouterRes{
+			Payload:  &core.LoRaWANJoinAccept{Payload: []byte{1, 2, 3, 4}},
+			Metadata: &core.Metadata{},
+		}
+
+		// Operate
+		cherr := make(chan error, 2)
+		chres := make(chan *core.JoinRouterRes, 2)
+		for _, req := range []*core.JoinRouterReq{req1, req2} {
+			go func(req *core.JoinRouterReq) {
+				res, err := r.HandleJoin(context.Background(), req)
+				chres <- res
+				cherr <- err
+			}(req)
+		}
+
+		// Check
+		CheckErrors(t, wantErr, <-cherr)
+		CheckErrors(t, wantErr, <-cherr)
+		Check(t, wantRes, <-chres, "Router Join Responses")
+		Check(t, wantRes, <-chres, "Router Join Responses")
+		Check(t, wantJoins, atomic.LoadInt32(&joins), "Broker join requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Two identical join requests, no join-accept for the first one")
+
+		// Build
+		var joins int32
+		br := mocks.NewAuthBrokerClient()
+		br.OutHandleJoin.Res = &core.JoinBrokerRes{}
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{countingBrokerClient{br, &joins}},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  NewMockBrkStorage(),
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{})
+
+		// Expect
+		var wantJoins int32 = 2
+
+		// Operate
+		_, err := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+		FatalUnless(t, err)
+		_, err = r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+		FatalUnless(t, err)
+
+		// Check
+		Check(t, wantJoins, atomic.LoadInt32(&joins), "Broker join requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Join request retransmitted with a new DevNonce")
+
+		// Build
+		var joins int32
+		r := newRouter(t, &joins, Options{})
+
+		// Expect
+		var wantJoins int32 = 1
+		var wantRes = new(core.JoinRouterRes)
+
+		// Operate
+		_, err := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+		FatalUnless(t, err)
+		res, err := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{4, 4}))
+		FatalUnless(t, err)
+
+		// Check
+		Check(t, wantRes, res, "Router Join Responses")
+		Check(t, wantJoins, atomic.LoadInt32(&joins), "Broker join requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Join requests of two devices")
+
+		// Build
+		var joins int32
+		r := newRouter(t, &joins, Options{})
+
+		// Expect
+		var wantJoins int32 = 2
+
+		// Operate
+		_, err := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+		FatalUnless(t, err)
+		_, err = r.HandleJoin(context.Background(), newJoinReq([]byte{2, 2, 2, 2, 2, 2, 2, 3}, []byte{3, 3}))
+		FatalUnless(t, err)
+
+		// Check
+		Check(t, wantJoins, atomic.LoadInt32(&joins), "Broker join requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Suppressed join request cancelled while waiting")
+
+		// Build
+		var joins int32
+		r := newRouter(t, &joins, Options{})
+		cherr := make(chan error, 1)
+		go func() {
+			_, err := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+			cherr <- err
+		}()
+		<-time.After(5 * time.Millisecond) // The broker takes 20ms to answer the first one
+		bctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// Expect
+		var wantErr = ErrOperational
+		var wantRes = new(core.JoinRouterRes)
+		var wantJoins int32 = 1
+
+		// Operate
+		res, err := r.HandleJoin(bctx, newJoinReq(devEUI, []byte{4, 4}))
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Router Join Responses")
+		FatalUnless(t, <-cherr)
+		Check(t, wantJoins, atomic.LoadInt32(&joins), "Broker join requests")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Two identical join requests, second after the window")
+
+		// Build
+		var joins int32
+		r := newRouter(t, &joins, Options{JoinSuppression: 10 * time.Millisecond})
+
+		// Expect
+		var wantJoins int32 = 2
+
+		// Operate
+		_, err := r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+		FatalUnless(t, err)
+		<-time.After(50 * time.Millisecond)
+		_, err = r.HandleJoin(context.Background(), newJoinReq(devEUI, []byte{3, 3}))
+		FatalUnless(t, err)
+
+		// Check
+		Check(t, wantJoins, atomic.LoadInt32(&joins), "Broker join requests")
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	newStatsReq := func(gid []byte) *core.StatsReq {
+		return &core.StatsReq{
+			GatewayID: gid,
+			Metadata: &core.StatsMetadata{
+				Altitude:  -14,
+				Longitude: 43.333,
+				Latitude:  -2.342,
+			},
+		}
+	}
+
+	{
+		Desc(t, "No broker configured")
+
+		// Build
+		r := New(Components{
+			Ctx:        GetLogger(t, "Router"),
+			BrkStorage: NewMockBrkStorage(),
+			GtwStorage: NewMockGtwStorage(),
+		}, Options{})
+
+		// Expect
+		var wantErr = ErrOperational
+
+		// Operate
+		err := r.Healthy()
+
+		// Check
+		CheckErrors(t, wantErr, err)
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "One broker, no gateway required")
+
+		// Build
+		r := New(Components{
+			Ctx:        GetLogger(t, "Router"),
+			Brokers:    []core.BrokerClient{mocks.NewAuthBrokerClient()},
+			BrkStorage: NewMockBrkStorage(),
+			GtwStorage: NewMockGtwStorage(),
+		}, Options{})
+
+		// Expect
+		var wantErr *string
+
+		// Operate
+		err := r.Healthy()
+
+		// Check
+		CheckErrors(t, wantErr, err)
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Two gateways required, then reported")
+
+		// Build
+		r := New(Components{
+			Ctx:        GetLogger(t, "Router"),
+			Brokers:    []core.BrokerClient{mocks.NewAuthBrokerClient()},
+			BrkStorage: NewMockBrkStorage(),
+			GtwStorage: NewMockGtwStorage(),
+		}, Options{MinGateways: 2})
+
+		// Expect
+		var wantErr1 = ErrOperational
+		var wantErr2 = ErrOperational
+		var wantErr3 *string
+
+		// Operate
+		err1 := r.Healthy()
+		_, err := r.HandleStats(context.Background(), newStatsReq([]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+		FatalUnless(t, err)
+		err2 := r.Healthy()
+		_, err = r.HandleStats(context.Background(), newStatsReq([]byte{8, 7, 6, 5, 4, 3, 2, 1}))
+		FatalUnless(t, err)
+		err3 := r.Healthy()
+
+		// Check
+		CheckErrors(t, wantErr1, err1)
+		CheckErrors(t, wantErr2, err2)
+		CheckErrors(t, wantErr3, err3)
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Gateway reported too long ago")
+
+		// Build
+		r := New(Components{
+			Ctx:        GetLogger(t, "Router"),
+			Brokers:    []core.BrokerClient{mocks.NewAuthBrokerClient()},
+			BrkStorage: NewMockBrkStorage(),
+			GtwStorage: NewMockGtwStorage(),
+		}, Options{MinGateways: 1, GatewayStaleness: 50 * time.Millisecond})
+
+		// Expect
+		var wantErr = ErrOperational
+
+		// Operate
+		_, err := r.HandleStats(context.Background(), newStatsReq([]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+		FatalUnless(t, err)
+		<-time.After(100 * time.Millisecond)
+		err = r.Healthy()
+
+		// Check
+		CheckErrors(t, wantErr, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	{
+		Desc(t, "Handle an uplink with downlink, then a join no broker can answer")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		br.OutHandleData.Res = &core.DataBrokerRes{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataDown),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    2,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      4,
+					FRMPayload: []byte{42, 42, 14, 14},
+				},
+				MIC: []byte{8, 7, 6, 5},
+			},
+			Metadata: new(core.Metadata),
+		}
+		br.Failures["HandleJoin"] = errors.New(errors.Operational, "Mock Error")
+		st := NewMockBrkStorage()
+		st.OutRead.Entries = []brkEntry{
+			{
+				BrokerIndex: 0,
+				until:       time.Now().Add(time.Hour),
+			},
+		}
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{br},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  st,
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{})
+		dataReq := &core.DataRouterReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    1,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{4, 3, 2, 1},
+			},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+		joinReq := &core.JoinRouterReq{
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			AppEUI:    []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:    []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevNonce:  []byte{3, 3},
+			MIC:       []byte{14, 14, 14, 14},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+		}
+
+		// Expect
+		var wantDataErr *string
+		var wantJoinErr = ErrOperational
+		var wantStats = Stats{
+			UplinksIn:          1,
+			DownlinksOut:       1,
+			JoinsRejected:      1,
+			BrokersUnreachable: 1,
+		}
+
+		// Operate
+		_, errData := r.HandleData(context.Background(), dataReq)
+		_, errJoin := r.HandleJoin(context.Background(), joinReq)
+
+		// Check
+		CheckErrors(t, wantDataErr, errData)
+		CheckErrors(t, wantJoinErr, errJoin)
+		Check(t, wantStats, r.Stats(), "Stats")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle a join rate limited by the broker")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		br.Failures["HandleJoin"] = errors.New(errors.Behavioural, "Join rate limited")
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{br},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  NewMockBrkStorage(),
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{})
+		joinReq := &core.JoinRouterReq{
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			AppEUI:    []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:    []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevNonce:  []byte{3, 3},
+			MIC:       []byte{14, 14, 14, 14},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+		}
+
+		// Expect
+		var wantErr = ErrBehavioural
+		var wantRes = new(core.JoinRouterRes)
+		var wantStats = Stats{
+			JoinsRejected: 1,
+		}
+
+		// Operate
+		res, err := r.HandleJoin(context.Background(), joinReq)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Router Join Responses")
+		Check(t, wantStats, r.Stats(), "Stats")
+	}
+}
+
+// slowBrokerClient is a broker that only answers once the request context is done
+type slowBrokerClient struct {
+	*mocks.AuthBrokerClient
+}
+
+// HandleData implements the core.BrokerClient interface
+func (m slowBrokerClient) HandleData(ctx context.Context, in *core.DataBrokerReq, opts ...grpc.CallOption) (*core.DataBrokerRes, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestBrokerTimeout(t *testing.T) {
+	{
+		Desc(t, "Handle valid uplink | 2 brokers known, one hangs | no downlink")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		st := NewMockBrkStorage()
+		st.OutRead.Entries = []brkEntry{
+			{
+				BrokerIndex: 0,
+				until:       time.Now().Add(time.Hour),
+			},
+			{
+				BrokerIndex: 1,
+				until:       time.Now().Add(time.Hour),
+			},
+		}
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{slowBrokerClient{mocks.NewAuthBrokerClient()}, br},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  st,
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{BrokerTimeout: 50 * time.Millisecond})
+		req := &core.DataRouterReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    1,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{4, 3, 2, 1},
+			},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+
+		// Expect
+		var wantErr *string
+		var wantRes = new(core.DataRouterRes)
+		var wantBrReq = true
+		var wantInTime = true
+
+		// Operate
+		start := time.Now()
+		res, err := r.HandleData(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Router Data Responses")
+		Check(t, wantBrReq, br.InHandleData.Req != nil, "Broker Data Requests")
+		Check(t, wantInTime, time.Since(start) < time.Second, "Timely responses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle valid uplink | 1 broker known, hangs | request cancelled")
+
+		// Build
+		st := NewMockBrkStorage()
+		st.OutRead.Entries = []brkEntry{
+			{
+				BrokerIndex: 0,
+				until:       time.Now().Add(time.Hour),
+			},
+		}
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{slowBrokerClient{mocks.NewAuthBrokerClient()}},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  st,
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{BrokerTimeout: 10 * time.Second})
+		req := &core.DataRouterReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    1,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{4, 3, 2, 1},
+			},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+
+		// Expect
+		var wantErr = ErrOperational
+		var wantRes = new(core.DataRouterRes)
+		var wantInTime = true
+
+		// Operate
+		bctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-time.After(50 * time.Millisecond)
+			cancel()
+		}()
+		start := time.Now()
+		res, err := r.HandleData(bctx, req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Router Data Responses")
+		Check(t, wantInTime, time.Since(start) < time.Second, "Timely responses")
+	}
+}
+
+// busyBrokerClient is a broker that keeps track of the number of requests it handles concurrently
+// with its peers
+type busyBrokerClient struct {
+	*mocks.AuthBrokerClient
+	current *int32
+	max     *int32
+	total   *int32
+}
+
+// HandleData implements the core.BrokerClient interface
+func (m busyBrokerClient) HandleData(ctx context.Context, in *core.DataBrokerReq, opts ...grpc.CallOption) (*core.DataBrokerRes, error) {
+	atomic.AddInt32(m.total, 1)
+	current := atomic.AddInt32(m.current, 1)
+	defer atomic.AddInt32(m.current, -1)
+	for {
+		max := atomic.LoadInt32(m.max)
+		if current <= max || atomic.CompareAndSwapInt32(m.max, max, current) {
+			break
+		}
+	}
+	<-time.After(time.Millisecond)
+	return m.AuthBrokerClient.HandleData(ctx, in, opts...)
+}
+
+// newBusyBrokers creates n brokers sharing the same counters, only the broker at the given index
+// is responsible for the device
+func newBusyBrokers(n int, responsible int) ([]core.BrokerClient, *int32, *int32) {
+	var current, max, total int32
+	var brokers []core.BrokerClient
+	for i := 0; i < n; i++ {
+		br := mocks.NewAuthBrokerClient()
+		if i != responsible {
+			br.Failures["HandleData"] = errors.New(errors.NotFound, "Mock Error")
+		}
+		brokers = append(brokers, busyBrokerClient{
+			AuthBrokerClient: br,
+			current:          &current,
+			max:              &max,
+			total:            &total,
+		})
+	}
+	return brokers, &max, &total
+}
+
+func TestConcurrentSends(t *testing.T) {
+	newDataReq := func() *core.DataRouterReq {
+		return &core.DataRouterReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    1,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{4, 3, 2, 1},
+			},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+			GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+	}
+
+	{
+		Desc(t, "Broadcast to 100 brokers | 4 concurrent sends | one responsible")
+
+		// Build
+		brokers, max, total := newBusyBrokers(100, 42)
+		st := NewMockBrkStorage()
+		st.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     brokers,
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  st,
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{MaxConcurrentSends: 4})
+
+		// Expect
+		var wantErr *string
+		var wantRes = new(core.DataRouterRes)
+		var wantTotal int32 = 100
+		var wantBounded = true
+		var wantStore uint16 = 42
+
+		// Operate
+		res, err := r.HandleData(context.Background(), newDataReq())
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Router Data Responses")
+		Check(t, wantTotal, atomic.LoadInt32(total), "Broker Data Requests")
+		Check(t, wantBounded, atomic.LoadInt32(max) <= 4, "Concurrent Broker Data Requests")
+		Check(t, wantStore, st.InCreate.Entry.BrokerIndex, "Brokers stored")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Broadcast to 100 brokers | 4 concurrent sends | none responsible")
+
+		// Build
+		brokers, max, total := newBusyBrokers(100, -1)
+		st := NewMockBrkStorage()
+		st.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     brokers,
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  st,
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{MaxConcurrentSends: 4})
+
+		// Expect
+		var wantErr = ErrNotFound
+		var wantRes = new(core.DataRouterRes)
+		var wantTotal int32 = 100
+		var wantBounded = true
+		var wantStore uint16
+
+		// Operate
+		res, err := r.HandleData(context.Background(), newDataReq())
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Router Data Responses")
+		Check(t, wantTotal, atomic.LoadInt32(total), "Broker Data Requests")
+		Check(t, wantBounded, atomic.LoadInt32(max) <= 4, "Concurrent Broker Data Requests")
+		Check(t, wantStore, st.InCreate.Entry.BrokerIndex, "Brokers stored")
+	}
+}
+
+func TestGatewayBlacklist(t *testing.T) {
+	gid := types.GatewayEUI{1, 2, 3, 4, 5, 6, 7, 8}
+	newDataReq := func() *core.DataRouterReq {
+		return &core.DataRouterReq{
+			Payload: &core.LoRaWANData{
+				MHDR: &core.LoRaWANMHDR{
+					MType: uint32(lorawan.UnconfirmedDataUp),
+					Major: uint32(lorawan.LoRaWANR1),
+				},
+				MACPayload: &core.LoRaWANMACPayload{
+					FHDR: &core.LoRaWANFHDR{
+						DevAddr: []byte{1, 2, 3, 4},
+						FCnt:    1,
+						FCtrl:   new(core.LoRaWANFCtrl),
+					},
+					FPort:      1,
+					FRMPayload: []byte{14, 14, 42, 42},
+				},
+				MIC: []byte{4, 3, 2, 1},
+			},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+			GatewayID: gid.Bytes(),
+		}
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle uplink | Blacklisted gateway, then whitelisted")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		st := NewMockBrkStorage()
+		st.OutRead.Entries = []brkEntry{
+			{
+				BrokerIndex: 0,
+				until:       time.Now().Add(time.Hour),
+			},
+		}
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{br},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  st,
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{})
+
+		// Expect
+		var wantBlacklistedErr = ErrBehavioural
+		var wantBlacklistedBrReq *core.DataBrokerReq
+		var wantWhitelistedErr *string
+		var wantRes = new(core.DataRouterRes)
+
+		// Operate
+		r.BlacklistGateway(gid)
+		res, err := r.HandleData(context.Background(), newDataReq())
+
+		// Check
+		CheckErrors(t, wantBlacklistedErr, err)
+		Check(t, wantRes, res, "Router Data Responses")
+		Check(t, wantBlacklistedBrReq, br.InHandleData.Req, "Broker Data Requests")
+
+		// Operate
+		r.WhitelistGateway(gid)
+		res, err = r.HandleData(context.Background(), newDataReq())
+
+		// Check
+		CheckErrors(t, wantWhitelistedErr, err)
+		Check(t, wantRes, res, "Router Data Responses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle uplink | Other gateway blacklisted")
+
+		// Build
+		st := NewMockBrkStorage()
+		st.OutRead.Entries = []brkEntry{
+			{
+				BrokerIndex: 0,
+				until:       time.Now().Add(time.Hour),
+			},
+		}
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{mocks.NewAuthBrokerClient()},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  st,
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{})
+
+		// Expect
+		var wantErr *string
+		var wantRes = new(core.DataRouterRes)
+
+		// Operate
+		r.BlacklistGateway(types.GatewayEUI{8, 7, 6, 5, 4, 3, 2, 1})
+		res, err := r.HandleData(context.Background(), newDataReq())
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Router Data Responses")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Handle join | Blacklisted gateway")
+
+		// Build
+		br := mocks.NewAuthBrokerClient()
+		r := New(Components{
+			DutyManager: mocks.NewDutyManager(),
+			Brokers:     []core.BrokerClient{br},
+			Ctx:         GetLogger(t, "Router"),
+			BrkStorage:  NewMockBrkStorage(),
+			GtwStorage:  NewMockGtwStorage(),
+		}, Options{})
+		req := &core.JoinRouterReq{
+			GatewayID: gid.Bytes(),
+			AppEUI:    []byte{1, 1, 1, 1, 1, 1, 1, 1},
+			DevEUI:    []byte{2, 2, 2, 2, 2, 2, 2, 2},
+			DevNonce:  []byte{3, 3},
+			MIC:       []byte{14, 14, 14, 14},
+			Metadata: &core.Metadata{
+				Frequency: 868.5,
+			},
+		}
+
+		// Expect
+		var wantErr = ErrBehavioural
+		var wantRes = new(core.JoinRouterRes)
+		var wantBrReq *core.JoinBrokerReq
+
+		// Operate
+		r.BlacklistGateway(gid)
+		res, err := r.HandleJoin(context.Background(), req)
+
+		// Check
+		CheckErrors(t, wantErr, err)
+		Check(t, wantRes, res, "Router Join Responses")
+		Check(t, wantBrReq, br.InHandleJoin.Req, "Broker Join Requests")
+	}
+}
+
+func TestStart(t *testing.T) {
+	router := New(Components{
+		Ctx:         GetLogger(t, "Router"),
+		DutyManager: mocks.NewDutyManager(),
+		Brokers:     []core.BrokerClient{mocks.NewAuthBrokerClient()},
+		BrkStorage:  NewMockBrkStorage(),
+		GtwStorage:  NewMockGtwStorage(),
+	}, Options{NetAddr: "localhost:8886"})
+
+	cherr := make(chan error)
+	go func() {
+		err := router.Start()
+		cherr <- err
+	}()
+
+	var err error
+	select {
+	case err = <-cherr:
+	case <-time.After(time.Millisecond * 250):
+	}
+	CheckErrors(t, nil, err)
+}
+
+func BenchmarkHandleData(b *testing.B) {
+	// Build
+	dm := mocks.NewDutyManager()
+	br := mocks.NewAuthBrokerClient()
+	st := NewMockBrkStorage()
+	gt := NewMockGtwStorage()
+	gt.OutRead.Entry = gtwEntry{
+		GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Metadata: core.StatsMetadata{
+			Altitude:  14,
+			Longitude: 14.0,
+			Latitude:  -14.0,
+		},
+	}
+	st.OutRead.Entries = []brkEntry{
+		{
+			BrokerIndex: 0,
+			until:       time.Now().Add(time.Hour),
+		},
+	}
+	r := New(Components{
+		DutyManager: dm,
+		Brokers:     []core.BrokerClient{br},
+		Ctx:         &log.Logger{Handler: log.HandlerFunc(func(*log.Entry) error { return nil }), Level: log.FatalLevel},
+		BrkStorage:  st,
+		GtwStorage:  gt,
+	}, Options{})
+	req := &core.DataRouterReq{
+		Payload: &core.LoRaWANData{
+			MHDR: &core.LoRaWANMHDR{
+				MType: uint32(lorawan.UnconfirmedDataUp),
+				Major: uint32(lorawan.LoRaWANR1),
+			},
+			MACPayload: &core.LoRaWANMACPayload{
+				FHDR: &core.LoRaWANFHDR{
+					DevAddr: []byte{1, 2, 3, 4},
+					FCnt:    1,
+					FCtrl:   new(core.LoRaWANFCtrl),
+				},
+				FPort:      1,
+				FRMPayload: []byte{14, 14, 42, 42},
+			},
+			MIC: []byte{4, 3, 2, 1},
+		},
+		Metadata: &core.Metadata{
+			DataRate:   "SF7BW125",
+			CodingRate: "4/5",
+			Frequency:  868.5,
+			Rssi:       -20,
+			Lsnr:       5.0,
+		},
+		GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+
+	// Operate
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.HandleData(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	// Build
+	brokers, _, _ := newBusyBrokers(100, 42)
+	st := NewMockBrkStorage()
+	st.Failures["read"] = errors.New(errors.NotFound, "Mock Error")
+	r := New(Components{
+		DutyManager: mocks.NewDutyManager(),
+		Brokers:     brokers,
+		Ctx:         &log.Logger{Handler: log.HandlerFunc(func(*log.Entry) error { return nil }), Level: log.FatalLevel},
+		BrkStorage:  st,
+		GtwStorage:  NewMockGtwStorage(),
+	}, Options{})
+	req := &core.DataRouterReq{
+		Payload: &core.LoRaWANData{
+			MHDR: &core.LoRaWANMHDR{
+				MType: uint32(lorawan.UnconfirmedDataUp),
+				Major: uint32(lorawan.LoRaWANR1),
+			},
+			MACPayload: &core.LoRaWANMACPayload{
+				FHDR: &core.LoRaWANFHDR{
+					DevAddr: []byte{1, 2, 3, 4},
+					FCnt:    1,
+					FCtrl:   new(core.LoRaWANFCtrl),
+				},
+				FPort:      1,
+				FRMPayload: []byte{14, 14, 42, 42},
+			},
+			MIC: []byte{4, 3, 2, 1},
+		},
+		Metadata: &core.Metadata{
+			Frequency: 868.5,
+		},
+		GatewayID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+
+	// Operate
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.HandleData(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
 	}
-	CheckErrors(t, nil, err)
 }
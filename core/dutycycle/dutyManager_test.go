@@ -268,6 +268,44 @@ func TestUpdateAndLookup(t *testing.T) {
 		m.Close()
 	}
 
+	// --------------------
+
+	{
+		Desc(t, "Update up to the sub-band budget then lookup")
+
+		// Build
+		m, _ := NewManager(dutyManagerDB, time.Minute, Europe)
+		toa, err := computeTOA(14, "SF8BW125", "4/5")
+		FatalUnless(t, err)
+		budget := time.Minute / 100 // 1% on EuropeG1
+
+		// Operate
+		var before Cycles
+		for onAir := time.Duration(0); onAir < budget; onAir += toa {
+			before, err = m.Lookup([]byte{8, 8, 8})
+			if err != nil && err.(errors.Failure).Nature != errors.NotFound {
+				t.Fatal(err)
+			}
+			FatalUnless(t, m.Update([]byte{8, 8, 8}, 868.523, 14, "SF8BW125", "4/5"))
+		}
+		FatalUnless(t, m.Update([]byte{8, 8, 8}, 869.525, 14, "SF8BW125", "4/5"))
+		after, err := m.Lookup([]byte{8, 8, 8})
+
+		// Expectation
+		wantBefore := true
+		wantG1 := StateBlocked
+		wantG3 := StateHighlyAvailable
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, wantBefore, StateFromDuty(before[EuropeG1]) != StateBlocked, "Available before the budget is exceeded")
+		Check(t, wantG1, StateFromDuty(after[EuropeG1]), "EuropeG1 state")
+		Check(t, wantG3, StateFromDuty(after[EuropeG3]), "EuropeG3 state")
+
+		// Clean
+		m.Close()
+	}
+
 	// -------------------
 
 	{
@@ -80,6 +80,15 @@ func (c *ScoreComputer) Get(s scores) *BestTarget {
 	return nil
 }
 
+// GetRX2 returns the best score on RX2 only, regardless of the configured spread factor.
+// It returns nil if none of the target is available for a response on RX2
+func (c *ScoreComputer) GetRX2(s scores) *BestTarget {
+	if s.rx2.Score > 0 {
+		return &BestTarget{ID: s.rx2.ID, IsRX2: true}
+	}
+	return nil
+}
+
 func computeScore(duty State, lsnr float64, rssi int) int {
 	var score int
 
@@ -249,3 +249,47 @@ func TestUpdateGet(t *testing.T) {
 		CheckBestTargets(t, &BestTarget{ID: 1, IsRX2: true}, got)
 	}
 }
+
+func TestGetRX2(t *testing.T) {
+	{
+		Desc(t, "SF7 | (1, Ha, Av, -25, 5.0)")
+
+		// Build
+		c, s, err := NewScoreComputer("SF7BW125")
+		CheckErrors(t, nil, err)
+
+		// Operate
+		s = c.Update(s, 1, core.Metadata{
+			DutyRX1: uint32(StateHighlyAvailable),
+			DutyRX2: uint32(StateAvailable),
+			Rssi:    -25,
+			Lsnr:    5.0,
+		})
+		got := c.GetRX2(s)
+
+		// Check
+		CheckBestTargets(t, &BestTarget{ID: 1, IsRX2: true}, got)
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "SF7 | (1, Ha, Bl, -25, 5.0)")
+
+		// Build
+		c, s, err := NewScoreComputer("SF7BW125")
+		CheckErrors(t, nil, err)
+
+		// Operate
+		s = c.Update(s, 1, core.Metadata{
+			DutyRX1: uint32(StateHighlyAvailable),
+			DutyRX2: uint32(StateBlocked),
+			Rssi:    -25,
+			Lsnr:    5.0,
+		})
+		got := c.GetRX2(s)
+
+		// Check
+		CheckBestTargets(t, nil, got)
+	}
+}
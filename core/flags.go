@@ -5,4 +5,6 @@ package core
 
 const (
 	RelaxFcntCheck uint32 = 1 << iota
+	ForceRX2
+	EnableADR
 )
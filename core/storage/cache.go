@@ -0,0 +1,245 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"encoding"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache wraps a storage so that the results of reads are kept in memory for the given ttl. At most
+// maxEntries results are kept, the least recently used ones being evicted first. Writes go through
+// to the storage and invalidate the results they affect.
+//
+// The storage must not be modified without going through the cache.
+func Cache(itf Interface, ttl time.Duration, maxEntries int) Interface {
+	return &cache{
+		Interface:  itf,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// WithCache gives a wrapper caching storages as Cache does, to be given to New
+func WithCache(ttl time.Duration, maxEntries int) Wrapper {
+	return func(itf Interface) Interface {
+		return Cache(itf, ttl, maxEntries)
+	}
+}
+
+type cache struct {
+	Interface
+	sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List // Most recently used at the front
+	generation uint64     // Bumped on each invalidation, so that reads racing with a write aren't kept
+}
+
+type cacheEntry struct {
+	key     string
+	buckets string // The buckets the result was read from, used for invalidation
+	value   encodedSlice
+	expires time.Time
+}
+
+// encodeBuckets gives a representation of a bucket path which can't collide with another one
+func encodeBuckets(buckets [][]byte) string {
+	var buf bytes.Buffer
+	for _, bucket := range buckets {
+		buf.WriteByte(byte(len(bucket) >> 8))
+		buf.WriteByte(byte(len(bucket)))
+		buf.Write(bucket)
+	}
+	return buf.String()
+}
+
+// readKey identifies the result of a Read
+func readKey(key []byte, buckets string) string {
+	return "r" + buckets + string(key)
+}
+
+// readAllKey identifies the result of a ReadAll
+func readAllKey(buckets string) string {
+	return "a" + buckets
+}
+
+// current gives the generation a read from the storage starts at
+func (c *cache) current() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation
+}
+
+// get retrieves a result still valid
+func (c *cache) get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	itf, err := entry.value.decode()
+	if err != nil {
+		return nil, false
+	}
+	return itf, true
+}
+
+// set keeps a result read at the given generation, evicting the least recently used one if the
+// cache is full. Results read before an invalidation are dropped.
+func (c *cache) set(key string, buckets string, value interface{}, generation uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation {
+		return
+	}
+	encoded, err := encodeSlice(value)
+	if err != nil { // Not cached, but the storage is still there
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:     key,
+		buckets: buckets,
+		value:   encoded,
+		expires: time.Now().Add(c.ttl),
+	})
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate drops the results a write to the given key affects
+func (c *cache) invalidate(key []byte, buckets string) {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	for _, k := range []string{readKey(key, buckets), readAllKey(buckets)} {
+		if elem, ok := c.entries[k]; ok {
+			c.lru.Remove(elem)
+			delete(c.entries, k)
+		}
+	}
+}
+
+// invalidateBuckets drops the results read from the given buckets or any of their sub-buckets
+func (c *cache) invalidateBuckets(buckets string) {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	for k, elem := range c.entries {
+		if strings.HasPrefix(elem.Value.(*cacheEntry).buckets, buckets) {
+			c.lru.Remove(elem)
+			delete(c.entries, k)
+		}
+	}
+}
+
+// encodedSlice is a result in its binary form. Entries may hold slices, a copy of the result would
+// share them with the caller; decoding gives entries which share nothing, as read from the storage.
+type encodedSlice struct {
+	typ     reflect.Type
+	entries [][]byte
+}
+
+// encodeSlice encodes a result, which is a slice of entries as guaranteed by the storage
+func encodeSlice(itf interface{}) (encodedSlice, error) {
+	value := reflect.ValueOf(itf)
+	encoded := encodedSlice{typ: value.Type(), entries: make([][]byte, value.Len())}
+	for i := range encoded.entries {
+		data, err := value.Index(i).Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return encodedSlice{}, err
+		}
+		encoded.entries[i] = data
+	}
+	return encoded, nil
+}
+
+// decode gives a fresh result, the same way the storage builds one
+func (e encodedSlice) decode() (interface{}, error) {
+	value := reflect.MakeSlice(e.typ, 0, len(e.entries))
+	for _, data := range e.entries {
+		entry := reflect.New(e.typ.Elem())
+		if err := entry.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		value = reflect.Append(value, entry.Elem())
+	}
+	return value.Interface(), nil
+}
+
+// Read implements the storage.Interface interface
+func (c *cache) Read(key []byte, shape encoding.BinaryUnmarshaler, buckets ...[]byte) (interface{}, error) {
+	b := encodeBuckets(buckets)
+	if itf, ok := c.get(readKey(key, b)); ok {
+		return itf, nil
+	}
+	generation := c.current()
+	itf, err := c.Interface.Read(key, shape, buckets...)
+	if err != nil {
+		return nil, err
+	}
+	c.set(readKey(key, b), b, itf, generation)
+	return itf, nil
+}
+
+// ReadAll implements the storage.Interface interface
+func (c *cache) ReadAll(shape encoding.BinaryUnmarshaler, buckets ...[]byte) (interface{}, error) {
+	b := encodeBuckets(buckets)
+	if itf, ok := c.get(readAllKey(b)); ok {
+		return itf, nil
+	}
+	generation := c.current()
+	itf, err := c.Interface.ReadAll(shape, buckets...)
+	if err != nil {
+		return nil, err
+	}
+	c.set(readAllKey(b), b, itf, generation)
+	return itf, nil
+}
+
+// Update implements the storage.Interface interface
+func (c *cache) Update(key []byte, entries []encoding.BinaryMarshaler, buckets ...[]byte) error {
+	defer c.invalidate(key, encodeBuckets(buckets))
+	return c.Interface.Update(key, entries, buckets...)
+}
+
+// Append implements the storage.Interface interface
+func (c *cache) Append(key []byte, entries []encoding.BinaryMarshaler, buckets ...[]byte) error {
+	defer c.invalidate(key, encodeBuckets(buckets))
+	return c.Interface.Append(key, entries, buckets...)
+}
+
+// Delete implements the storage.Interface interface
+func (c *cache) Delete(key []byte, buckets ...[]byte) error {
+	defer c.invalidate(key, encodeBuckets(buckets))
+	return c.Interface.Delete(key, buckets...)
+}
+
+// Reset implements the storage.Interface interface
+func (c *cache) Reset(buckets ...[]byte) error {
+	defer c.invalidateBuckets(encodeBuckets(buckets))
+	return c.Interface.Reset(buckets...)
+}
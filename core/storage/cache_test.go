@@ -0,0 +1,217 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+)
+
+func TestCache(t *testing.T) {
+	name := path.Join(os.TempDir(), "TestCache.db")
+	defer os.Remove(name)
+
+	db, err := New(name)
+	FatalUnless(t, err)
+	defer db.Close()
+
+	{
+		Desc(t, "Serve repeated reads from the cache")
+
+		// Build
+		collector := newFakeCollector()
+		itf := Cache(Instrument(db, collector), time.Minute, 10)
+		FatalUnless(t, itf.Update([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("hits")))
+
+		// Operate
+		entries1, err1 := itf.Read([]byte{1}, &testEntry{}, []byte("hits"))
+		entries2, err2 := itf.Read([]byte{1}, &testEntry{}, []byte("hits"))
+		_, err3 := itf.ReadAll(&testEntry{}, []byte("hits"))
+		_, err4 := itf.ReadAll(&testEntry{}, []byte("hits"))
+
+		// Expect
+		want := []testEntry{{Data: "TTN"}}
+		wantOperations := map[string]int{"update": 1, "read": 1, "read_all": 1}
+
+		// Check
+		CheckErrors(t, nil, err1)
+		CheckErrors(t, nil, err2)
+		CheckErrors(t, nil, err3)
+		CheckErrors(t, nil, err4)
+		Check(t, want, entries1.([]testEntry), "First read")
+		Check(t, want, entries2.([]testEntry), "Second read")
+		Check(t, wantOperations, collector.Operations, "Operations")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Invalidate reads on write")
+
+		// Build
+		collector := newFakeCollector()
+		itf := Cache(Instrument(db, collector), time.Minute, 10)
+		FatalUnless(t, itf.Update([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("writes")))
+		_, err := itf.Read([]byte{1}, &testEntry{}, []byte("writes"))
+		FatalUnless(t, err)
+		_, err = itf.ReadAll(&testEntry{}, []byte("writes"))
+		FatalUnless(t, err)
+
+		// Operate
+		FatalUnless(t, itf.Append([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "IoT"}}, []byte("writes")))
+		entries, err1 := itf.Read([]byte{1}, &testEntry{}, []byte("writes"))
+		all, err2 := itf.ReadAll(&testEntry{}, []byte("writes"))
+		FatalUnless(t, itf.Delete([]byte{1}, []byte("writes")))
+		_, err3 := itf.Read([]byte{1}, &testEntry{}, []byte("writes"))
+
+		// Expect
+		want := []testEntry{{Data: "TTN"}, {Data: "IoT"}}
+
+		// Check
+		CheckErrors(t, nil, err1)
+		CheckErrors(t, nil, err2)
+		CheckErrors(t, ErrNotFound, err3)
+		Check(t, want, entries.([]testEntry), "Read")
+		Check(t, want, all.([]testEntry), "ReadAll")
+		Check(t, 3, collector.Operations["read"], "Reads")
+		Check(t, 2, collector.Operations["read_all"], "ReadAlls")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Invalidate nested reads on reset")
+
+		// Build
+		itf := Cache(db, time.Minute, 10)
+		FatalUnless(t, itf.Update([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("nested"), []byte("reset")))
+		_, err := itf.Read([]byte{1}, &testEntry{}, []byte("nested"), []byte("reset"))
+		FatalUnless(t, err)
+
+		// Operate
+		FatalUnless(t, itf.Reset([]byte("nested")))
+		_, err = itf.Read([]byte{1}, &testEntry{}, []byte("nested"), []byte("reset"))
+
+		// Check
+		CheckErrors(t, ErrNotFound, err)
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Go back to the storage once entries expired")
+
+		// Build
+		collector := newFakeCollector()
+		itf := Cache(Instrument(db, collector), 10*time.Millisecond, 10)
+		FatalUnless(t, itf.Update([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("ttl")))
+		_, err := itf.Read([]byte{1}, &testEntry{}, []byte("ttl"))
+		FatalUnless(t, err)
+
+		// Operate
+		<-time.After(20 * time.Millisecond)
+		_, err = itf.Read([]byte{1}, &testEntry{}, []byte("ttl"))
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, 2, collector.Operations["read"], "Reads")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Evict the least recently used entry when full")
+
+		// Build
+		collector := newFakeCollector()
+		itf := Cache(Instrument(db, collector), time.Minute, 2)
+		for _, key := range []byte{1, 2, 3} {
+			FatalUnless(t, itf.Update([]byte{key}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("lru")))
+		}
+
+		// Operate
+		for _, key := range []byte{1, 2, 1, 3, 1, 2} {
+			_, err := itf.Read([]byte{key}, &testEntry{}, []byte("lru"))
+			FatalUnless(t, err)
+		}
+
+		// Check
+		// 1, 2 and 3 miss, 3 evicts 2 which misses again
+		Check(t, 4, collector.Operations["read"], "Reads")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Callers can't alter cached entries")
+
+		// Build
+		itf := Cache(db, time.Minute, 10)
+		FatalUnless(t, itf.Update([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("copy")))
+		entries, err := itf.Read([]byte{1}, &testEntry{}, []byte("copy"))
+		FatalUnless(t, err)
+
+		// Operate
+		entries.([]testEntry)[0].Data = "Patate"
+		entries, err = itf.Read([]byte{1}, &testEntry{}, []byte("copy"))
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, []testEntry{{Data: "TTN"}}, entries.([]testEntry), "Entries")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Callers can't alter bytes of cached entries")
+
+		// Build
+		itf := Cache(db, time.Minute, 10)
+		FatalUnless(t, itf.Update([]byte{1}, []encoding.BinaryMarshaler{bytesEntry{Data: []byte("TTN")}}, []byte("deep")))
+		entries, err := itf.Read([]byte{1}, &bytesEntry{}, []byte("deep"))
+		FatalUnless(t, err)
+
+		// Operate
+		entries.([]bytesEntry)[0].Data[0] = 'P'
+		entries, err = itf.Read([]byte{1}, &bytesEntry{}, []byte("deep"))
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, []bytesEntry{{Data: []byte("TTN")}}, entries.([]bytesEntry), "Entries")
+	}
+}
+
+func TestNewWithCache(t *testing.T) {
+	name := path.Join(os.TempDir(), "TestNewWithCache.db")
+	defer os.Remove(name)
+
+	// Build
+	db, err := New(name, WithCache(time.Minute, 10))
+	FatalUnless(t, err)
+	defer db.Close()
+
+	// Check
+	_, ok := db.(*cache)
+	Check(t, true, ok, "Cached storages")
+}
+
+// bytesEntry holds a slice, which a shallow copy would share
+type bytesEntry struct {
+	Data []byte
+}
+
+func (e bytesEntry) MarshalBinary() ([]byte, error) {
+	return e.Data, nil
+}
+
+func (e *bytesEntry) UnmarshalBinary(data []byte) error {
+	e.Data = make([]byte, len(data))
+	copy(e.Data, data)
+	return nil
+}
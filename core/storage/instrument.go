@@ -0,0 +1,124 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding"
+	"reflect"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/utils/stats"
+)
+
+// Collector receives measures about storage operations, for instance to export them as metrics
+type Collector interface {
+	// Observe is called after each operation with its name, duration and outcome
+	Observe(operation string, duration time.Duration, err error)
+	// Entries is called after each successful read with the number of entries read
+	Entries(operation string, n int)
+}
+
+// Instrument wraps a storage so that each of its operations is reported to the given collector.
+// Storages aren't instrumented unless wrapped.
+func Instrument(itf Interface, c Collector) Interface {
+	return instrumented{Interface: itf, collector: c}
+}
+
+// WithInstrument gives a wrapper instrumenting storages as Instrument does, to be given to New
+func WithInstrument(c Collector) Wrapper {
+	return func(itf Interface) Interface {
+		return Instrument(itf, c)
+	}
+}
+
+// StatsCollector reports storage measures through the stats package, under the metric names
+// <prefix>.<operation>, <prefix>.<operation>.errors, <prefix>.<operation>.duration (in µs) and
+// <prefix>.<operation>.entries
+type StatsCollector string
+
+// Observe implements the storage.Collector interface
+func (c StatsCollector) Observe(operation string, duration time.Duration, err error) {
+	name := string(c) + "." + operation
+	stats.MarkMeter(name)
+	stats.UpdateHistogram(name+".duration", int64(duration/time.Microsecond))
+	if err != nil {
+		stats.MarkMeter(name + ".errors")
+	}
+}
+
+// Entries implements the storage.Collector interface
+func (c StatsCollector) Entries(operation string, n int) {
+	stats.UpdateHistogram(string(c)+"."+operation+".entries", int64(n))
+}
+
+type instrumented struct {
+	Interface
+	collector Collector
+}
+
+// observe reports an operation started at the given time
+func (i instrumented) observe(operation string, start time.Time, err error) {
+	i.collector.Observe(operation, time.Since(start), err)
+}
+
+// entries reports the number of entries of a read, which is a slice as guaranteed by the storage
+func (i instrumented) entries(operation string, itf interface{}) {
+	if itf != nil {
+		i.collector.Entries(operation, reflect.ValueOf(itf).Len())
+	}
+}
+
+// Read implements the storage.Interface interface
+func (i instrumented) Read(key []byte, shape encoding.BinaryUnmarshaler, buckets ...[]byte) (interface{}, error) {
+	start := time.Now()
+	itf, err := i.Interface.Read(key, shape, buckets...)
+	i.observe("read", start, err)
+	if err == nil {
+		i.entries("read", itf)
+	}
+	return itf, err
+}
+
+// ReadAll implements the storage.Interface interface
+func (i instrumented) ReadAll(shape encoding.BinaryUnmarshaler, buckets ...[]byte) (interface{}, error) {
+	start := time.Now()
+	itf, err := i.Interface.ReadAll(shape, buckets...)
+	i.observe("read_all", start, err)
+	if err == nil {
+		i.entries("read_all", itf)
+	}
+	return itf, err
+}
+
+// Update implements the storage.Interface interface
+func (i instrumented) Update(key []byte, entries []encoding.BinaryMarshaler, buckets ...[]byte) error {
+	start := time.Now()
+	err := i.Interface.Update(key, entries, buckets...)
+	i.observe("update", start, err)
+	return err
+}
+
+// Append implements the storage.Interface interface
+func (i instrumented) Append(key []byte, entries []encoding.BinaryMarshaler, buckets ...[]byte) error {
+	start := time.Now()
+	err := i.Interface.Append(key, entries, buckets...)
+	i.observe("append", start, err)
+	return err
+}
+
+// Delete implements the storage.Interface interface
+func (i instrumented) Delete(key []byte, buckets ...[]byte) error {
+	start := time.Now()
+	err := i.Interface.Delete(key, buckets...)
+	i.observe("delete", start, err)
+	return err
+}
+
+// Reset implements the storage.Interface interface
+func (i instrumented) Reset(buckets ...[]byte) error {
+	start := time.Now()
+	err := i.Interface.Reset(buckets...)
+	i.observe("reset", start, err)
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright © 2016 The Things Network
+// Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/TheThingsNetwork/ttn/utils/testing"
+)
+
+// fakeCollector counts the operations it is told about
+type fakeCollector struct {
+	Operations map[string]int
+	Failures   map[string]int
+	Sizes      map[string][]int
+}
+
+func newFakeCollector() *fakeCollector {
+	return &fakeCollector{
+		Operations: make(map[string]int),
+		Failures:   make(map[string]int),
+		Sizes:      make(map[string][]int),
+	}
+}
+
+// Observe implements the storage.Collector interface
+func (c *fakeCollector) Observe(operation string, duration time.Duration, err error) {
+	c.Operations[operation]++
+	if err != nil {
+		c.Failures[operation]++
+	}
+}
+
+// Entries implements the storage.Collector interface
+func (c *fakeCollector) Entries(operation string, n int) {
+	c.Sizes[operation] = append(c.Sizes[operation], n)
+}
+
+func TestInstrument(t *testing.T) {
+	name := path.Join(os.TempDir(), "TestInstrument.db")
+	defer os.Remove(name)
+
+	{
+		Desc(t, "Report each operation to the collector")
+
+		// Build
+		db, err := New(name)
+		FatalUnless(t, err)
+		collector := newFakeCollector()
+		itf := Instrument(db, collector)
+		defer itf.Close()
+
+		// Operate
+		FatalUnless(t, itf.Append([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("bucket")))
+		FatalUnless(t, itf.Append([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "Patate"}}, []byte("bucket")))
+		FatalUnless(t, itf.Update([]byte{2}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("bucket")))
+		_, err = itf.Read([]byte{1}, &testEntry{}, []byte("bucket"))
+		FatalUnless(t, err)
+		_, err = itf.ReadAll(&testEntry{}, []byte("bucket"))
+		FatalUnless(t, err)
+		_, errNotFound := itf.Read([]byte{3}, &testEntry{}, []byte("bucket"))
+		FatalUnless(t, itf.Delete([]byte{1}, []byte("bucket")))
+		FatalUnless(t, itf.Reset([]byte("bucket")))
+
+		// Expect
+		wantOperations := map[string]int{
+			"append":   2,
+			"update":   1,
+			"read":     2,
+			"read_all": 1,
+			"delete":   1,
+			"reset":    1,
+		}
+		wantFailures := map[string]int{
+			"read": 1,
+		}
+		wantSizes := map[string][]int{
+			"read":     {2},
+			"read_all": {3},
+		}
+
+		// Check
+		CheckErrors(t, ErrNotFound, errNotFound)
+		Check(t, wantOperations, collector.Operations, "Operations")
+		Check(t, wantFailures, collector.Failures, "Failures")
+		Check(t, wantSizes, collector.Sizes, "Sizes")
+	}
+
+	// --------------------
+
+	{
+		Desc(t, "Instrument a storage when creating it")
+
+		// Build
+		name := path.Join(os.TempDir(), "TestInstrumentNew.db")
+		defer os.Remove(name)
+		collector := newFakeCollector()
+		itf, err := New(name, WithInstrument(collector))
+		FatalUnless(t, err)
+		defer itf.Close()
+
+		// Operate
+		FatalUnless(t, itf.Update([]byte{1}, []encoding.BinaryMarshaler{testEntry{Data: "TTN"}}, []byte("wrapped")))
+		_, err = itf.Read([]byte{1}, &testEntry{}, []byte("wrapped"))
+
+		// Expect
+		wantOperations := map[string]int{"update": 1, "read": 1}
+
+		// Check
+		CheckErrors(t, nil, err)
+		Check(t, wantOperations, collector.Operations, "Operations")
+	}
+}
@@ -45,13 +45,21 @@ type store struct {
 	db *bolt.DB
 }
 
-// New creates a new storage instance ready-to-be-used
-func New(name string) (Interface, error) {
+// Wrapper decorates a storage, as a cache does
+type Wrapper func(itf Interface) Interface
+
+// New creates a new storage instance ready-to-be-used. The given wrappers are applied in order, the
+// last one being the outermost.
+func New(name string, wrappers ...Wrapper) (Interface, error) {
 	db, err := bolt.Open(name, 0600, &bolt.Options{Timeout: time.Second})
 	if err != nil {
 		return nil, errors.New(errors.Operational, err)
 	}
-	return store{db}, nil
+	var itf Interface = store{db}
+	for _, wrap := range wrappers {
+		itf = wrap(itf)
+	}
+	return itf, nil
 }
 
 // Make sure we return a failure
@@ -110,12 +118,19 @@ func (itf store) ReadAll(shape encoding.BinaryUnmarshaler, buckets ...[]byte) (i
 		}
 		return bucket.ForEach(func(_ []byte, v []byte) error {
 			r := readwriter.New(v)
-			r.Read(func(data []byte) {
-				entry := reflect.New(entryType.Elem()).Interface()
-				entry.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
-				entries = reflect.Append(entries, reflect.ValueOf(entry).Elem())
-			})
-			return r.Err()
+			for {
+				r.Read(func(data []byte) {
+					entry := reflect.New(entryType.Elem()).Interface()
+					entry.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+					entries = reflect.Append(entries, reflect.ValueOf(entry).Elem())
+				})
+				if err := r.Err(); err != nil {
+					if failure, ok := err.(errors.Failure); ok && failure.Nature == errors.Behavioural {
+						return nil
+					}
+					return err
+				}
+			}
 		})
 	})
 	if err != nil {
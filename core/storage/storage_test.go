@@ -237,6 +237,20 @@ func TestStoreAndRead(t *testing.T) {
 
 	// ---------------------
 
+	{
+		Desc(t, "Read All entries of a bucket, several per key")
+		err := itf.Update([]byte{0, 0, 1}, []encoding.BinaryMarshaler{&testEntry{Data: "The"}, &testEntry{Data: "Things"}}, []byte("level2"))
+		FatalUnless(t, err)
+		err = itf.Update([]byte{0, 0, 2}, []encoding.BinaryMarshaler{&testEntry{Data: "Network"}}, []byte("level2"))
+		FatalUnless(t, err)
+		entries, err := itf.ReadAll(&testEntry{}, []byte("level2"))
+		want := []testEntry{{Data: "The"}, {Data: "Things"}, {Data: "Network"}}
+		CheckErrors(t, nil, err)
+		Check(t, want, entries, "Entries")
+	}
+
+	// ---------------------
+
 	{
 		Desc(t, "Store, Read, Update, Delete & Reset on closed storage")
 		_ = itf.Close()
@@ -78,6 +78,12 @@ registered on the Handler.`,
 			if (device.Flags & core.RelaxFcntCheck) != 0 {
 				flags = "relax-fcnt"
 			}
+			if (device.Flags & core.ForceRX2) != 0 {
+				flags += ",force-rx2"
+			}
+			if (device.Flags & core.EnableADR) != 0 {
+				flags += ",adr"
+			}
 			if flags == "" {
 				flags = "-"
 			}
@@ -238,6 +244,12 @@ var devicesInfoCmd = &cobra.Command{
 					if (device.Flags & core.RelaxFcntCheck) != 0 {
 						flags = "relax-fcnt"
 					}
+					if (device.Flags & core.ForceRX2) != 0 {
+						flags += ",force-rx2"
+					}
+					if (device.Flags & core.EnableADR) != 0 {
+						flags += ",adr"
+					}
 					if flags == "" {
 						flags = "-"
 					}
@@ -380,6 +392,12 @@ registration on the Handler`,
 			flags |= core.RelaxFcntCheck
 			ctx.Warn("You are disabling frame counter checks. Your device is not protected against replay-attacks.")
 		}
+		if value, _ := cmd.Flags().GetBool("force-rx2"); value {
+			flags |= core.ForceRX2
+		}
+		if value, _ := cmd.Flags().GetBool("adr"); value {
+			flags |= core.EnableADR
+		}
 
 		auth, err := util.LoadAuth(viper.GetString("ttn-account-server"))
 		if err != nil {
@@ -461,4 +479,6 @@ func init() {
 	devicesRegisterCmd.AddCommand(devicesRegisterPersonalizedCmd)
 	devicesRegisterCmd.AddCommand(devicesRegisterDefaultCmd)
 	devicesRegisterPersonalizedCmd.Flags().Bool("relax-fcnt", false, "Allow frame counter to reset (insecure)")
+	devicesRegisterPersonalizedCmd.Flags().Bool("force-rx2", false, "Always send downlinks in the RX2 window")
+	devicesRegisterPersonalizedCmd.Flags().Bool("adr", false, "Adapt the data rate and transmit power of the device")
 }